@@ -3,10 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"drexel.edu/net-quic/pkg/loadbalancer"
 	"drexel.edu/net-quic/pkg/server"
+	"drexel.edu/net-quic/pkg/util"
 )
 
 var (
@@ -15,17 +22,69 @@ var (
 	MODE_LOADBALANCER = false
 	MODE_SERVER       = false
 	CERT_FILE         = ""
+	MAX_VERSION       = 0
+	MAX_PDU_SIZE      = 64 * 1024
+	QLOG_DIR          = ""
+	TRACE_FILE        = ""
+	TRACE_FORMAT      = "jsonl"
+	// JWT_SECRET_FILE holds the secret load balancer tokens are signed with
+	JWT_SECRET_FILE = ""
+	// QUIC TRANSPORT PARAMETERS
+	KEEP_ALIVE           = 10 * time.Second
+	MAX_IDLE_TIMEOUT     = 30 * time.Second
+	HANDSHAKE_TIMEOUT    = 5 * time.Second
+	MAX_INCOMING_STREAMS = int64(100)
+	DATAGRAMS            = true
 	// SERVER PARAMETERS
-	SERVER_IP   = "0.0.0.0"
-	SERVER_PORT = 4243
-	KEY_FILE    = ""
+	// SERVER_ID is the ID load balancers know the server by; SERVER_ID_FILE keeps a generated one
+	SERVER_ID      = ""
+	SERVER_ID_FILE = ""
+	SERVER_IP      = "0.0.0.0"
+	SERVER_PORT    = 4243
+	KEY_FILE       = ""
+	// SESSION_TICKET_KEY is the file holding the TLS session ticket key
+	SESSION_TICKET_KEY = ""
+	// DRAIN_TIMEOUT is how long the server drains after SIGINT/SIGTERM before exiting
+	DRAIN_TIMEOUT = 15
+	// PROBES is a JSON file of application probes to run with every health report
+	PROBES = ""
+	// PROBE_INTERVAL is how long probe results are reused for
+	PROBE_INTERVAL = time.Second
+	// WARM_UP is how long the server reports itself not ready after starting
+	WARM_UP = time.Duration(0)
+	// DEGRADED_THRESHOLDS are metric=value pairs over which the server reports itself degraded
+	DEGRADED_THRESHOLDS = ""
+	// WEIGHT, MAX_CONNECTIONS and LABELS are advertised to load balancers in ACK
+	WEIGHT          = 1
+	MAX_CONNECTIONS = 0
+	LABELS          = ""
+	// MAX_SESSIONS caps the load balancers with a session at once
+	MAX_SESSIONS = 0
+	// SERVER_ADMIN_ADDR is where the unauthenticated admin API listing them listens, if anywhere
+	SERVER_ADMIN_ADDR = ""
+	// SAMPLE_INTERVAL is how often metrics are sampled for windowed aggregates
+	SAMPLE_INTERVAL = time.Second
 
 	// LOADBALANCER PARAMETERS
+	// CLIENT_ID is the identity the load balancer authenticates to servers with
+	CLIENT_ID          = ""
 	SERVERS            = ""
 	LOADBALANCER_PORT  = 4242
 	MAX_FAIL_ATTEMPTS  = 3
 	CHECK_INTERVAL     = 10
 	RECONNECT_INTERVAL = 30
+	CODEC              = "binary"
+	METRICS            = "cpu,memory"
+	PUSH_MODE          = false
+	PUSH_THRESHOLDS    = ""
+	HEARTBEAT_INTERVAL = 500
+	ZERO_RTT           = true
+	// ADMIN_ADDR is where the unauthenticated admin API listens, if anywhere
+	ADMIN_ADDR = ""
+	// MAX_RESPONSE_TIME is the response time over which servers count as degraded
+	MAX_RESPONSE_TIME = time.Duration(0)
+	// AGGREGATE_WINDOWS are the windows servers report metric aggregates over
+	AGGREGATE_WINDOWS = ""
 )
 
 func processFlags() {
@@ -33,15 +92,50 @@ func processFlags() {
 	svrMode := flag.Bool("server", MODE_SERVER, "server mode")
 	tlsMode := flag.Bool("tls-gen", GENERATE_TLS, "generate tls config")
 	flag.StringVar(&CERT_FILE, "cert-file", CERT_FILE, "tls certificate file")
+	flag.IntVar(&MAX_VERSION, "max-version", MAX_VERSION, "highest protocol version to negotiate (0 for the latest)")
+	flag.IntVar(&MAX_PDU_SIZE, "max-pdu-size", MAX_PDU_SIZE, "largest PDU payload in bytes to accept once negotiated")
+	flag.StringVar(&QLOG_DIR, "qlog-dir", QLOG_DIR, "directory to write a qlog file per QUIC connection to (empty to disable)")
+	flag.StringVar(&TRACE_FILE, "trace-file", TRACE_FILE, "file to record every PDU sent and received in (empty to disable)")
+	flag.StringVar(&TRACE_FORMAT, "trace-format", TRACE_FORMAT, "format of the trace file (jsonl or binary)")
+	flag.StringVar(&JWT_SECRET_FILE, "jwt-secret-file", JWT_SECRET_FILE, "file holding the secret load balancer tokens are signed and verified with (default $"+util.JWT_SECRET_ENV+")")
+	flag.DurationVar(&KEEP_ALIVE, "keep-alive", KEEP_ALIVE, "period of QUIC keep-alive PINGs on quiet connections (0 to disable)")
+	flag.DurationVar(&MAX_IDLE_TIMEOUT, "max-idle-timeout", MAX_IDLE_TIMEOUT, "close QUIC connections that receive nothing for this long")
+	flag.DurationVar(&HANDSHAKE_TIMEOUT, "handshake-timeout", HANDSHAKE_TIMEOUT, "give up on QUIC handshakes that make no progress for this long")
+	flag.Int64Var(&MAX_INCOMING_STREAMS, "max-incoming-streams", MAX_INCOMING_STREAMS, "most streams the peer may have open at once")
+	flag.BoolVar(&DATAGRAMS, "datagrams", DATAGRAMS, "enable QUIC datagrams, which carry heartbeats")
 	flag.StringVar(&KEY_FILE, "key-file", KEY_FILE, "[server mode] tls key file")
+	flag.StringVar(&SESSION_TICKET_KEY, "session-ticket-key", SESSION_TICKET_KEY, "[server mode] file holding the TLS session ticket key, created if missing; keeps 0-RTT resumption working across restarts")
+	flag.StringVar(&PROBES, "probes", PROBES, "[server mode] JSON file of application probes (http, tcp, unix, exec) to report with health data")
+	flag.DurationVar(&PROBE_INTERVAL, "probe-interval", PROBE_INTERVAL, "[server mode] run probes at most this often, sharing the results between load balancers")
+	flag.DurationVar(&WARM_UP, "warm-up", WARM_UP, "[server mode] report not-ready for this long after starting, e.g. while the application warms up")
+	flag.StringVar(&DEGRADED_THRESHOLDS, "degraded-thresholds", DEGRADED_THRESHOLDS, "[server mode] comma-separated metric=value pairs at or over which the server reports degraded (e.g. cpu_usage_percent=90)")
+	flag.StringVar(&SERVER_ID, "server-id", SERVER_ID, "[server mode] ID load balancers know the server by (default <hostname>-<port>)")
+	flag.StringVar(&SERVER_ID_FILE, "server-id-file", SERVER_ID_FILE, "[server mode] file holding the server ID, generated on first run if missing (ignored with -server-id)")
+	flag.IntVar(&WEIGHT, "weight", WEIGHT, "[server mode] capacity weight relative to other servers, advertised to load balancers")
+	flag.IntVar(&MAX_CONNECTIONS, "max-connections", MAX_CONNECTIONS, "[server mode] client connections the server takes at once, advertised to load balancers (0 for no limit)")
+	flag.StringVar(&LABELS, "labels", LABELS, "[server mode] comma-separated key=value labels advertised to load balancers (e.g. zone=us-east-1a,role=api)")
+	flag.IntVar(&MAX_SESSIONS, "max-sessions", MAX_SESSIONS, "[server mode] load balancers that may have a session at once (0 for no limit)")
+	flag.StringVar(&SERVER_ADMIN_ADDR, "server-admin-addr", SERVER_ADMIN_ADDR, "[server mode] address of the admin API listing the load balancers watching the server, e.g. 127.0.0.1:4241 (off by default; it is unauthenticated, so keep it on loopback)")
+	flag.DurationVar(&SAMPLE_INTERVAL, "sample-interval", SAMPLE_INTERVAL, "[server mode] how often metrics are sampled for the windowed aggregates load balancers can ask for")
 	flag.StringVar(&SERVER_IP, "server-ip", SERVER_IP, "[server mode] server IP")
 	flag.IntVar(&SERVER_PORT, "server-port", SERVER_PORT, "[server mode] server port")
+	flag.IntVar(&DRAIN_TIMEOUT, "drain-timeout", DRAIN_TIMEOUT, "[server mode] seconds to keep answering with draining errors after SIGINT/SIGTERM before exiting")
+	flag.StringVar(&CLIENT_ID, "client-id", CLIENT_ID, "[loadbalancer mode] identity to authenticate to servers with, unique per load balancer (default <hostname>-<port>)")
 	flag.StringVar(&SERVERS, "servers", SERVERS, "[loadbalancer mode] comma-separated list of server addresses (host:port)")
 
 	flag.IntVar(&LOADBALANCER_PORT, "loadbalancer-port", LOADBALANCER_PORT, "[loadbalancer mode] port for the loadbalancer")
 	flag.IntVar(&MAX_FAIL_ATTEMPTS, "max-fail-attempts", MAX_FAIL_ATTEMPTS, "[loadbalancer mode] maximum fail attempts before marking server as down")
 	flag.IntVar(&CHECK_INTERVAL, "check-interval", CHECK_INTERVAL, "[loadbalancer mode] interval for health checks and status display in seconds")
 	flag.IntVar(&RECONNECT_INTERVAL, "reconnect-interval", RECONNECT_INTERVAL, "[loadbalancer mode] interval for attempting to reconnect to down servers in seconds")
+	flag.StringVar(&CODEC, "codec", CODEC, "[loadbalancer mode] preferred PDU codec (binary or json)")
+	flag.StringVar(&METRICS, "metrics", METRICS, "[loadbalancer mode] comma-separated collectors or metrics to ask servers for (cpu, memory, load, disk, network, fds, goroutines, response_time)")
+	flag.StringVar(&AGGREGATE_WINDOWS, "aggregate-windows", AGGREGATE_WINDOWS, "[loadbalancer mode] comma-separated windows to ask servers for metric aggregates over (10s, 1m, 5m)")
+	flag.BoolVar(&PUSH_MODE, "push", PUSH_MODE, "[loadbalancer mode] ask servers to push health data instead of polling them")
+	flag.IntVar(&HEARTBEAT_INTERVAL, "heartbeat-interval", HEARTBEAT_INTERVAL, "[loadbalancer mode] interval for heartbeat datagrams from servers in milliseconds (0 to disable)")
+	flag.BoolVar(&ZERO_RTT, "zero-rtt", ZERO_RTT, "[loadbalancer mode] resume TLS sessions with known servers using 0-RTT")
+	flag.StringVar(&ADMIN_ADDR, "admin-addr", ADMIN_ADDR, "[loadbalancer mode] address of the admin API used by qhcp, e.g. 127.0.0.1:4240 (off by default; it is unauthenticated, so keep it on loopback)")
+	flag.DurationVar(&MAX_RESPONSE_TIME, "max-response-time", MAX_RESPONSE_TIME, "[loadbalancer mode] mark servers degraded while their health check p95 or probe latency is over this (0 to disable)")
+	flag.StringVar(&PUSH_THRESHOLDS, "push-thresholds", PUSH_THRESHOLDS, "[loadbalancer mode] comma-separated metric=value pairs that make servers push right away (e.g. cpu_usage_percent=80)")
 
 	flag.Parse()
 	MODE_LOADBALANCER = *lbMode
@@ -53,8 +147,69 @@ func processFlags() {
 		MODE_LOADBALANCER = true
 	}
 }
+
+// parseThresholds parses comma-separated metric=value pairs.
+func parseThresholds(spec string) map[string]float64 {
+	thresholds := make(map[string]float64)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		metric, value, ok := strings.Cut(pair, "=")
+		threshold, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			log.Fatalf("invalid threshold %q, expected metric=value", pair)
+		}
+		thresholds[metric] = threshold
+	}
+	return thresholds
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(spec string) []string {
+	var items []string
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseLabels parses comma-separated key=value labels.
+func parseLabels(spec string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			log.Fatalf("invalid label %q, expected key=value", pair)
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// transportConfig returns the QUIC transport parameters set by the flags.
+func transportConfig() util.TransportConfig {
+	return util.TransportConfig{
+		KeepAlivePeriod:    KEEP_ALIVE,
+		MaxIdleTimeout:     MAX_IDLE_TIMEOUT,
+		HandshakeTimeout:   HANDSHAKE_TIMEOUT,
+		MaxIncomingStreams: MAX_INCOMING_STREAMS,
+		DisableDatagrams:   !DATAGRAMS,
+	}
+}
+
 func main() {
 	processFlags()
+	if JWT_SECRET_FILE != "" {
+		if err := util.LoadJWTSecret(JWT_SECRET_FILE); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if MODE_LOADBALANCER {
 		serverList := make([]string, 0)
 		for _, serverAddr := range strings.Split(SERVERS, ",") {
@@ -65,25 +220,75 @@ func main() {
 		}
 
 		lbConfig := loadbalancer.LoadBalancerConfig{
+			ClientID:          CLIENT_ID,
 			Servers:           serverList,
 			CertFile:          CERT_FILE,
 			MaxFailAttempts:   MAX_FAIL_ATTEMPTS,
 			CheckInterval:     CHECK_INTERVAL,
 			ReconnectInterval: RECONNECT_INTERVAL,
 			Port:              LOADBALANCER_PORT,
+			Codec:             CODEC,
+			Metrics:           splitList(METRICS),
+			AggregateWindows:  splitList(AGGREGATE_WINDOWS),
+			MaxVersion:        MAX_VERSION,
+			MaxPduSize:        MAX_PDU_SIZE,
+			PushMode:          PUSH_MODE,
+			PushThresholds:    parseThresholds(PUSH_THRESHOLDS),
+			HeartbeatInterval: HEARTBEAT_INTERVAL,
+			QlogDir:           QLOG_DIR,
+			TraceFile:         TRACE_FILE,
+			TraceFormat:       TRACE_FORMAT,
+			ZeroRTT:           ZERO_RTT,
+			AdminAddr:         ADMIN_ADDR,
+			MaxResponseTime:   MAX_RESPONSE_TIME,
+			TransportConfig:   transportConfig(),
 		}
 		lb := loadbalancer.NewLoadBalancer(lbConfig)
 		lb.Run()
 	} else {
 		serverConfig := server.ServerConfig{
-			GenTLS:   GENERATE_TLS,
-			CertFile: CERT_FILE,
-			KeyFile:  KEY_FILE,
-			Address:  SERVER_IP,
-			Port:     SERVER_PORT,
+			ServerID:             SERVER_ID,
+			IDFile:               SERVER_ID_FILE,
+			GenTLS:               GENERATE_TLS,
+			CertFile:             CERT_FILE,
+			KeyFile:              KEY_FILE,
+			Address:              SERVER_IP,
+			Port:                 SERVER_PORT,
+			MaxVersion:           MAX_VERSION,
+			MaxPduSize:           MAX_PDU_SIZE,
+			QlogDir:              QLOG_DIR,
+			TraceFile:            TRACE_FILE,
+			TraceFormat:          TRACE_FORMAT,
+			SessionTicketKeyFile: SESSION_TICKET_KEY,
+			TransportConfig:      transportConfig(),
+			WarmUp:               WARM_UP,
+			DegradedThresholds:   parseThresholds(DEGRADED_THRESHOLDS),
+			Weight:               WEIGHT,
+			MaxConnections:       MAX_CONNECTIONS,
+			Labels:               parseLabels(LABELS),
+			MaxSessions:          MAX_SESSIONS,
+			AdminAddr:            SERVER_ADMIN_ADDR,
+			SampleInterval:       SAMPLE_INTERVAL,
+		}
+		if PROBES != "" {
+			probes, err := server.LoadProbes(PROBES)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig.Probes = probes
+			serverConfig.ProbeInterval = PROBE_INTERVAL
 		}
 
 		server := server.NewServer(serverConfig)
+		go func() {
+			// Let load balancers move away before shutting down
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			<-signals
+			server.Drain()
+			time.Sleep(time.Duration(DRAIN_TIMEOUT) * time.Second)
+			os.Exit(0)
+		}()
 		server.Run()
 	}
 }
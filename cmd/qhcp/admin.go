@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"drexel.edu/net-quic/pkg/admin"
+	"drexel.edu/net-quic/pkg/loadbalancer"
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// servers lists the servers of a running load balancer.
+func servers(args []string) {
+	flags := flag.NewFlagSet("servers", flag.ExitOnError)
+	adminAddr := flags.String("admin", defaultAdminAddr, "address of the load balancer's admin API, as given to its -admin-addr")
+	var labels []string
+	flags.Func("label", "only list servers with this key=value label (repeatable)", func(label string) error {
+		labels = append(labels, label)
+		return nil
+	})
+	flags.Parse(args)
+
+	query := url.Values{"label": labels}
+	var statuses []loadbalancer.ServerStatus
+	adminRequest(http.MethodGet, *adminAddr, "/servers?"+query.Encode(), nil, &statuses)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tADDRESS\tHOSTNAME\tSTATE\tWEIGHT\tMAX CONNS\tLABELS\tRTT P95\tINTERVAL\tMETRICS\tPROBES")
+	for _, st := range statuses {
+		state := st.Status
+		if st.StatusReason != "" {
+			state += ": " + st.StatusReason
+		}
+		probes := make([]string, len(st.Probes))
+		for i, probe := range st.Probes {
+			result := "ok"
+			if !probe.Passed {
+				result = "failed"
+			}
+			probes[i] = fmt.Sprintf("%s=%s(%.1fms)", probe.Name, result, probe.LatencyMs)
+		}
+		maxConns := "-"
+		if st.MaxConnections > 0 {
+			maxConns = strconv.Itoa(st.MaxConnections)
+		}
+		rtt := "-"
+		if st.ResponseTime != nil {
+			rtt = fmt.Sprintf("%.1fms", st.ResponseTime.P95Ms)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%ds\t%s\t%s\n", st.ServerID, st.Address, st.Hostname, state,
+			st.Weight, maxConns, formatLabels(st.Labels), rtt, st.CheckInterval, strings.Join(st.Metrics, ","), strings.Join(probes, ","))
+	}
+	w.Flush()
+}
+
+// sessions lists the load balancers watching a running server.
+func sessions(args []string) {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	adminAddr := flags.String("admin", defaultServerAdminAddr, "address of the server's admin API, as given to its -server-admin-addr")
+	flags.Parse(args)
+
+	var statuses []admin.SessionStatus
+	adminRequest(http.MethodGet, *adminAddr, "/sessions", nil, &statuses)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LOAD BALANCER\tADDRESS\tSINCE\tVERSION\tCODEC\tINTERVAL\tMETRICS\tPUSH\tWINDOWS")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%ds\t%s\t%t\t%s\n", st.LoadBalancer, st.Address, st.EstablishedAt.Format(time.RFC3339),
+			st.Version, st.Codec, st.CheckInterval, strings.Join(st.Metrics, ","), st.PushMode, strings.Join(st.AggregateWindows, ","))
+	}
+	w.Flush()
+}
+
+// formatLabels lists labels as key=value pairs, sorted by key.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// config sends a CONFIG_UPDATE to a server through a running load balancer.
+func config(args []string) {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	adminAddr := flags.String("admin", defaultAdminAddr, "address of the load balancer's admin API, as given to its -admin-addr")
+	interval := flags.Int("interval", 0, "new check interval in seconds (0 to keep it)")
+	metrics := flags.String("metrics", "", "comma-separated collectors or metrics to report (empty to keep them)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("qhcp: config needs exactly one server ID")
+	}
+
+	update := &pdu.ConfigUpdatePayload{NewCheckInterval: *interval}
+	if *metrics != "" {
+		update.NewMetrics = strings.Split(*metrics, ",")
+	}
+	if err := update.Validate(); err != nil {
+		log.Fatalf("qhcp: %s", err)
+	}
+	ack := &pdu.ConfigAckPayload{}
+	adminRequest(http.MethodPost, *adminAddr, "/servers/"+url.PathEscape(flags.Arg(0))+"/config", update, ack)
+	fmt.Printf("%s: %s\n", ack.UpdateStatus, ack.Message)
+	fmt.Printf("check interval: %ds\n", ack.CheckInterval)
+	fmt.Printf("metrics: %s\n", strings.Join(ack.Metrics, ","))
+	if len(ack.RejectedMetrics) > 0 {
+		fmt.Printf("rejected metrics: %s\n", strings.Join(ack.RejectedMetrics, ","))
+	}
+}
+
+// adminRequest calls the load balancer's admin API and decodes the
+// response into out, exiting on failure.
+func adminRequest(method, admin, path string, in, out any) {
+	var body bytes.Buffer
+	if in != nil {
+		json.NewEncoder(&body).Encode(in)
+	}
+	req, err := http.NewRequest(method, "http://"+admin+path, &body)
+	if err != nil {
+		log.Fatalf("qhcp: %s", err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("qhcp: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error        string `json:"error"`
+			ErrorCode    int    `json:"error_code"`
+			ErrorMessage string `json:"error_message"`
+		}
+		json.NewDecoder(rsp.Body).Decode(&failure)
+		if failure.ErrorCode != 0 {
+			log.Fatalf("qhcp: server answered with %d %s: %s", failure.ErrorCode, pdu.ErrorName(failure.ErrorCode), failure.ErrorMessage)
+		}
+		log.Fatalf("qhcp: %s: %s", rsp.Status, failure.Error)
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+		log.Fatalf("qhcp: malformed response: %s", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+const usage = `usage: qhcp <command> [arguments]
+
+commands:
+  decode [file ...]      pretty-print a PDU trace (stdin if no file is given)
+  servers                list the servers of a running load balancer
+  config <server id>     change a server's check interval or metrics
+  sessions               list the load balancers watching a running server
+`
+
+// defaultAdminAddr is where qhcp looks for the load balancer's admin API
+// unless told otherwise. The load balancer only serves it when started
+// with -admin-addr.
+const defaultAdminAddr = "127.0.0.1:4240"
+
+// defaultServerAdminAddr is where qhcp looks for the server's admin API
+// unless told otherwise. The server only serves it when started with
+// -server-admin-addr.
+const defaultServerAdminAddr = "127.0.0.1:4241"
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "decode":
+		decode(os.Args[2:])
+	case "servers":
+		servers(os.Args[2:])
+	case "config":
+		config(os.Args[2:])
+	case "sessions":
+		sessions(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "qhcp: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+// decode pretty-prints the PDU traces named in args.
+func decode(args []string) {
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	stream := flags.String("stream", "", "only show PDUs on this stream (control or health)")
+	peer := flags.String("peer", "", "only show PDUs exchanged with this peer address")
+	raw := flags.Bool("raw", false, "also print the raw payload")
+	flags.Parse(args)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err := decodeFile(name, func(rec *pdu.TraceRecord) {
+			if (*stream != "" && rec.Stream != *stream) || (*peer != "" && rec.Peer != *peer) {
+				return
+			}
+			printRecord(os.Stdout, rec, *raw)
+		}); err != nil {
+			log.Fatalf("qhcp: %s: %s", name, err)
+		}
+	}
+}
+
+// decodeFile passes every record of the trace in the named file, or
+// stdin for "-", to show. The file is closed before it returns.
+func decodeFile(name string, show func(rec *pdu.TraceRecord)) error {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	tr := pdu.NewTraceReader(r)
+	for {
+		rec, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		show(rec)
+	}
+}
+
+// printRecord writes a header line for the record followed by one line
+// per payload field.
+func printRecord(w io.Writer, rec *pdu.TraceRecord, raw bool) {
+	arrow := "<-"
+	if rec.Direction == pdu.TRACE_SEND {
+		arrow = "->"
+	}
+	if rec.PDU == nil {
+		fmt.Fprintf(w, "%s %s %s %-21s %-7s unreadable frame: %s\n",
+			rec.Time.Format(time.RFC3339Nano), rec.Direction, arrow, rec.Peer, rec.Stream, rec.Error)
+		return
+	}
+	msg := rec.PDU
+	fmt.Fprintf(w, "%s %s %s %-21s %-7s id=%-5d %s (%d bytes)\n",
+		rec.Time.Format(time.RFC3339Nano), rec.Direction, arrow, rec.Peer, rec.Stream, msg.ID,
+		strings.Trim(msg.GetTypeAsString(), "*"), len(msg.Data))
+	for _, line := range payloadLines(msg) {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+	if raw && len(msg.Data) > 0 {
+		fmt.Fprintf(w, "    raw: %s\n", msg.Data)
+	}
+}
+
+// payloadLines decodes the PDU's payload and returns its fields as
+// "name: value" lines, sorted by name.
+func payloadLines(msg *pdu.PDU) []string {
+	payload := pdu.NewPayloadFor(msg.Mtype)
+	if payload == nil {
+		if len(msg.Data) == 0 {
+			return nil
+		}
+		return []string{fmt.Sprintf("data: %q", msg.Data)}
+	}
+	if err := pdu.DecodePayload(msg.Data, payload); err != nil {
+		return []string{fmt.Sprintf("undecodable payload: %s", err), fmt.Sprintf("data: %q", msg.Data)}
+	}
+	encoded, _ := json.Marshal(payload)
+	fields := make(map[string]json.RawMessage)
+	json.Unmarshal(encoded, &fields)
+	lines := make([]string, 0, len(fields))
+	for name, value := range fields {
+		line := fmt.Sprintf("%s: %s", name, value)
+		if msg.Mtype == pdu.TYPE_ERROR && name == "error_code" {
+			var code int
+			json.Unmarshal(value, &code)
+			line += fmt.Sprintf(" (%s, %s)", pdu.ErrorName(code), pdu.ClassifyError(code))
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,25 @@
+// Package admin holds the types the server's admin API returns, so that
+// clients such as qhcp can decode them without linking in the server and
+// its metric collectors.
+package admin
+
+import "time"
+
+// SessionStatus describes the session of one load balancer watching the
+// server, as returned by Server.Sessions and GET /sessions.
+type SessionStatus struct {
+	// LoadBalancer is the client_id the load balancer authenticated with.
+	LoadBalancer  string    `json:"load_balancer"`
+	Address       string    `json:"address"`
+	EstablishedAt time.Time `json:"established_at"`
+	Version       int       `json:"version"`
+	Codec         string    `json:"codec"`
+	// CheckInterval, Metrics and PushMode are the session's current
+	// health check configuration.
+	CheckInterval int      `json:"check_interval"`
+	Metrics       []string `json:"metrics"`
+	PushMode      bool     `json:"push_mode"`
+	// AggregateWindows are the windows the session's health reports
+	// carry aggregates over.
+	AggregateWindows []string `json:"aggregate_windows,omitempty"`
+}
@@ -0,0 +1,737 @@
+// Package conformance checks that a server agent speaks the health check
+// protocol correctly. Run drives a live agent over QUIC through every
+// message type, including malformed, truncated and out-of-order input,
+// and checks the exact PDUs it answers with. Any agent can run it
+// against itself from a test of its own:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.Target{Addr: "127.0.0.1:4243"})
+//	}
+//
+// Dial and Peer are the same load balancer end of a connection, for
+// tests of an agent's own behaviour beyond the suite.
+package conformance
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+// timeout bounds every wait for the agent.
+const timeout = 5 * time.Second
+
+// Target describes the agent under test. It must speak
+// pdu.MAX_PROTOCOL_VERSION and accept datagrams if it sends heartbeats.
+type Target struct {
+	// Addr is the agent's UDP address (host:port).
+	Addr string
+	// TLS is the client TLS configuration. It defaults to util.BuildTLSClientConfig.
+	TLS *tls.Config
+	// AuthToken is presented in HELLO. It defaults to a token from
+	// util.GenerateJWT, which needs the agent's JWT secret.
+	AuthToken string
+}
+
+// Run runs the conformance suite against target, one subtest per case.
+// Every case uses a connection of its own.
+func Run(t *testing.T, target Target) {
+	target = target.withDefaults()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.run(Dial(t, target))
+		})
+	}
+}
+
+// withDefaults fills in the TLS configuration and token if they are unset.
+func (target Target) withDefaults() Target {
+	if target.TLS == nil {
+		target.TLS = util.BuildTLSClientConfig()
+	}
+	if target.AuthToken == "" {
+		target.AuthToken = util.GenerateJWT("conformance")
+	}
+	return target
+}
+
+var cases = []struct {
+	name string
+	run  func(p *Peer)
+}{
+	{"Hello", testHello},
+	{"HelloJsonCodec", testHelloJsonCodec},
+	{"HelloLegacyVersion", testHelloLegacyVersion},
+	{"HelloLegacyStream", testHelloLegacyStream},
+	{"HelloUnsupportedVersion", testHelloUnsupportedVersion},
+	{"HelloBadToken", testHelloBadToken},
+	{"HelloMalformedPayload", testHelloMalformedPayload},
+	{"HelloInvalidPayload", testHelloInvalidPayload},
+	{"MessagesBeforeHello", testMessagesBeforeHello},
+	{"UnknownTypeBeforeHello", testUnknownTypeBeforeHello},
+	{"SecondHello", testSecondHello},
+	{"UnknownTypeAfterHello", testUnknownTypeAfterHello},
+	{"ServerMessagesFromClient", testServerMessagesFromClient},
+	{"MalformedFrame", testMalformedFrame},
+	{"MalformedBinaryFrame", testMalformedBinaryFrame},
+	{"OversizedFrame", testOversizedFrame},
+	{"TruncatedFrame", testTruncatedFrame},
+	{"TruncatedHeader", testTruncatedHeader},
+	{"UnknownStreamType", testUnknownStreamType},
+	{"HealthRequest", testHealthRequest},
+	{"PipelinedHealthRequests", testPipelinedHealthRequests},
+	{"HealthStream", testHealthStream},
+	{"HealthStreamRejectsControlMessages", testHealthStreamRejectsControlMessages},
+	{"ConfigUpdate", testConfigUpdate},
+	{"ConfigUpdateMalformed", testConfigUpdateMalformed},
+	{"RateLimit", testRateLimit},
+	{"PushMode", testPushMode},
+	{"Heartbeats", testHeartbeats},
+	{"Terminate", testTerminate},
+	{"MessagesAfterTerminate", testMessagesAfterTerminate},
+}
+
+// helloPayload returns the HELLO that cases send unless they need something else.
+func (p *Peer) helloPayload() *pdu.HelloPayload {
+	return &pdu.HelloPayload{
+		SupportedMetrics: []string{"cpu_usage_percent", "memory_usage_percent"},
+		CheckInterval:    5,
+		AuthToken:        p.target.AuthToken,
+		MinVersion:       pdu.MIN_PROTOCOL_VERSION,
+		MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+		Codecs:           []string{pdu.CODEC_BINARY, pdu.CODEC_JSON},
+		MaxPduSize:       64 * 1024,
+	}
+}
+
+func testHello(p *Peer) {
+	hello := p.helloPayload()
+	ack := p.hello(hello)
+	if ack.Version != pdu.MAX_PROTOCOL_VERSION {
+		p.t.Errorf("ACK version = %d, want %d", ack.Version, pdu.MAX_PROTOCOL_VERSION)
+	}
+	if ack.Codec != pdu.CODEC_BINARY {
+		p.t.Errorf("ACK codec = %q, want %q", ack.Codec, pdu.CODEC_BINARY)
+	}
+	if ack.MaxPduSize < pdu.MAX_PDU_SIZE || ack.MaxPduSize > hello.MaxPduSize {
+		p.t.Errorf("ACK max_pdu_size = %d, want between %d and %d", ack.MaxPduSize, pdu.MAX_PDU_SIZE, hello.MaxPduSize)
+	}
+	if ack.CheckInterval != hello.CheckInterval {
+		p.t.Errorf("ACK check_interval = %d, want %d", ack.CheckInterval, hello.CheckInterval)
+	}
+	if ack.PushMode {
+		p.t.Error("ACK confirms push mode, which wasn't asked for")
+	}
+	if ack.HeartbeatInterval != 0 {
+		p.t.Errorf("ACK heartbeat_interval_ms = %d, but no heartbeats were asked for", ack.HeartbeatInterval)
+	}
+}
+
+func testHelloJsonCodec(p *Peer) {
+	hello := p.helloPayload()
+	hello.Codecs = []string{pdu.CODEC_JSON}
+	ack := p.hello(hello)
+	if ack.Codec != pdu.CODEC_JSON {
+		p.t.Fatalf("ACK codec = %q, want %q", ack.Codec, pdu.CODEC_JSON)
+	}
+	p.Control.send(1, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(1, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testHelloLegacyVersion(p *Peer) {
+	// Load balancers that predate negotiation send a single version
+	// and a control stream without preamble
+	p.Control = p.Open(-1)
+	ack := p.hello(&pdu.HelloPayload{
+		SupportedMetrics: []string{"cpu_usage_percent"},
+		CheckInterval:    5,
+		AuthToken:        p.target.AuthToken,
+		Version:          pdu.PROTOCOL_VERSION_1,
+	})
+	if ack.Version != pdu.PROTOCOL_VERSION_1 || ack.Codec != "" || ack.MaxPduSize != 0 {
+		p.t.Fatalf("ACK = %+v, want version 1 without codec or max_pdu_size", ack)
+	}
+	p.Control.send(0, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(0, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testHelloLegacyStream(p *Peer) {
+	p.Control = p.Open(-1)
+	hello := p.helloPayload()
+	hello.MaxVersion = pdu.PROTOCOL_VERSION_4
+	ack := p.hello(hello)
+	if ack.Version != pdu.PROTOCOL_VERSION_4 {
+		p.t.Fatalf("ACK version = %d, want %d", ack.Version, pdu.PROTOCOL_VERSION_4)
+	}
+	p.Control.send(3, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(3, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testHelloUnsupportedVersion(p *Peer) {
+	hello := p.helloPayload()
+	hello.MinVersion = pdu.MAX_PROTOCOL_VERSION + 1
+	hello.MaxVersion = pdu.MAX_PROTOCOL_VERSION + 5
+	p.Control.send(1, pdu.TYPE_HELLO, hello)
+	errorData := p.Control.expectError(1, pdu.ERROR_UNSUPPORTED_VERSION)
+	if errorData.MinVersion != pdu.MIN_PROTOCOL_VERSION || errorData.MaxVersion != pdu.MAX_PROTOCOL_VERSION {
+		p.t.Fatalf("ERROR advertises versions [%d, %d], want [%d, %d]",
+			errorData.MinVersion, errorData.MaxVersion, pdu.MIN_PROTOCOL_VERSION, pdu.MAX_PROTOCOL_VERSION)
+	}
+}
+
+func testHelloBadToken(p *Peer) {
+	hello := p.helloPayload()
+	hello.AuthToken = "not-a-token"
+	p.Control.send(1, pdu.TYPE_HELLO, hello)
+	p.ExpectRejected(p.Control, 1, pdu.ERROR_AUTH_FAILED)
+}
+
+func testHelloMalformedPayload(p *Peer) {
+	msg := pdu.NewPDU(pdu.TYPE_HELLO, []byte(`{"auth_token":`))
+	msg.ID = 1
+	p.Control.sendPDU(msg)
+	p.ExpectRejected(p.Control, 1, pdu.ERROR_MALFORMED_PAYLOAD)
+}
+
+func testHelloInvalidPayload(p *Peer) {
+	// Well-formed JSON, but without the required auth_token
+	msg := pdu.NewPDU(pdu.TYPE_HELLO, []byte(`{"min_version":1,"max_version":5}`))
+	msg.ID = 1
+	p.Control.sendPDU(msg)
+	p.ExpectRejected(p.Control, 1, pdu.ERROR_MALFORMED_PAYLOAD)
+}
+
+func testMessagesBeforeHello(p *Peer) {
+	for _, mtype := range []uint8{pdu.TYPE_HEALTH_REQUEST, pdu.TYPE_CONFIG_UPDATE, pdu.TYPE_TERMINATE} {
+		if mtype != pdu.TYPE_HEALTH_REQUEST {
+			p = Dial(p.t, p.target)
+		}
+		p.Control.send(1, mtype, nil)
+		p.ExpectRejected(p.Control, 1, pdu.ERROR_UNEXPECTED_MESSAGE)
+	}
+}
+
+func testUnknownTypeBeforeHello(p *Peer) {
+	p.Control.send(1, 42, nil)
+	p.ExpectRejected(p.Control, 1, pdu.ERROR_UNKNOWN_TYPE)
+}
+
+func testSecondHello(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.send(2, pdu.TYPE_HELLO, p.helloPayload())
+	p.ExpectRejected(p.Control, 2, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+func testUnknownTypeAfterHello(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.send(2, 200, nil)
+	p.ExpectRejected(p.Control, 2, pdu.ERROR_UNKNOWN_TYPE)
+}
+
+func testServerMessagesFromClient(p *Peer) {
+	// Messages only a server may send are out of order from a load balancer
+	for i, mtype := range []uint8{pdu.TYPE_ACK, pdu.TYPE_HEALTH_RESPONSE, pdu.TYPE_CONFIG_ACK, pdu.TYPE_ERROR, pdu.TYPE_TERMINATE_ACK} {
+		if i > 0 {
+			p = Dial(p.t, p.target)
+		}
+		p.hello(p.helloPayload())
+		p.Control.send(2, mtype, nil)
+		p.ExpectRejected(p.Control, 2, pdu.ERROR_UNEXPECTED_MESSAGE)
+	}
+}
+
+func testMalformedFrame(p *Peer) {
+	p.Control.sendFrame([]byte("this is not a PDU"))
+	p.ExpectRejected(p.Control, 0, pdu.ERROR_MALFORMED_PAYLOAD)
+}
+
+func testMalformedBinaryFrame(p *Peer) {
+	p.hello(p.helloPayload())
+	// The header claims a 9 byte payload but only 2 follow
+	raw := make([]byte, pdu.BINARY_HEADER_SIZE+2)
+	raw[0] = pdu.TYPE_HEALTH_REQUEST
+	binary.BigEndian.PutUint32(raw[1:], 2)
+	binary.BigEndian.PutUint32(raw[5:], 9)
+	p.Control.sendFrame(raw)
+	p.ExpectRejected(p.Control, 0, pdu.ERROR_MALFORMED_PAYLOAD)
+}
+
+func testOversizedFrame(p *Peer) {
+	// An oversized frame is skipped, so the stream stays usable
+	p.Control.sendFrame(make([]byte, 4*pdu.MAX_PDU_SIZE))
+	p.Control.expectError(0, pdu.ERROR_PAYLOAD_TOO_LARGE)
+	p.hello(p.helloPayload())
+	p.Control.send(2, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(2, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testTruncatedFrame(p *Peer) {
+	// The frame promises 100 bytes but the stream ends after 10
+	hdr := make([]byte, pdu.FRAME_HEADER_SIZE)
+	binary.BigEndian.PutUint32(hdr, 100)
+	p.Control.sendRaw(append(hdr, make([]byte, 10)...))
+	p.Control.closeWrite()
+	p.Control.expectEOF()
+}
+
+func testTruncatedHeader(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.sendRaw([]byte{0, 0})
+	p.Control.closeWrite()
+	p.Control.expectEOF()
+}
+
+func testUnknownStreamType(p *Peer) {
+	s := p.Open(0x7f)
+	s.send(1, pdu.TYPE_HELLO, p.helloPayload())
+	s.expectEOF()
+	// The connection survives, so a proper control stream still works
+	p.hello(p.helloPayload())
+}
+
+func testHealthRequest(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.send(2, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(2, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testPipelinedHealthRequests(p *Peer) {
+	p.hello(p.helloPayload())
+	ids := []uint32{10, 11, 12}
+	for _, id := range ids {
+		p.Control.send(id, pdu.TYPE_HEALTH_REQUEST, nil)
+	}
+	for _, id := range ids {
+		p.Control.expectHealth(id, pdu.TYPE_HEALTH_RESPONSE)
+	}
+}
+
+func testHealthStream(p *Peer) {
+	p.hello(p.helloPayload())
+	health := p.OpenHealth()
+	health.send(2, pdu.TYPE_HEALTH_REQUEST, nil)
+	health.expectHealth(2, pdu.TYPE_HEALTH_RESPONSE)
+	// The control stream still answers health checks too
+	p.Control.send(3, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(3, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testHealthStreamRejectsControlMessages(p *Peer) {
+	p.hello(p.helloPayload())
+	health := p.OpenHealth()
+	health.send(2, pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 10})
+	p.ExpectRejected(health, 2, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+func testConfigUpdate(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.send(2, pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 10})
+	configAck := &pdu.ConfigAckPayload{}
+	p.Control.expect(2, pdu.TYPE_CONFIG_ACK, configAck)
+	if configAck.UpdateStatus != pdu.CONFIG_STATUS_SUCCESS {
+		p.t.Fatalf("CONFIG_ACK update_status = %q, want success", configAck.UpdateStatus)
+	}
+	if configAck.CheckInterval != 10 {
+		p.t.Errorf("CONFIG_ACK check_interval = %d, want 10", configAck.CheckInterval)
+	}
+}
+
+func testConfigUpdateMalformed(p *Peer) {
+	p.hello(p.helloPayload())
+	// A CONFIG_UPDATE that changes nothing is refused, but the session survives
+	p.Control.sendPDU(&pdu.PDU{Mtype: pdu.TYPE_CONFIG_UPDATE, ID: 2})
+	p.Control.expectError(2, pdu.ERROR_MALFORMED_PAYLOAD)
+	p.Control.send(3, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.Control.expectHealth(3, pdu.TYPE_HEALTH_RESPONSE)
+}
+
+func testRateLimit(p *Peer) {
+	p.hello(p.helloPayload())
+	// Ten requests per second are served, the rest are refused
+	const requests = 12
+	for id := uint32(1); id <= requests; id++ {
+		p.Control.send(id, pdu.TYPE_HEALTH_REQUEST, nil)
+	}
+	limited := 0
+	for id := uint32(1); id <= requests; id++ {
+		rsp := p.Control.read()
+		if rsp.ID != id {
+			p.t.Fatalf("got %s with id %d, want id %d", rsp.GetTypeAsString(), rsp.ID, id)
+		}
+		if rsp.Mtype == pdu.TYPE_ERROR {
+			p.Control.checkError(rsp, id, pdu.ERROR_RATE_LIMITED)
+			limited++
+		}
+	}
+	if limited == 0 {
+		p.t.Fatalf("%d requests in a row were all served, want some rate limited", requests)
+	}
+}
+
+func testPushMode(p *Peer) {
+	hello := p.helloPayload()
+	hello.CheckInterval = 1
+	hello.PushMode = true
+	ack := p.hello(hello)
+	if !ack.PushMode {
+		p.t.Fatal("ACK doesn't confirm push mode")
+	}
+	health := p.OpenHealth()
+	healthData := health.expectHealth(0, pdu.TYPE_HEALTH_DATA)
+	if healthData.Trigger != pdu.PUSH_TRIGGER_INTERVAL {
+		p.t.Fatalf("HEALTH_DATA trigger = %q, want %q", healthData.Trigger, pdu.PUSH_TRIGGER_INTERVAL)
+	}
+}
+
+func testHeartbeats(p *Peer) {
+	hello := p.helloPayload()
+	hello.HeartbeatInterval = pdu.MIN_HEARTBEAT_INTERVAL_MS
+	ack := p.hello(hello)
+	if ack.HeartbeatInterval == 0 {
+		p.t.Skip("agent doesn't send heartbeats")
+	}
+	if ack.HeartbeatInterval < pdu.MIN_HEARTBEAT_INTERVAL_MS {
+		p.t.Fatalf("ACK heartbeat_interval_ms = %d, below the %d ms minimum", ack.HeartbeatInterval, pdu.MIN_HEARTBEAT_INTERVAL_MS)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var last uint32
+	for i := 0; i < 3; i++ {
+		raw, err := p.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			p.t.Fatalf("waiting for heartbeat: %v", err)
+		}
+		hb, err := pdu.HeartbeatFromBytes(raw)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if hb.Seq <= last {
+			p.t.Fatalf("heartbeat %d after %d, want increasing sequence numbers", hb.Seq, last)
+		}
+		last = hb.Seq
+	}
+}
+
+func testTerminate(p *Peer) {
+	p.hello(p.helloPayload())
+	p.Control.send(2, pdu.TYPE_TERMINATE, &pdu.TerminatePayload{})
+	p.Control.expect(2, pdu.TYPE_TERMINATE_ACK, &pdu.TerminatePayload{})
+	p.Control.expectEOF()
+}
+
+func testMessagesAfterTerminate(p *Peer) {
+	p.hello(p.helloPayload())
+	health := p.OpenHealth()
+	health.send(2, pdu.TYPE_HEALTH_REQUEST, nil)
+	health.expectHealth(2, pdu.TYPE_HEALTH_RESPONSE)
+	p.Control.send(3, pdu.TYPE_TERMINATE, &pdu.TerminatePayload{})
+	p.Control.expect(3, pdu.TYPE_TERMINATE_ACK, &pdu.TerminatePayload{})
+	health.send(4, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.ExpectRejected(health, 4, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+// Peer is the load balancer end of a connection to the agent. Besides
+// driving the suite, it lets an agent's own tests talk to it.
+type Peer struct {
+	t      *testing.T
+	target Target
+	conn   quic.Connection
+	// Control is the stream HELLO goes on. Cases that need a control
+	// stream without preamble replace it with one from Open.
+	Control *Stream
+}
+
+// Stream is one framed stream of a Peer.
+type Stream struct {
+	t      *testing.T
+	s      quic.Stream
+	codec  pdu.Codec
+	reader *pdu.Reader
+	writer *pdu.Writer
+}
+
+// Dial connects to the agent and opens a control stream. The connection
+// is closed when the test ends.
+func Dial(t *testing.T, target Target) *Peer {
+	t.Helper()
+	target = target.withDefaults()
+	if target.AuthToken == "" {
+		t.Fatalf("no auth token: set Target.AuthToken or the agent's JWT secret in %s", util.JWT_SECRET_ENV)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, target.Addr, target.TLS, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("dialing %s: %v", target.Addr, err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	p := &Peer{t: t, target: target, conn: conn}
+	p.Control = p.Open(pdu.STREAM_CONTROL)
+	return p
+}
+
+// Open opens a stream that starts with the given preamble, or with none
+// if streamType is negative.
+func (p *Peer) Open(streamType int) *Stream {
+	p.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := p.conn.OpenStreamSync(ctx)
+	if err != nil {
+		p.t.Fatalf("opening stream: %v", err)
+	}
+	if streamType >= 0 {
+		if err := pdu.WriteStreamType(s, uint8(streamType)); err != nil {
+			p.t.Fatalf("writing stream type: %v", err)
+		}
+	}
+	return &Stream{t: p.t, s: s, codec: pdu.JsonCodec, reader: pdu.NewReader(s), writer: pdu.NewWriter(s)}
+}
+
+// OpenHealth opens a health stream using the control stream's codec.
+func (p *Peer) OpenHealth() *Stream {
+	p.t.Helper()
+	s := p.Open(pdu.STREAM_HEALTH)
+	s.SetCodec(p.Control.codec)
+	return s
+}
+
+// Hello completes HELLO/ACK on the control stream and switches it to the
+// agreed codec and PDU size.
+func (p *Peer) Hello(hello *pdu.HelloPayload) *pdu.AckPayload {
+	p.t.Helper()
+	p.Control.send(1, pdu.TYPE_HELLO, hello)
+	ack := &pdu.AckPayload{}
+	rsp := p.Control.read()
+	if rsp.Mtype != pdu.TYPE_ACK {
+		p.t.Fatalf("HELLO answered with %s: %s", rsp.GetTypeAsString(), rsp.Data)
+	}
+	id := uint32(1)
+	if !pdu.SupportsCorrelation(hello.MaxVersion) {
+		// Versions before 4 don't have to echo IDs
+		id = rsp.ID
+	}
+	p.Control.check(rsp, id, pdu.TYPE_ACK, ack)
+	codec := pdu.JsonCodec
+	if pdu.SupportsCodecNegotiation(ack.Version) {
+		var ok bool
+		if codec, ok = pdu.CodecByName(ack.Codec, ack.Version); !ok {
+			p.t.Fatalf("ACK picked unknown codec %q", ack.Codec)
+		}
+	}
+	p.Control.SetCodec(codec)
+	if ack.MaxPduSize > 0 {
+		p.Control.reader.SetMaxPduSize(ack.MaxPduSize)
+		p.Control.writer.SetMaxPduSize(ack.MaxPduSize)
+	}
+	return ack
+}
+
+// hello is Hello for the cases, which ask for metrics every agent
+// must confirm.
+func (p *Peer) hello(hello *pdu.HelloPayload) *pdu.AckPayload {
+	p.t.Helper()
+	ack := p.Hello(hello)
+	if !slices.Equal(ack.ConfirmedMetrics, hello.SupportedMetrics) {
+		p.t.Errorf("ACK confirmed_metrics = %v, want %v", ack.ConfirmedMetrics, hello.SupportedMetrics)
+	}
+	return ack
+}
+
+// ExpectRejected checks that the agent answers the request with the
+// given ID with an ERROR carrying code and then closes the connection
+// with the same code. The close may overtake the ERROR.
+func (p *Peer) ExpectRejected(s *Stream, id uint32, code int) {
+	p.t.Helper()
+	s.s.SetReadDeadline(time.Now().Add(timeout))
+	rsp, err := s.reader.ReadPDU()
+	var appErr *quic.ApplicationError
+	switch {
+	case err == nil:
+		s.checkError(rsp, id, code)
+	case !errors.As(err, &appErr):
+		p.t.Fatalf("reading PDU: %v", err)
+	}
+	p.ExpectClosed(code)
+}
+
+// ExpectClosed checks that the agent closes the connection with code as
+// its application error code.
+func (p *Peer) ExpectClosed(code int) {
+	p.t.Helper()
+	select {
+	case <-p.conn.Context().Done():
+	case <-time.After(timeout):
+		p.t.Fatalf("connection still open, want it closed with code %d", code)
+	}
+	var appErr *quic.ApplicationError
+	if !errors.As(context.Cause(p.conn.Context()), &appErr) {
+		p.t.Fatalf("connection closed with %v, want an application error", context.Cause(p.conn.Context()))
+	}
+	if int(appErr.ErrorCode) != code {
+		p.t.Fatalf("connection closed with code %d, want %d", appErr.ErrorCode, code)
+	}
+}
+
+// SetCodec switches the codec used on the stream.
+func (s *Stream) SetCodec(codec pdu.Codec) {
+	s.codec = codec
+	s.reader.SetCodec(codec)
+	s.writer.SetCodec(codec)
+}
+
+// Reader returns the stream's PDU reader, for reads that may fail.
+func (s *Stream) Reader() *pdu.Reader {
+	return s.reader
+}
+
+// Writer returns the stream's PDU writer, for writes that may fail.
+func (s *Stream) Writer() *pdu.Writer {
+	return s.writer
+}
+
+// SetReadDeadline bounds reads through Reader, which unlike the checks
+// here don't set a deadline of their own.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	return s.s.SetReadDeadline(t)
+}
+
+// send writes a PDU of type mtype with the given ID and payload.
+func (s *Stream) send(id uint32, mtype uint8, payload pdu.Payload) {
+	s.t.Helper()
+	msg := pdu.NewPDU(mtype, nil)
+	if payload != nil {
+		var err error
+		if msg, err = pdu.NewPayloadPDU(mtype, payload); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	msg.ID = id
+	s.sendPDU(msg)
+}
+
+// sendPDU writes msg as is.
+func (s *Stream) sendPDU(msg *pdu.PDU) {
+	s.t.Helper()
+	if err := s.writer.WritePDU(msg); err != nil {
+		s.t.Fatalf("sending %s: %v", msg.GetTypeAsString(), err)
+	}
+}
+
+// sendFrame writes raw as the body of a single frame, bypassing the codec.
+func (s *Stream) sendFrame(raw []byte) {
+	s.t.Helper()
+	frame := make([]byte, pdu.FRAME_HEADER_SIZE+len(raw))
+	binary.BigEndian.PutUint32(frame, uint32(len(raw)))
+	copy(frame[pdu.FRAME_HEADER_SIZE:], raw)
+	s.sendRaw(frame)
+}
+
+// sendRaw writes raw to the stream without any framing.
+func (s *Stream) sendRaw(raw []byte) {
+	s.t.Helper()
+	if _, err := s.s.Write(raw); err != nil {
+		s.t.Fatalf("writing to stream: %v", err)
+	}
+}
+
+// closeWrite ends the sending side of the stream.
+func (s *Stream) closeWrite() {
+	s.t.Helper()
+	if err := s.s.Close(); err != nil {
+		s.t.Fatalf("closing stream: %v", err)
+	}
+}
+
+// read returns the next PDU from the agent.
+func (s *Stream) read() *pdu.PDU {
+	s.t.Helper()
+	s.s.SetReadDeadline(time.Now().Add(timeout))
+	rsp, err := s.reader.ReadPDU()
+	if err != nil {
+		s.t.Fatalf("reading PDU: %v", err)
+	}
+	return rsp
+}
+
+// expect reads the next PDU and checks it with check.
+func (s *Stream) expect(id uint32, mtype uint8, payload pdu.Payload) {
+	s.t.Helper()
+	s.check(s.read(), id, mtype, payload)
+}
+
+// check checks that rsp has type mtype and the given ID, and decodes its
+// payload into payload.
+func (s *Stream) check(rsp *pdu.PDU, id uint32, mtype uint8, payload pdu.Payload) {
+	s.t.Helper()
+	want := &pdu.PDU{Mtype: mtype}
+	if rsp.Mtype != mtype {
+		s.t.Fatalf("got %s: %s, want %s", rsp.GetTypeAsString(), rsp.Data, want.GetTypeAsString())
+	}
+	if rsp.ID != id {
+		s.t.Fatalf("got %s with id %d, want id %d", rsp.GetTypeAsString(), rsp.ID, id)
+	}
+	if int(rsp.Length) != len(rsp.Data) {
+		s.t.Fatalf("got %s with length %d and %d bytes of data", rsp.GetTypeAsString(), rsp.Length, len(rsp.Data))
+	}
+	if err := pdu.DecodePayload(rsp.Data, payload); err != nil {
+		s.t.Fatalf("decoding %s: %v", rsp.GetTypeAsString(), err)
+	}
+}
+
+// expectHealth reads a HEALTH_RESPONSE or HEALTH_DATA and checks that it
+// carries metrics.
+func (s *Stream) expectHealth(id uint32, mtype uint8) *pdu.HealthResponsePayload {
+	s.t.Helper()
+	healthData := &pdu.HealthResponsePayload{}
+	s.expect(id, mtype, healthData)
+	if len(healthData.Metrics) == 0 {
+		s.t.Fatal("health data carries no metrics")
+	}
+	return healthData
+}
+
+// expectError reads an ERROR answering the request with the given ID and
+// checks its code.
+func (s *Stream) expectError(id uint32, code int) *pdu.ErrorPayload {
+	s.t.Helper()
+	return s.checkError(s.read(), id, code)
+}
+
+// checkError checks that rsp is an ERROR with the given ID and code.
+func (s *Stream) checkError(rsp *pdu.PDU, id uint32, code int) *pdu.ErrorPayload {
+	s.t.Helper()
+	errorData := &pdu.ErrorPayload{}
+	s.check(rsp, id, pdu.TYPE_ERROR, errorData)
+	if errorData.ErrorCode != code {
+		s.t.Fatalf("got ERROR %d (%s), want %d (%s)",
+			errorData.ErrorCode, errorData.ErrorMessage, code, pdu.ErrorName(code))
+	}
+	if errorData.ErrorMessage == "" {
+		s.t.Error("ERROR has no error_message")
+	}
+	return errorData
+}
+
+// expectEOF checks that the agent ends the stream without sending anything.
+func (s *Stream) expectEOF() {
+	s.t.Helper()
+	s.s.SetReadDeadline(time.Now().Add(timeout))
+	rsp, err := s.reader.ReadPDU()
+	if err == nil {
+		s.t.Fatalf("got %s: %s, want the stream to end", rsp.GetTypeAsString(), rsp.Data)
+	}
+	var streamErr *quic.StreamError
+	if err != io.EOF && !errors.As(err, &streamErr) {
+		s.t.Fatalf("stream failed with %v, want it to end", err)
+	}
+}
@@ -0,0 +1,18 @@
+package conformance
+
+import (
+	"flag"
+	"testing"
+)
+
+var addr = flag.String("conformance.addr", "", "address of a running agent to check (host:port)")
+
+// TestAgent checks an agent started outside the test, e.g.
+//
+//	go test ./pkg/conformance -conformance.addr 127.0.0.1:4243
+func TestAgent(t *testing.T) {
+	if *addr == "" {
+		t.Skip("no -conformance.addr given")
+	}
+	Run(t, Target{Addr: *addr})
+}
@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// ServerStatus is what the load balancer knows about one server.
+type ServerStatus struct {
+	ServerID string `json:"server_id"`
+	Address  string `json:"address"`
+	// Hostname and InstanceID are what the server said about itself in ACK.
+	Hostname   string `json:"hostname,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	// Weight, MaxConnections and Labels are what the server advertised in ACK.
+	Weight         int               `json:"weight"`
+	MaxConnections int               `json:"max_connections,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	// Status is one of the pdu.STATUS_* values.
+	Status       string `json:"status"`
+	StatusReason string `json:"status_reason,omitempty"`
+	// CheckInterval and Metrics are the session's current health check configuration.
+	CheckInterval int      `json:"check_interval"`
+	Metrics       []string `json:"metrics"`
+	// Probes are the results of the server's application probes.
+	Probes []pdu.ProbeResult `json:"probes,omitempty"`
+	// ResponseTime covers the latest health checks. Servers that push their
+	// health data have none.
+	ResponseTime *ResponseTimeStats `json:"response_time,omitempty"`
+	// Aggregates maps each window the load balancer asked for to the
+	// server's latest metric aggregates over it.
+	Aggregates map[string]map[string]pdu.MetricAggregate `json:"aggregates,omitempty"`
+}
+
+// Status returns the status of every server the load balancer has had a
+// session with, sorted by server ID.
+func (lb *LoadBalancer) Status() []ServerStatus {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	statuses := make([]ServerStatus, 0, len(lb.serverHealthMap))
+	for serverID, health := range lb.serverHealthMap {
+		checkInterval, metrics := health.session.healthConfig()
+		var responseTime *ResponseTimeStats
+		if rt := health.session.responseTimeStats(); rt.Samples > 0 {
+			responseTime = &rt
+		}
+		statuses = append(statuses, ServerStatus{
+			ServerID:       serverID,
+			Address:        health.Address,
+			Hostname:       health.Hostname,
+			InstanceID:     health.InstanceID,
+			Weight:         health.Weight,
+			MaxConnections: health.MaxConnections,
+			Labels:         health.Labels,
+			Status:         health.Status,
+			StatusReason:   health.StatusReason,
+			CheckInterval:  checkInterval,
+			Metrics:        metrics,
+			Probes:         health.Probes,
+			ResponseTime:   responseTime,
+			Aggregates:     health.Aggregates,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ServerID < statuses[j].ServerID })
+	return statuses
+}
+
+// Routable returns the servers that should get traffic: the healthy ones,
+// then the degraded ones, each sorted by server ID.
+func (lb *LoadBalancer) Routable() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	var healthy, degraded []string
+	for serverID, health := range lb.serverHealthMap {
+		switch health.Status {
+		case pdu.STATUS_HEALTHY:
+			healthy = append(healthy, serverID)
+		case pdu.STATUS_DEGRADED:
+			degraded = append(degraded, serverID)
+		}
+	}
+	sort.Strings(healthy)
+	sort.Strings(degraded)
+	return append(healthy, degraded...)
+}
+
+// serveAdmin serves the admin API on addr:
+//
+//	GET  /servers              the status of every server, or of those with
+//	                           every label=key=value given in the query
+//	POST /servers/{id}/config  a CONFIG_UPDATE payload, answered with the CONFIG_ACK
+func (lb *LoadBalancer) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", lb.handleStatus)
+	mux.HandleFunc("POST /servers/{id}/config", lb.handleConfigUpdate)
+	log.Printf("[loadbalancer] Admin API listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("[loadbalancer] Admin API stopped: %s", err)
+	}
+}
+
+func (lb *LoadBalancer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	labels := make(map[string]string)
+	for _, label := range r.URL.Query()["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid label %q, expected key=value", label))
+			return
+		}
+		labels[key] = value
+	}
+	statuses := []ServerStatus{}
+	for _, status := range lb.Status() {
+		if hasLabels(status.Labels, labels) {
+			statuses = append(statuses, status)
+		}
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// hasLabels reports whether labels include every key and value in want.
+func hasLabels(labels map[string]string, want map[string]string) bool {
+	for key, value := range want {
+		if got, ok := labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (lb *LoadBalancer) handleConfigUpdate(w http.ResponseWriter, r *http.Request) {
+	update := &pdu.ConfigUpdatePayload{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := update.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ack, err := lb.UpdateServerConfig(r.PathValue("id"), update)
+	var errorData *pdu.ErrorPayload
+	switch {
+	case errors.Is(err, ErrUnknownServer):
+		writeError(w, http.StatusNotFound, err)
+	case errors.As(err, &errorData):
+		writeJSON(w, http.StatusBadGateway, errorData)
+	case err != nil:
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		writeJSON(w, http.StatusOK, ack)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// configUpdateTimeout is how long UpdateServerConfig waits for CONFIG_ACK.
+const configUpdateTimeout = 5 * time.Second
+
+// ErrUnknownServer is returned for a server ID the load balancer has no session with.
+var ErrUnknownServer = errors.New("unknown server")
+
+// UpdateServerConfig asks a server to change the check interval and
+// metrics of its session with CONFIG_UPDATE, without reconnecting. The
+// load balancer starts using whatever the server accepted right away. An
+// ERROR from the server is returned as a *pdu.ErrorPayload.
+func (lb *LoadBalancer) UpdateServerConfig(serverID string, update *pdu.ConfigUpdatePayload) (*pdu.ConfigAckPayload, error) {
+	lb.mu.Lock()
+	serverHealth, ok := lb.serverHealthMap[serverID]
+	lb.mu.Unlock()
+	if !ok || serverHealth.Status == pdu.STATUS_DOWN {
+		return nil, fmt.Errorf("%w %s", ErrUnknownServer, serverID)
+	}
+	sess := serverHealth.session
+	data, err := pdu.EncodePayload(update)
+	if err != nil {
+		return nil, err
+	}
+	req, err := sess.control.request(pdu.TYPE_CONFIG_UPDATE, data)
+	if err != nil {
+		return nil, fmt.Errorf("error sending configuration update to server %s: %w", serverID, err)
+	}
+	timer := time.NewTimer(configUpdateTimeout)
+	defer timer.Stop()
+	var rsp *pdu.PDU
+	select {
+	case rsp, ok = <-req.reply:
+		if !ok {
+			return nil, errSessionClosed
+		}
+	case <-timer.C:
+		if sess.control.cancel(req) {
+			return nil, fmt.Errorf("server %s didn't confirm the configuration update within %s", serverID, configUpdateTimeout)
+		}
+		if rsp, ok = <-req.reply; !ok {
+			return nil, errSessionClosed
+		}
+	}
+
+	switch rsp.Mtype {
+	case pdu.TYPE_CONFIG_ACK:
+	case pdu.TYPE_ERROR:
+		errorData := &pdu.ErrorPayload{}
+		if err := pdu.DecodePayload(rsp.Data, errorData); err != nil {
+			return nil, fmt.Errorf("malformed error from server %s: %w", serverID, err)
+		}
+		return nil, errorData
+	default:
+		return nil, fmt.Errorf("unexpected %s in reply to configuration update from server %s", rsp.GetTypeAsString(), serverID)
+	}
+	ack := &pdu.ConfigAckPayload{}
+	if err := pdu.DecodePayload(rsp.Data, ack); err != nil {
+		return nil, fmt.Errorf("malformed CONFIG_ACK from server %s: %w", serverID, err)
+	}
+	log.Printf("[loadbalancer] Configuration update ACK from server %s: %s - %s", serverID, ack.UpdateStatus, ack.Message)
+	if ack.UpdateStatus == pdu.CONFIG_STATUS_REJECTED {
+		return ack, nil
+	}
+
+	checkInterval, metrics := sess.healthConfig()
+	switch {
+	case ack.CheckInterval > 0:
+		checkInterval = ack.CheckInterval
+	case update.NewCheckInterval > 0:
+		// Servers that predate the fields in CONFIG_ACK accept everything
+		checkInterval = update.NewCheckInterval
+	}
+	switch {
+	case len(ack.Metrics) > 0:
+		metrics = ack.Metrics
+	case len(update.NewMetrics) > 0:
+		metrics = update.NewMetrics
+	}
+	sess.setHealthConfig(checkInterval, metrics)
+	log.Printf("[loadbalancer] Server %s now reports %v every %d seconds", serverID, metrics, checkInterval)
+	return ack, nil
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// heartbeatMissLimit is how many heartbeat intervals may pass without a
+// heartbeat before the silence counts as a failed check.
+const heartbeatMissLimit = 10
+
+// HeartbeatStats summarizes the heartbeat datagrams received from a server.
+type HeartbeatStats struct {
+	Received uint64
+	// Lost counts heartbeats skipped in the sequence that never turned up.
+	Lost uint64
+	// LargestGap is the longest run of consecutive lost heartbeats.
+	LargestGap uint32
+	LastSeq    uint32
+	LastSeen   time.Time
+	// seen has bit i set if heartbeat LastSeq-i was received, to tell
+	// duplicates from reordered heartbeats.
+	seen uint64
+}
+
+// LossRate returns the fraction of heartbeats that were lost.
+func (h HeartbeatStats) LossRate() float64 {
+	total := h.Received + h.Lost
+	if total == 0 {
+		return 0
+	}
+	return float64(h.Lost) / float64(total)
+}
+
+// record accounts for a heartbeat with the given sequence number.
+// Sequence numbers wrap around, so a heartbeat is newer if it is less
+// than half the sequence space ahead. Duplicates are ignored.
+func (h *HeartbeatStats) record(seq uint32, now time.Time) {
+	h.LastSeen = now
+	if ahead := seq - h.LastSeq; ahead > 0 && ahead < 1<<31 {
+		gap := ahead - 1
+		h.Lost += uint64(gap)
+		if gap > h.LargestGap {
+			h.LargestGap = gap
+		}
+		h.LastSeq = seq
+		if ahead < 64 {
+			h.seen = h.seen<<ahead | 1
+		} else {
+			h.seen = 1
+		}
+		h.Received++
+		return
+	}
+	if behind := h.LastSeq - seq; behind < 64 {
+		if h.seen&(1<<behind) != 0 {
+			return
+		}
+		h.seen |= 1 << behind
+	}
+	h.Received++
+	if h.Lost > 0 {
+		// A reordered heartbeat that was already counted as lost
+		h.Lost--
+	}
+}
+
+// receiveHeartbeats reads heartbeat datagrams for a session until its
+// connection closes, marking the server unhealthy whenever they stop.
+func (lb *LoadBalancer) receiveHeartbeats(sess *session, interval time.Duration) {
+	timeout := heartbeatMissLimit * interval
+	for {
+		ctx, cancel := context.WithTimeout(lb.ctx, timeout)
+		raw, err := sess.conn.ReceiveDatagram(ctx)
+		cancel()
+		select {
+		case <-sess.closed:
+			return
+		default:
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("[loadbalancer] No heartbeat from server %s for %s", sess.serverID, timeout)
+			lb.markServerUnhealthy(sess.serverID)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		hb, err := pdu.HeartbeatFromBytes(raw)
+		if err != nil {
+			log.Printf("[loadbalancer] Ignoring datagram from server %s: %s", sess.serverID, err)
+			continue
+		}
+		sess.recordHeartbeat(hb.Seq)
+	}
+}
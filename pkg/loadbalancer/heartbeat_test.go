@@ -0,0 +1,63 @@
+package loadbalancer
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatStatsRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		// start is the state before seqs arrive
+		start      HeartbeatStats
+		seqs       []uint32
+		received   uint64
+		lost       uint64
+		largestGap uint32
+		lastSeq    uint32
+	}{
+		{name: "in order", seqs: []uint32{1, 2, 3}, received: 3, lastSeq: 3},
+		{name: "missing", seqs: []uint32{1, 2, 5, 6, 8}, received: 5, lost: 3, largestGap: 2, lastSeq: 8},
+		{name: "reordered", seqs: []uint32{1, 3, 2, 4}, received: 4, largestGap: 1, lastSeq: 4},
+		{name: "reordered across a gap", seqs: []uint32{1, 5, 3, 6}, received: 4, lost: 2, largestGap: 3, lastSeq: 6},
+		{name: "duplicate", seqs: []uint32{1, 2, 2, 3, 3}, received: 3, lastSeq: 3},
+		{name: "duplicate while some are lost", seqs: []uint32{1, 4, 4, 1}, received: 2, lost: 2, largestGap: 2, lastSeq: 4},
+		{name: "duplicate of a reordered heartbeat", seqs: []uint32{1, 3, 2, 2}, received: 3, largestGap: 1, lastSeq: 3},
+		{name: "gap longer than the duplicate window", seqs: []uint32{1, 100, 2}, received: 3, lost: 97, largestGap: 98, lastSeq: 100},
+		{
+			name:     "wrap around",
+			start:    HeartbeatStats{Received: 1, LastSeq: math.MaxUint32 - 1, seen: 1},
+			seqs:     []uint32{math.MaxUint32, 0, 1},
+			received: 4, lastSeq: 1,
+		},
+		{
+			name:     "reordered across the wrap",
+			start:    HeartbeatStats{Received: 1, LastSeq: math.MaxUint32 - 1, seen: 1},
+			seqs:     []uint32{0, math.MaxUint32, 1},
+			received: 4, largestGap: 1, lastSeq: 1,
+		},
+		{
+			name:     "lost across the wrap",
+			start:    HeartbeatStats{Received: 1, LastSeq: math.MaxUint32, seen: 1},
+			seqs:     []uint32{2},
+			received: 2, lost: 2, largestGap: 2, lastSeq: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.start
+			now := time.Now()
+			for _, seq := range tt.seqs {
+				h.record(seq, now)
+			}
+			if h.Received != tt.received || h.Lost != tt.lost || h.LargestGap != tt.largestGap || h.LastSeq != tt.lastSeq {
+				t.Errorf("after %v: received %d, lost %d, largest gap %d, last seq %d; want %d, %d, %d, %d",
+					tt.seqs, h.Received, h.Lost, h.LargestGap, h.LastSeq, tt.received, tt.lost, tt.largestGap, tt.lastSeq)
+			}
+			if !h.LastSeen.Equal(now) {
+				t.Errorf("last seen %v, want %v", h.LastSeen, now)
+			}
+		})
+	}
+}
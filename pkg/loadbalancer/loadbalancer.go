@@ -3,8 +3,12 @@ package loadbalancer
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,14 +20,69 @@ import (
 
 // LoadBalancerConfig represents the configuration for the load balancer.
 type LoadBalancerConfig struct {
+	// ClientID is the identity in the token the load balancer presents in
+	// HELLO. Servers keep one session per identity, so load balancers that
+	// share servers need distinct IDs. Empty uses <hostname>-<port>.
+	ClientID          string
 	Servers           []string
 	CertFile          string
 	MaxFailAttempts   int
 	CheckInterval     int
 	ReconnectInterval int
 	Port              int
+	Codec             string
+	// Metrics are the collectors or metrics asked for in HELLO, e.g.
+	// "disk" or "load_average_1m". Empty leaves the choice to the server.
+	Metrics []string
+	// AggregateWindows asks servers for aggregates of the metrics over
+	// these windows (pdu.WINDOW_*) with every health report.
+	AggregateWindows []string
+	// MaxVersion caps the protocol version offered in HELLO (0 means the latest).
+	MaxVersion int
+	// MaxPduSize is the largest payload the load balancer asks to receive.
+	MaxPduSize int
+	// PushMode asks servers to push HEALTH_DATA instead of being polled.
+	PushMode bool
+	// PushThresholds are metric values that make a server push right away.
+	PushThresholds map[string]float64
+	// HeartbeatInterval asks servers for heartbeat datagrams every this
+	// many milliseconds (0 disables heartbeats).
+	HeartbeatInterval int
+	// QlogDir is where a qlog file is written for every connection to a
+	// server, named by server ID. Empty disables qlog.
+	QlogDir string
+	// TraceFile is where every PDU sent and received is recorded, in
+	// TraceFormat (pdu.TRACE_JSONL or pdu.TRACE_BINARY). Empty disables tracing.
+	TraceFile   string
+	TraceFormat string
+	// ZeroRTT keeps TLS session tickets and resumes sessions with known
+	// servers using 0-RTT.
+	ZeroRTT bool
+	// AdminAddr is where the admin API listens for status requests and
+	// configuration updates, e.g. "127.0.0.1:4240". Empty disables it.
+	AdminAddr string
+	// MaxResponseTime marks servers degraded while the p95 of their health
+	// check response times, or their application's response time as
+	// reported by their probes, is over it. 0 disables the check.
+	MaxResponseTime time.Duration
+	// TransportConfig sets the QUIC transport parameters of server
+	// connections. Datagrams are only enabled for heartbeats.
+	util.TransportConfig
 }
 
+// Reasons a server is down, as kept in ServerHealth.DownReason.
+const (
+	DOWN_FAILED_CHECKS = "failed health checks"
+	// DOWN_IDLE_TIMEOUT means QUIC heard nothing from the server for
+	// longer than the idle timeout, e.g. because the network dropped.
+	DOWN_IDLE_TIMEOUT    = "idle timeout"
+	DOWN_CONNECTION_LOST = "connection lost"
+	DOWN_FATAL_ERROR     = "fatal error"
+	// DOWN_REPORTED means the server keeps reporting pdu.STATUS_DOWN
+	// without saying why.
+	DOWN_REPORTED = "reported down"
+)
+
 // LoadBalancer represents the load balancer.
 type LoadBalancer struct {
 	cfg                LoadBalancerConfig
@@ -32,15 +91,91 @@ type LoadBalancer struct {
 	serverHealthMap    map[string]*ServerHealth
 	serverFailureCount map[string]int
 	mu                 sync.Mutex
+	// trace records PDUs if a trace file is configured.
+	trace *pdu.Trace
+	// sessionCaches holds a tls.ClientSessionCache per server address
+	sessionCaches sync.Map
+	// traces holds the *connTrace of connections still being set up,
+	// keyed by quic.ConnectionTracingID
+	traces sync.Map
 }
 
 // ServerHealth represents the health status of a server.
 type ServerHealth struct {
-	ServerID        string
-	IsHealthy       bool
+	ServerID string
+	// Address is the configured address the session was opened with.
+	Address string
+	// Hostname and InstanceID are what the server said about itself in
+	// ACK. Servers that predate them leave them empty.
+	Hostname   string
+	InstanceID string
+	// Weight, MaxConnections and Labels are what the server advertised in
+	// ACK. Weight is 1 for servers that don't advertise one, and
+	// MaxConnections is 0 for no limit.
+	Weight         int
+	MaxConnections int
+	Labels         map[string]string
+	// Status is one of the pdu.STATUS_* values. A new session is not
+	// ready until the server first reports its health.
+	Status          string
 	FailedAttempts  int
 	MaxFailAttempts int
-	conn            quic.Connection
+	// StaleResponses counts responses that arrived after their request
+	// timed out, or that answered no request at all.
+	StaleResponses int
+	// StatusReason says why the server isn't healthy: one of the DOWN_*
+	// reasons, or the reason the server reported.
+	StatusReason string
+	// Probes are the results of the server's application probes in its
+	// latest health data.
+	Probes []pdu.ProbeResult
+	// Aggregates are the metric aggregates per window in the server's
+	// latest health data.
+	Aggregates map[string]map[string]pdu.MetricAggregate
+	// reportedDown is set while the server is down because it says so,
+	// while its session is fine.
+	reportedDown bool
+	conn         quic.Connection
+	session      *session
+}
+
+// claimServerID starts tracking the health of a new session with the
+// server at serverAddr. A server ID may only be used by one address at a
+// time, so if another address still has a session under the same ID, the
+// new connection is closed and claimServerID returns false. lb.mu must be
+// held.
+func (lb *LoadBalancer) claimServerID(serverAddr string, conn quic.Connection, sess *session) bool {
+	if existing, ok := lb.serverHealthMap[sess.serverID]; ok {
+		switch {
+		case existing.Address != serverAddr && existing.conn.Context().Err() == nil:
+			log.Printf("[loadbalancer] Rejecting server %s: server ID %s is already used by %s", serverAddr, sess.serverID, existing.Address)
+			conn.CloseWithError(quic.ApplicationErrorCode(pdu.ERROR_DUPLICATE_SERVER_ID), "duplicate server ID")
+			return false
+		case existing.Address != serverAddr:
+			log.Printf("[loadbalancer] Server %s moved from %s to %s", sess.serverID, existing.Address, serverAddr)
+		case existing.InstanceID != sess.ack.InstanceID:
+			log.Printf("[loadbalancer] Server %s restarted (instance %s)", sess.serverID, sess.ack.InstanceID)
+		}
+	}
+	weight := sess.ack.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	lb.serverHealthMap[sess.serverID] = &ServerHealth{
+		ServerID:        sess.serverID,
+		Address:         serverAddr,
+		Hostname:        sess.ack.Hostname,
+		InstanceID:      sess.ack.InstanceID,
+		Weight:          weight,
+		MaxConnections:  sess.ack.MaxConnections,
+		Labels:          sess.ack.Labels,
+		Status:          pdu.STATUS_NOT_READY,
+		StatusReason:    "waiting for health data",
+		MaxFailAttempts: lb.cfg.MaxFailAttempts,
+		conn:            conn,
+		session:         sess,
+	}
+	return true
 }
 
 // NewLoadBalancer creates a new load balancer with the given configuration.
@@ -61,11 +196,32 @@ func NewLoadBalancer(cfg LoadBalancerConfig) *LoadBalancer {
 		lb.tls = util.BuildTLSClientConfig()
 	}
 	lb.ctx = context.TODO()
+	if cfg.ClientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "loadbalancer"
+		}
+		lb.cfg.ClientID = fmt.Sprintf("%s-%d", hostname, cfg.Port)
+	}
+	if !util.HasJWTSecret() {
+		log.Fatal("[loadbalancer] ", util.ErrNoJWTSecret)
+	}
+	log.Printf("[loadbalancer] Authenticating to servers as %s", lb.cfg.ClientID)
+	if cfg.TraceFile != "" {
+		trace, err := util.CreateTrace(cfg.TraceFile, cfg.TraceFormat)
+		if err != nil {
+			log.Fatal("[loadbalancer] error creating trace file:", err)
+		}
+		lb.trace = trace
+	}
 	return lb
 }
 
 // Run starts the load balancer.
 func (lb *LoadBalancer) Run() {
+	if lb.cfg.AdminAddr != "" {
+		go lb.serveAdmin(lb.cfg.AdminAddr)
+	}
 	// Connect to each server and start health check
 	for _, serverAddr := range lb.cfg.Servers {
 		go lb.connectAndMonitor(serverAddr)
@@ -103,38 +259,47 @@ func (lb *LoadBalancer) Run() {
 // connectAndMonitor connects to a server and starts monitoring its health.
 func (lb *LoadBalancer) connectAndMonitor(serverAddr string) {
 	for {
-		conn, err := quic.DialAddr(lb.ctx, serverAddr, lb.tls, nil)
-		lb.mu.Lock()
+		// Dialing and HELLO/ACK can take a while, so the lock is only taken
+		// to publish the result
+		sess, err := lb.connect(serverAddr)
 		if err != nil {
-			log.Printf("[loadbalancer] error dialing server %s: %v", serverAddr, err)
+			log.Printf("[loadbalancer] error connecting to server %s: %v", serverAddr, err)
+			lb.mu.Lock()
 			lb.serverFailureCount[serverAddr]++
 			lb.mu.Unlock()
 			time.Sleep(time.Duration(lb.cfg.ReconnectInterval) * time.Second)
 			continue
 		}
 
-		serverID := lb.protocolHandler(conn)
-		if serverID == "" {
-			log.Printf("[loadbalancer] failed to get server ID for %s", serverAddr)
+		lb.mu.Lock()
+		if !lb.claimServerID(serverAddr, sess.conn, sess) {
 			lb.serverFailureCount[serverAddr]++
 			lb.mu.Unlock()
 			time.Sleep(time.Duration(lb.cfg.ReconnectInterval) * time.Second)
 			continue
 		}
-
-		lb.serverHealthMap[serverID] = &ServerHealth{
-			ServerID:        serverID,
-			IsHealthy:       true,
-			FailedAttempts:  0,
-			MaxFailAttempts: lb.cfg.MaxFailAttempts,
-			conn:            conn,
-		}
 		delete(lb.serverFailureCount, serverAddr)
 		lb.mu.Unlock()
+		lb.startSession(sess)
 
 		// Monitor the server connection
-		lb.monitorServer(serverID)
+		lb.monitorServer(sess.serverID)
+	}
+}
+
+// connect dials a server and opens a session with it. It must not be
+// called with lb.mu held.
+func (lb *LoadBalancer) connect(serverAddr string) (*session, error) {
+	conn, err := lb.dial(serverAddr)
+	if err != nil {
+		return nil, err
 	}
+	conn, sess, err := lb.openSession(conn)
+	if err != nil {
+		conn.CloseWithError(0, "no session")
+		return nil, err
+	}
+	return sess, nil
 }
 
 // monitorServer monitors the health of a server and handles disconnection.
@@ -148,7 +313,7 @@ func (lb *LoadBalancer) monitorServer(serverID string) {
 			return
 		}
 
-		if !health.IsHealthy {
+		if health.Status == pdu.STATUS_DOWN && !health.reportedDown {
 			// Server is marked as unhealthy, close the connection
 			health.conn.CloseWithError(0, "server unhealthy")
 			return
@@ -163,12 +328,11 @@ func (lb *LoadBalancer) performHealthCheck() {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 	for serverID, health := range lb.serverHealthMap {
-		if !health.IsHealthy {
-			if health.FailedAttempts >= health.MaxFailAttempts {
-				log.Printf("[loadbalancer] Server %s is down", serverID)
-			} else {
-				log.Printf("[loadbalancer] Server %s health check failed (%d/%d)", serverID, health.FailedAttempts, health.MaxFailAttempts)
-			}
+		switch {
+		case health.Status == pdu.STATUS_DOWN:
+			log.Printf("[loadbalancer] Server %s is down", serverID)
+		case health.FailedAttempts > 0:
+			log.Printf("[loadbalancer] Server %s health check failed (%d/%d)", serverID, health.FailedAttempts, health.MaxFailAttempts)
 		}
 	}
 }
@@ -177,143 +341,502 @@ func (lb *LoadBalancer) performHealthCheck() {
 func (lb *LoadBalancer) displayHealthStatus() {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	healthyCount := 0
+	counts := make(map[string]int)
 	for _, health := range lb.serverHealthMap {
-		if health.IsHealthy {
-			healthyCount++
-		}
+		counts[health.Status]++
 	}
 	totalServers := len(lb.cfg.Servers)
-	log.Printf("[loadbalancer] %d out of %d servers are healthy", healthyCount, totalServers)
+	log.Printf("[loadbalancer] %d out of %d servers are healthy, %d degraded, %d not ready, %d draining, %d down",
+		counts[pdu.STATUS_HEALTHY], totalServers, counts[pdu.STATUS_DEGRADED], counts[pdu.STATUS_NOT_READY],
+		counts[pdu.STATUS_DRAINING], counts[pdu.STATUS_DOWN])
 	log.Printf("[loadbalancer]")
 	for serverAddr, failCount := range lb.serverFailureCount {
 		log.Printf("[loadbalancer] Server %s failed to connect %d times", serverAddr, failCount)
 	}
+	for serverID, health := range lb.serverHealthMap {
+		if health.Status != pdu.STATUS_HEALTHY {
+			log.Printf("[loadbalancer] Server %s is %s", serverID, describeStatus(health.Status, health.StatusReason))
+		}
+		if health.StaleResponses > 0 {
+			log.Printf("[loadbalancer] Server %s sent %d stale responses", serverID, health.StaleResponses)
+		}
+		if rt := health.session.responseTimeStats(); rt.Samples > 0 {
+			log.Printf("[loadbalancer] Server %s response time: %s", serverID, rt)
+		}
+		for _, window := range lb.cfg.AggregateWindows {
+			if aggregates, ok := health.Aggregates[window]; ok {
+				log.Printf("[loadbalancer] Server %s over %s: %s", serverID, window, formatAggregates(aggregates))
+			}
+		}
+		if hb := health.session.heartbeatStats(); hb.Received > 0 {
+			log.Printf("[loadbalancer] Server %s heartbeats: %d received, %.1f%% lost, largest gap %d, last seen %s ago",
+				serverID, hb.Received, 100*hb.LossRate(), hb.LargestGap, time.Since(hb.LastSeen).Round(time.Millisecond))
+		}
+		ts := health.session.transportStats()
+		if ts.CloseReason != "" {
+			log.Printf("[loadbalancer] Server %s connection closed: %s", serverID, ts.CloseReason)
+		}
+		log.Printf("[loadbalancer] Server %s transport: RTT %s (min %s), %d/%d packets lost (%.1f%%), cwnd %d bytes, %d bytes in flight, %s",
+			serverID, ts.SmoothedRTT.Round(time.Microsecond), ts.MinRTT.Round(time.Microsecond), ts.PacketsLost, ts.PacketsSent,
+			100*ts.LossRate(), ts.CongestionWindow, ts.BytesInFlight, ts.CongestionState)
+	}
 }
 
-// protocolHandler handles the protocol communication with a server.
-func (lb *LoadBalancer) protocolHandler(conn quic.Connection) string {
+// protocolHandler runs HELLO/ACK with a server and sets up the session
+// it agrees on, which startSession starts using. It returns an error if
+// the server didn't complete HELLO/ACK.
+func (lb *LoadBalancer) protocolHandler(conn quic.Connection) (*session, error) {
 	stream, err := conn.OpenStreamSync(lb.ctx)
 	if err != nil {
-		log.Printf("[loadbalancer] error opening stream: %s", err)
-		return ""
+		return nil, fmt.Errorf("error opening stream: %w", err)
+	}
+	if pdu.UsesStreamPreamble(pdu.LocalMaxVersion(lb.cfg.MaxVersion)) {
+		if err := pdu.WriteStreamType(stream, pdu.STREAM_CONTROL); err != nil {
+			return nil, fmt.Errorf("error writing to stream: %w", err)
+		}
 	}
 	// Send HELLO PDU
-	helloData := map[string]interface{}{
-		"supported_metrics": []string{"cpu_load", "memory_usage", "response_time"},
-		"check_interval":    5,
-		"auth_token":        util.GenerateJWT("loadbalancer123"),
-		"version":           1.0,
-	}
-	helloBytes, _ := json.Marshal(helloData)
-	helloPdu := pdu.PDU{
-		Mtype:  pdu.TYPE_HELLO,
-		Length: uint16(len(helloBytes)),
-		Data:   helloBytes,
-	}
-	pduBytes, _ := pdu.PduToBytes(&helloPdu)
-	_, err = stream.Write(pduBytes)
-	if err != nil {
-		log.Printf("[loadbalancer] error writing to stream: %s", err)
-		return ""
+	hello := &pdu.HelloPayload{
+		SupportedMetrics: lb.cfg.Metrics,
+		CheckInterval:    5,
+		AuthToken:        util.GenerateJWT(lb.cfg.ClientID),
+		MinVersion:       pdu.MIN_PROTOCOL_VERSION,
+		MaxVersion:       pdu.LocalMaxVersion(lb.cfg.MaxVersion),
+		Codecs:           lb.offeredCodecs(),
+		MaxPduSize:       lb.cfg.MaxPduSize,
+		PushMode:         lb.cfg.PushMode,
+		PushThresholds:   lb.cfg.PushThresholds,
+		AggregateWindows: lb.cfg.AggregateWindows,
+	}
+	if conn.ConnectionState().SupportsDatagrams {
+		hello.HeartbeatInterval = lb.cfg.HeartbeatInterval
 	}
-	// Read the ACK message from the server
-	ackBuffer := pdu.MakePduBuffer()
-	n, err := stream.Read(ackBuffer)
+	reader := pdu.NewReader(stream)
+	writer := pdu.NewWriter(stream)
+	lb.setTrace(conn, reader, writer, "control")
+	err = writer.WritePayload(pdu.TYPE_HELLO, hello)
 	if err != nil {
-		log.Printf("[loadbalancer] Error reading ACK from stream: %v", err)
-		return ""
+		return nil, fmt.Errorf("error writing to stream: %w", err)
 	}
-	ackPdu, err := pdu.PduFromBytes(ackBuffer[:n])
+	// Read the ACK message from the server, which must not keep us waiting
+	stream.SetReadDeadline(time.Now().Add(ackTimeout))
+	ackPdu, err := reader.ReadPDU()
 	if err != nil {
-		log.Printf("[loadbalancer] Error converting ACK pdu from bytes: %s", err)
-		return ""
+		return nil, fmt.Errorf("error reading ACK from stream: %w", err)
 	}
+	stream.SetReadDeadline(time.Time{})
 	log.Printf("[loadbalancer] Got ACK response: %s", ackPdu.ToJsonString())
+	if ackPdu.Mtype == pdu.TYPE_ERROR {
+		errorData := &pdu.ErrorPayload{}
+		if err := pdu.DecodePayload(ackPdu.Data, errorData); err != nil {
+			return nil, fmt.Errorf("error decoding ERROR from server: %w", err)
+		}
+		if errorData.ErrorCode == pdu.ERROR_UNSUPPORTED_VERSION {
+			return nil, fmt.Errorf("server rejected protocol versions [%d, %d], it supports [%d, %d]",
+				hello.MinVersion, hello.MaxVersion, errorData.MinVersion, errorData.MaxVersion)
+		}
+		return nil, fmt.Errorf("server rejected HELLO (%s, %s): %s",
+			pdu.ErrorName(errorData.ErrorCode), pdu.ClassifyError(errorData.ErrorCode), errorData.ErrorMessage)
+	}
+	if ackPdu.Mtype != pdu.TYPE_ACK {
+		return nil, fmt.Errorf("expected ACK, got %s", ackPdu.GetTypeAsString())
+	}
+
+	ackData := &pdu.AckPayload{}
+	if err := pdu.DecodePayload(ackPdu.Data, ackData); err != nil {
+		return nil, fmt.Errorf("error decoding ACK: %w", err)
+	}
+
+	// Servers that predate negotiation don't send a version and speak version 1
+	if ackData.Version == 0 {
+		ackData.Version = pdu.PROTOCOL_VERSION_1
+	}
+	if ackData.Version < hello.MinVersion || ackData.Version > hello.MaxVersion {
+		return nil, fmt.Errorf("server %s picked protocol version %d which was not offered", ackData.ServerID, ackData.Version)
+	}
+
+	// Switch to the codec and PDU size chosen by the server
+	codec := pdu.JsonCodec
+	if pdu.SupportsCodecNegotiation(ackData.Version) {
+		if c, ok := pdu.CodecByName(ackData.Codec, ackData.Version); ok {
+			codec = c
+		}
+	}
+	maxPduSize := pdu.MAX_PDU_SIZE
+	if pdu.SupportsLargePdus(ackData.Version) {
+		if ackData.MaxPduSize > pdu.NegotiatePduSize(lb.cfg.MaxPduSize, pdu.MAX_NEGOTIABLE_PDU_SIZE) {
+			return nil, fmt.Errorf("server %s picked a %d byte PDU limit, more than was offered", ackData.ServerID, ackData.MaxPduSize)
+		}
+		maxPduSize = pdu.NegotiatePduSize(ackData.MaxPduSize, ackData.MaxPduSize)
+	}
+	reader.SetCodec(codec)
+	writer.SetCodec(codec)
+	reader.SetMaxPduSize(maxPduSize)
+	writer.SetMaxPduSize(maxPduSize)
+	log.Printf("[loadbalancer] Agreed on protocol version %d with %s codec and %d byte PDUs for server %s",
+		ackData.Version, codec.Name(), maxPduSize, ackData.ServerID)
+	log.Printf("[loadbalancer] Server %s will report metrics %v", ackData.ServerID, ackData.ConfirmedMetrics)
+	if len(lb.cfg.AggregateWindows) > 0 {
+		log.Printf("[loadbalancer] Server %s will report aggregates over %v", ackData.ServerID, ackData.AggregateWindows)
+	}
+	if ackData.Weight > 0 || ackData.MaxConnections > 0 || len(ackData.Labels) > 0 {
+		log.Printf("[loadbalancer] Server %s advertises weight %d, max connections %d, labels %v",
+			ackData.ServerID, ackData.Weight, ackData.MaxConnections, ackData.Labels)
+	}
+
+	sess := newSession(ackData.ServerID, conn, ackData.Version, hello.CheckInterval, ackData.ConfirmedMetrics)
+	sess.trace = lb.takeTrace(conn)
+	sess.trace.nameQlog(lb.cfg.QlogDir, ackData.ServerID)
+	sess.pushMode = ackData.PushMode
+	sess.ack = ackData
+	sess.control = sess.newChannel("control", reader, writer)
+	sess.health = sess.control
+	if pdu.SupportsHealthStreams(ackData.Version) {
+		// Health checks get their own stream so that a large control
+		// message can't hold them up
+		healthStream, err := conn.OpenStreamSync(lb.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error opening health stream: %w", err)
+		}
+		if err := pdu.WriteStreamType(healthStream, pdu.STREAM_HEALTH); err != nil {
+			return nil, fmt.Errorf("error writing to health stream: %w", err)
+		}
+		healthReader := pdu.NewReader(healthStream)
+		healthWriter := pdu.NewWriter(healthStream)
+		lb.setTrace(conn, healthReader, healthWriter, "health")
+		healthReader.SetCodec(codec)
+		healthWriter.SetCodec(codec)
+		healthReader.SetMaxPduSize(maxPduSize)
+		healthWriter.SetMaxPduSize(maxPduSize)
+		sess.health = sess.newChannel("health", healthReader, healthWriter)
+	}
+	return sess, nil
+}
+
+// startSession starts reading the streams of a session and checking the
+// health of its server. The session's server ID must have been claimed.
+func (lb *LoadBalancer) startSession(sess *session) {
+	if sess.health != sess.control {
+		go lb.runChannel(sess, sess.control, lb.discardStaleResponse)
+	}
+	go lb.runChannel(sess, sess.health, func(serverID string, rsp *pdu.PDU) {
+		// Push-mode servers send HEALTH_DATA, or an ERROR saying why they can't
+		pushed := rsp.Mtype == pdu.TYPE_HEALTH_DATA || (rsp.Mtype == pdu.TYPE_ERROR && rsp.ID == 0)
+		if pushed && sess.pushMode {
+			sess.touch()
+			lb.handleHealthResponse(sess, rsp)
+			return
+		}
+		lb.discardStaleResponse(serverID, rsp)
+	})
+
+	if sess.ack.HeartbeatInterval > 0 {
+		go lb.receiveHeartbeats(sess, time.Duration(sess.ack.HeartbeatInterval)*time.Millisecond)
+	}
+
+	if sess.pushMode {
+		// The server pushes on its own, just make sure it keeps doing so
+		log.Printf("[loadbalancer] Server %s will push health data", sess.serverID)
+		go lb.watchHealthData(sess)
+	} else {
+		// Periodically send health check requests
+		go lb.sendHealthChecks(sess)
+	}
+}
 
-	var ackData struct {
-		ServerID string `json:"server_id"`
+// runChannel reads from one stream of a session until it fails, then
+// marks the server down. PDUs that answer no request go to unmatched.
+func (lb *LoadBalancer) runChannel(sess *session, ch *channel, unmatched func(serverID string, rsp *pdu.PDU)) {
+	err := ch.readLoop(func(rsp *pdu.PDU) {
+		unmatched(sess.serverID, rsp)
+	})
+	log.Printf("[loadbalancer] %s stream of session with server %s ended: %v", ch.name, sess.serverID, err)
+	reason := DOWN_CONNECTION_LOST
+	var idleErr *quic.IdleTimeoutError
+	if errors.As(err, &idleErr) {
+		reason = DOWN_IDLE_TIMEOUT
 	}
-	json.Unmarshal(ackPdu.Data, &ackData)
+	lb.markServerDown(sess.serverID, sess.conn, reason)
+}
 
-	// Periodically send health check requests
-	go lb.sendHealthChecks(conn, ackData.ServerID, stream, helloData["check_interval"].(int))
+// setTrace records the PDUs of one stream to a server in the trace file, if any.
+func (lb *LoadBalancer) setTrace(conn quic.Connection, reader *pdu.Reader, writer *pdu.Writer, stream string) {
+	if lb.trace == nil {
+		return
+	}
+	peer := conn.RemoteAddr().String()
+	reader.SetTrace(lb.trace, peer, stream)
+	writer.SetTrace(lb.trace, peer, stream)
+}
 
-	return ackData.ServerID
+// quicConfig returns the QUIC configuration used to dial servers.
+func (lb *LoadBalancer) quicConfig() *quic.Config {
+	config := lb.cfg.QuicConfig()
+	config.EnableDatagrams = config.EnableDatagrams && lb.cfg.HeartbeatInterval > 0
+	config.Tracer = lb.newConnectionTracer
+	return config
 }
 
-// sendHealthChecks sends periodic health check requests to a server.
-func (lb *LoadBalancer) sendHealthChecks(conn quic.Connection, serverID string, stream quic.Stream, checkInterval int) {
-	ticker := time.NewTicker(time.Duration(checkInterval) * time.Second)
+// offeredCodecs returns the codecs offered in HELLO, in order of preference.
+func (lb *LoadBalancer) offeredCodecs() []string {
+	if lb.cfg.Codec == pdu.CODEC_JSON {
+		return []string{pdu.CODEC_JSON}
+	}
+	return []string{pdu.CODEC_BINARY, pdu.CODEC_JSON}
+}
+
+// sendHealthChecks sends periodic health check requests to a server. Each
+// request is awaited on its own, so a slow response doesn't hold up the
+// next tick.
+func (lb *LoadBalancer) sendHealthChecks(sess *session) {
+	serverID := sess.serverID
+	interval := sess.interval()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-sess.closed:
+			return
+		case <-sess.reconfigured:
+			interval = sess.interval()
+			ticker.Reset(interval)
+			continue
+		case <-ticker.C:
+		}
+		if sess.backingOff() {
+			log.Printf("[loadbalancer] Skipping health check of rate limited server %s", serverID)
+			continue
+		}
 		// Send health check request
-		reqPdu := pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST}
-		reqBytes, _ := pdu.PduToBytes(&reqPdu)
-		_, err := stream.Write(reqBytes)
+		req, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
 		if err != nil {
 			log.Printf("[loadbalancer] Error sending health check request to server %s: %v", serverID, err)
 			lb.markServerUnhealthy(serverID)
 			continue
 		}
-		log.Printf("[loadbalancer] Sent health check request to server %s", serverID)
+		log.Printf("[loadbalancer] Sent health check request %d to server %s", req.id, serverID)
+		go lb.awaitHealthResponse(sess, req, responseTimeoutIntervals*interval)
+	}
+}
+
+// awaitHealthResponse waits for the response to a health check request.
+func (lb *LoadBalancer) awaitHealthResponse(sess *session, req *pendingRequest, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var rsp *pdu.PDU
+	var ok bool
+	select {
+	case rsp, ok = <-req.reply:
+	case <-timer.C:
+		if sess.health.cancel(req) {
+			log.Printf("[loadbalancer] Health check request %d to server %s timed out after %s", req.id, sess.serverID, timeout)
+			lb.markServerUnhealthy(sess.serverID)
+			return
+		}
+		// The response arrived just as the timer fired
+		rsp, ok = <-req.reply
+	}
+	if !ok {
+		log.Printf("[loadbalancer] Session with server %s closed before health check request %d was answered", sess.serverID, req.id)
+		lb.markServerUnhealthy(sess.serverID)
+		return
+	}
+	if rsp.Mtype == pdu.TYPE_HEALTH_RESPONSE {
+		sess.recordResponseTime(time.Since(req.sentAt))
+	}
+	lb.handleHealthResponse(sess, rsp)
+}
 
-		// Read and process server response
-		buffer := pdu.MakePduBuffer()
-		n, err := stream.Read(buffer)
-		if err != nil {
-			log.Printf("[loadbalancer] Error reading from stream for server %s: %v", serverID, err)
-			lb.markServerUnhealthy(serverID)
+// watchHealthData marks a push-mode server unhealthy for every check
+// interval in which it hasn't pushed HEALTH_DATA within the response timeout.
+func (lb *LoadBalancer) watchHealthData(sess *session) {
+	interval := sess.interval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.closed:
+			return
+		case <-sess.reconfigured:
+			interval = sess.interval()
+			ticker.Reset(interval)
 			continue
+		case <-ticker.C:
+		}
+		if silence := time.Since(sess.lastSeen()); silence > responseTimeoutIntervals*interval {
+			log.Printf("[loadbalancer] No health data from server %s for %s", sess.serverID, silence.Round(time.Second))
+			lb.markServerUnhealthy(sess.serverID)
 		}
+	}
+}
 
-		rsp, err := pdu.PduFromBytes(buffer[:n])
-		if err != nil {
-			log.Printf("[loadbalancer] Error converting pdu from bytes for server %s: %s", serverID, err)
-			continue
+// handleHealthResponse processes health data from a server, whether it
+// answers a health check request or was pushed.
+func (lb *LoadBalancer) handleHealthResponse(sess *session, rsp *pdu.PDU) {
+	serverID := sess.serverID
+	rspDataString := string(rsp.Data)
+	log.Printf("[loadbalancer] Decoded string from server %s: %s", serverID, rspDataString)
+	switch rsp.Mtype {
+	case pdu.TYPE_HEALTH_RESPONSE, pdu.TYPE_HEALTH_DATA:
+		healthData := &pdu.HealthResponsePayload{}
+		if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+			log.Printf("[loadbalancer] Malformed health data from server %s: %s", serverID, err)
+			lb.markServerUnhealthy(serverID)
+			return
 		}
-		rspDataString := string(rsp.Data)
-		log.Printf("[loadbalancer] Decoded string from server %s: %s", serverID, rspDataString)
-		switch rsp.Mtype {
-		case pdu.TYPE_HEALTH_RESPONSE:
-			var healthData struct {
-				Timestamp string             `json:"timestamp"`
-				Metrics   map[string]float64 `json:"metrics"`
-			}
-			json.Unmarshal(rsp.Data, &healthData)
-			log.Printf("[loadbalancer] Received health data from server %s: CPU Usage: %.2f%%, Memory Usage: %.2f%%",
-				serverID, healthData.Metrics["cpu_usage_percent"], healthData.Metrics["memory_usage_percent"])
-			lb.markServerHealthy(serverID)
-		case pdu.TYPE_ERROR:
-			var errorData struct {
-				ErrorCode    int    `json:"error_code"`
-				ErrorMessage string `json:"error_message"`
-			}
-			json.Unmarshal(rsp.Data, &errorData)
-			log.Printf("[loadbalancer] Error from server %s: %d - %s", serverID, errorData.ErrorCode, errorData.ErrorMessage)
+		log.Printf("[loadbalancer] Received health data from server %s: %s", serverID, formatMetrics(healthData.Metrics))
+		lb.setAggregates(serverID, healthData.Aggregates)
+		status, reason := healthData.Status, healthData.StatusReason
+		if status == "" {
+			// Servers that predate statuses only send health data while they are fine
+			status = pdu.STATUS_HEALTHY
+		}
+		if status == pdu.STATUS_DOWN {
+			lb.markReportedDown(serverID, reason, healthData.Probes)
+			return
+		}
+		if slow := lb.slowResponses(sess, healthData.Metrics); status == pdu.STATUS_HEALTHY && slow != "" {
+			status, reason = pdu.STATUS_DEGRADED, slow
+		}
+		lb.setServerStatus(serverID, status, reason, healthData.Probes)
+	case pdu.TYPE_ERROR:
+		errorData := &pdu.ErrorPayload{}
+		if err := pdu.DecodePayload(rsp.Data, errorData); err != nil {
+			log.Printf("[loadbalancer] Malformed error from server %s: %s", serverID, err)
 			lb.markServerUnhealthy(serverID)
-		case pdu.TYPE_CONFIG_ACK:
-			var configAck struct {
-				UpdateStatus string `json:"update_status"`
-				Message      string `json:"message"`
-			}
-			json.Unmarshal(rsp.Data, &configAck)
+			return
+		}
+		lb.handleServerError(sess, errorData)
+	default:
+		log.Printf("[loadbalancer] Unexpected %s in reply to health check from server %s", rsp.GetTypeAsString(), serverID)
+		lb.markServerUnhealthy(serverID)
+	}
+}
+
+// handleServerError reacts to an ERROR in place of health data. Only
+// errors that say something about the server's health count as failed
+// checks; fatal errors take the server down right away.
+func (lb *LoadBalancer) handleServerError(sess *session, errorData *pdu.ErrorPayload) {
+	serverID := sess.serverID
+	class := pdu.ClassifyError(errorData.ErrorCode)
+	log.Printf("[loadbalancer] Error from server %s: %d %s (%s) - %s",
+		serverID, errorData.ErrorCode, pdu.ErrorName(errorData.ErrorCode), class, errorData.ErrorMessage)
+	switch {
+	case errorData.ErrorCode == pdu.ERROR_RATE_LIMITED:
+		// Ease off instead of holding it against the server
+		sess.backOff(sess.interval())
+	case errorData.ErrorCode == pdu.ERROR_METRIC_UNAVAILABLE:
+		// The server is up, it just couldn't measure itself this time
+	case errorData.ErrorCode == pdu.ERROR_DRAINING:
+		// Servers that predate STATUS_DRAINING say so with an error
+		lb.markServerDraining(serverID)
+	case class == pdu.ERROR_CLASS_RETRYABLE:
+		lb.markServerUnhealthy(serverID)
+	default:
+		// Retrying won't help, so reconnect from scratch
+		lb.markServerDown(serverID, sess.conn, DOWN_FATAL_ERROR)
+	}
+}
+
+// slowResponses says why a server counts as degraded for answering too
+// slowly: the p95 of its health check response times, or the response
+// time of its application as measured by its probes, is over
+// MaxResponseTime. It returns "" if the server is fast enough.
+func (lb *LoadBalancer) slowResponses(sess *session, metrics map[string]float64) string {
+	if lb.cfg.MaxResponseTime <= 0 {
+		return ""
+	}
+	limit := milliseconds(lb.cfg.MaxResponseTime)
+	if stats := sess.responseTimeStats(); stats.Samples >= minResponseTimeSamples && stats.P95Ms > limit {
+		return fmt.Sprintf("response time p95 %.1fms over %s", stats.P95Ms, lb.cfg.MaxResponseTime)
+	}
+	// Reported by servers asked for "response_time"
+	if ms, ok := metrics["response_time_ms"]; ok && ms > limit {
+		return fmt.Sprintf("application response time %.1fms over %s", ms, lb.cfg.MaxResponseTime)
+	}
+	return ""
+}
+
+// describeStatus formats a status with its reason, if there is one.
+func describeStatus(status string, reason string) string {
+	if reason == "" {
+		return status
+	}
+	return status + ": " + reason
+}
+
+// formatMetrics lists metrics as name=value pairs, sorted by name.
+func formatMetrics(metrics map[string]float64) string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%.2f", name, metrics[name])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// formatAggregates lists metric aggregates sorted by metric name.
+func formatAggregates(aggregates map[string]pdu.MetricAggregate) string {
+	names := make([]string, 0, len(aggregates))
+	for name := range aggregates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		a := aggregates[name]
+		parts[i] = fmt.Sprintf("%s avg=%.2f max=%.2f p95=%.2f", name, a.Avg, a.Max, a.P95)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// discardStaleResponse drops a PDU that doesn't answer any pending request.
+func (lb *LoadBalancer) discardStaleResponse(serverID string, rsp *pdu.PDU) {
+	if rsp.Mtype == pdu.TYPE_CONFIG_ACK {
+		configAck := &pdu.ConfigAckPayload{}
+		if err := pdu.DecodePayload(rsp.Data, configAck); err == nil {
 			log.Printf("[loadbalancer] Configuration update ACK from server %s: %s - %s", serverID, configAck.UpdateStatus, configAck.Message)
 		}
 	}
+	log.Printf("[loadbalancer] Discarding stale %s (id %d) from server %s", rsp.GetTypeAsString(), rsp.ID, serverID)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if serverHealth, ok := lb.serverHealthMap[serverID]; ok {
+		serverHealth.StaleResponses++
+	}
 }
 
-// markServerHealthy marks a server as healthy.
-func (lb *LoadBalancer) markServerHealthy(serverID string) {
+// setServerStatus records the status a server reported with its health
+// data, which also ends any run of failed checks.
+func (lb *LoadBalancer) setServerStatus(serverID string, status string, reason string, probes []pdu.ProbeResult) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 	if serverHealth, ok := lb.serverHealthMap[serverID]; ok {
+		if serverHealth.Status != status || serverHealth.StatusReason != reason {
+			log.Printf("[loadbalancer] Server %s is %s", serverID, describeStatus(status, reason))
+		}
 		serverHealth.FailedAttempts = 0
-		serverHealth.IsHealthy = true
+		serverHealth.Status = status
+		serverHealth.StatusReason = reason
+		serverHealth.Probes = probes
+		serverHealth.reportedDown = false
 		delete(lb.serverFailureCount, serverHealth.conn.RemoteAddr().String()) // Remove from failure count if healthy
 	}
 }
 
+// setAggregates keeps the metric aggregates of a server's latest health data.
+func (lb *LoadBalancer) setAggregates(serverID string, aggregates map[string]map[string]pdu.MetricAggregate) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if serverHealth, ok := lb.serverHealthMap[serverID]; ok {
+		serverHealth.Aggregates = aggregates
+	}
+}
+
 // markServerUnhealthy marks a server as unhealthy.
 func (lb *LoadBalancer) markServerUnhealthy(serverID string) {
 	lb.mu.Lock()
@@ -321,46 +844,110 @@ func (lb *LoadBalancer) markServerUnhealthy(serverID string) {
 	if serverHealth, ok := lb.serverHealthMap[serverID]; ok {
 		serverHealth.FailedAttempts++
 		if serverHealth.FailedAttempts >= serverHealth.MaxFailAttempts {
-			serverHealth.IsHealthy = false
+			serverHealth.Status = pdu.STATUS_DOWN
+			serverHealth.StatusReason = DOWN_FAILED_CHECKS
+			serverHealth.reportedDown = false
 			serverAddr := strings.Split(serverHealth.conn.RemoteAddr().String(), ":")[0] // Extract the server address without the port number
 			lb.serverFailureCount[serverAddr] = serverHealth.FailedAttempts
-			log.Printf("[loadbalancer] Server %s is down", serverID)
+			log.Printf("[loadbalancer] Server %s is down: %s", serverID, serverHealth.StatusReason)
+		}
+	}
+}
+
+// markReportedDown counts a check in which the server said it is down,
+// e.g. because its application probes fail. The connection is fine, so
+// unlike markServerUnhealthy it doesn't reconnect.
+func (lb *LoadBalancer) markReportedDown(serverID string, reason string, probes []pdu.ProbeResult) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	serverHealth, ok := lb.serverHealthMap[serverID]
+	if !ok {
+		return
+	}
+	serverHealth.Probes = probes
+	for _, probe := range probes {
+		if !probe.Passed {
+			log.Printf("[loadbalancer] Probe %s failed on server %s: %s", probe.Name, serverID, probe.Output)
+		}
+	}
+	if reason == "" {
+		reason = DOWN_REPORTED
+	}
+	serverHealth.FailedAttempts++
+	if serverHealth.FailedAttempts >= serverHealth.MaxFailAttempts {
+		if serverHealth.Status != pdu.STATUS_DOWN || serverHealth.StatusReason != reason {
+			log.Printf("[loadbalancer] Server %s is down: %s", serverID, reason)
 		}
+		serverHealth.Status = pdu.STATUS_DOWN
+		serverHealth.StatusReason = reason
+		serverHealth.reportedDown = true
+	}
+}
+
+// markServerDraining takes a server out of rotation until it reports
+// health data again, without counting a failed check.
+func (lb *LoadBalancer) markServerDraining(serverID string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if serverHealth, ok := lb.serverHealthMap[serverID]; ok && serverHealth.Status != pdu.STATUS_DRAINING && serverHealth.Status != pdu.STATUS_DOWN {
+		serverHealth.Status = pdu.STATUS_DRAINING
+		serverHealth.StatusReason = ""
+		log.Printf("[loadbalancer] Server %s is draining", serverID)
 	}
 }
 
+// markServerDown marks a server as down right away for one of the DOWN_*
+// reasons, e.g. when its session ends. It ignores the call if conn is no
+// longer the server's connection.
+func (lb *LoadBalancer) markServerDown(serverID string, conn quic.Connection, reason string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	serverHealth, ok := lb.serverHealthMap[serverID]
+	if !ok || serverHealth.conn != conn || (serverHealth.Status == pdu.STATUS_DOWN && !serverHealth.reportedDown) {
+		return
+	}
+	serverHealth.FailedAttempts = serverHealth.MaxFailAttempts
+	serverHealth.Status = pdu.STATUS_DOWN
+	serverHealth.StatusReason = reason
+	serverHealth.reportedDown = false
+	serverAddr := strings.Split(serverHealth.conn.RemoteAddr().String(), ":")[0] // Extract the server address without the port number
+	lb.serverFailureCount[serverAddr] = serverHealth.FailedAttempts
+	log.Printf("[loadbalancer] Server %s is down: %s", serverID, reason)
+}
+
 // reconnectDownServers attempts to reconnect to down servers.
 func (lb *LoadBalancer) reconnectDownServers() {
 	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	failCounts := maps.Clone(lb.serverFailureCount)
+	lb.mu.Unlock()
 
-	for serverAddr, failCount := range lb.serverFailureCount {
+	for serverAddr, failCount := range failCounts {
 		log.Printf("[loadbalancer] Attempting to reconnect to server %s (failed %d times)", serverAddr, failCount)
 
 		// Attempt to reconnect to the server
-		conn, err := quic.DialAddr(lb.ctx, serverAddr, lb.tls, nil)
+		sess, err := lb.connect(serverAddr)
 		if err != nil {
 			log.Printf("[loadbalancer] Failed to reconnect to server %s: %v", serverAddr, err)
 			continue
 		}
 
-		serverID := lb.protocolHandler(conn)
-		if serverID == "" {
-			log.Printf("[loadbalancer] Failed to get server ID for %s", serverAddr)
+		// Update the server health map with the new connection, unless the
+		// server came back some other way in the meantime
+		lb.mu.Lock()
+		if _, down := lb.serverFailureCount[serverAddr]; !down {
+			lb.mu.Unlock()
+			sess.conn.CloseWithError(0, "already reconnected")
 			continue
 		}
-
-		// Update the server health map with the new connection
-		lb.serverHealthMap[serverID] = &ServerHealth{
-			ServerID:        serverID,
-			IsHealthy:       true,
-			FailedAttempts:  0,
-			MaxFailAttempts: lb.cfg.MaxFailAttempts,
-			conn:            conn,
+		if !lb.claimServerID(serverAddr, sess.conn, sess) {
+			lb.mu.Unlock()
+			continue
 		}
 
 		// Remove the server from the failure count map
 		delete(lb.serverFailureCount, serverAddr)
+		lb.mu.Unlock()
+		lb.startSession(sess)
 
 		log.Printf("[loadbalancer] Successfully reconnected to server %s", serverAddr)
 	}
@@ -0,0 +1,88 @@
+package loadbalancer
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+func TestMain(m *testing.M) {
+	// NewLoadBalancer won't start without a JWT secret
+	util.SetJWTSecret([]byte("test-secret"))
+	os.Exit(m.Run())
+}
+
+// testConn is a connection that only knows whether it is closed.
+type testConn struct {
+	quic.Connection
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeCode quic.ApplicationErrorCode
+}
+
+func newTestConn() *testConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &testConn{ctx: ctx, cancel: cancel}
+}
+
+func (c *testConn) Context() context.Context { return c.ctx }
+
+func (c *testConn) CloseWithError(code quic.ApplicationErrorCode, reason string) error {
+	c.closeCode = code
+	c.cancel()
+	return nil
+}
+
+func TestClaimServerID(t *testing.T) {
+	lb := NewLoadBalancer(LoadBalancerConfig{ClientID: "lb-1"})
+	claim := func(serverAddr string, instanceID string) (*testConn, bool) {
+		conn := newTestConn()
+		sess := newSession("web-1", conn, pdu.MAX_PROTOCOL_VERSION, 5, nil)
+		sess.ack = &pdu.AckPayload{ServerID: "web-1", InstanceID: instanceID}
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		return conn, lb.claimServerID(serverAddr, conn, sess)
+	}
+
+	first, ok := claim("10.0.0.1:4243", "a")
+	if !ok {
+		t.Fatal("first server was refused")
+	}
+	if health := lb.serverHealthMap["web-1"]; health.Address != "10.0.0.1:4243" || health.Status != pdu.STATUS_NOT_READY {
+		t.Errorf("claimed server = %+v, want 10.0.0.1:4243 not ready", health)
+	}
+
+	// A second server using the same ID is refused while the first is connected
+	dup, ok := claim("10.0.0.2:4243", "b")
+	if ok {
+		t.Error("second server with the same ID was accepted")
+	}
+	if dup.ctx.Err() == nil || dup.closeCode != pdu.ERROR_DUPLICATE_SERVER_ID {
+		t.Errorf("second server's connection closed with %d, want %d", dup.closeCode, pdu.ERROR_DUPLICATE_SERVER_ID)
+	}
+	if health := lb.serverHealthMap["web-1"]; health.conn != first {
+		t.Error("refused server replaced the first one")
+	}
+
+	// but the first server may reconnect, e.g. after a restart
+	again, ok := claim("10.0.0.1:4243", "c")
+	if !ok {
+		t.Fatal("reconnect from the same address was refused")
+	}
+	if health := lb.serverHealthMap["web-1"]; health.conn != again || health.InstanceID != "c" {
+		t.Errorf("reconnected server = %+v, want the new connection", health)
+	}
+
+	// and once its connection is gone, the ID may move to another address
+	again.CloseWithError(0, "")
+	if _, ok := claim("10.0.0.2:4243", "d"); !ok {
+		t.Error("server was refused the ID of a closed connection")
+	}
+	if health := lb.serverHealthMap["web-1"]; health.Address != "10.0.0.2:4243" {
+		t.Errorf("server moved to %s, want 10.0.0.2:4243", health.Address)
+	}
+}
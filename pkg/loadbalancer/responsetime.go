@@ -0,0 +1,77 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// responseTimeWindow is how many of the latest health checks response
+	// time statistics cover.
+	responseTimeWindow = 100
+	// minResponseTimeSamples is how many health checks have to be timed
+	// before slow responses count against a server.
+	minResponseTimeSamples = 5
+)
+
+// ResponseTimeStats summarizes how long a server took to answer recent
+// health checks, from sending HEALTH_REQUEST to receiving HEALTH_RESPONSE.
+type ResponseTimeStats struct {
+	Samples int     `json:"samples"`
+	MinMs   float64 `json:"min_ms"`
+	AvgMs   float64 `json:"avg_ms"`
+	P95Ms   float64 `json:"p95_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+}
+
+func (r ResponseTimeStats) String() string {
+	return fmt.Sprintf("min %.2fms, avg %.2fms, p95 %.2fms, p99 %.2fms over %d checks",
+		r.MinMs, r.AvgMs, r.P95Ms, r.P99Ms, r.Samples)
+}
+
+// responseTimes keeps the response times of the latest health checks in
+// a ring buffer.
+type responseTimes struct {
+	samples [responseTimeWindow]time.Duration
+	next    int
+	count   int
+}
+
+// record adds a response time, replacing the oldest once the window is full.
+func (r *responseTimes) record(d time.Duration) {
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % len(r.samples)
+	r.count = min(r.count+1, len(r.samples))
+}
+
+// stats computes the statistics of the response times in the window.
+func (r *responseTimes) stats() ResponseTimeStats {
+	if r.count == 0 {
+		return ResponseTimeStats{}
+	}
+	sorted := slices.Clone(r.samples[:r.count])
+	slices.Sort(sorted)
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return ResponseTimeStats{
+		Samples: r.count,
+		MinMs:   milliseconds(sorted[0]),
+		AvgMs:   milliseconds(total / time.Duration(r.count)),
+		P95Ms:   milliseconds(percentile(sorted, 0.95)),
+		P99Ms:   milliseconds(percentile(sorted, 0.99)),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
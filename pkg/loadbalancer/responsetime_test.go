@@ -0,0 +1,59 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponseTimeStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    ResponseTimeStats
+	}{
+		{name: "empty", want: ResponseTimeStats{}},
+		{
+			name:    "single",
+			samples: []time.Duration{3 * time.Millisecond},
+			want:    ResponseTimeStats{Samples: 1, MinMs: 3, AvgMs: 3, P95Ms: 3, P99Ms: 3},
+		},
+		{
+			// 1..100ms, recorded from slowest to fastest
+			name:    "full",
+			samples: durations(100, 1, -1),
+			want:    ResponseTimeStats{Samples: 100, MinMs: 1, AvgMs: 50.5, P95Ms: 95, P99Ms: 99},
+		},
+		{
+			// 1..20ms, so the nearest ranks are the 19th and 20th
+			name:    "partial",
+			samples: durations(1, 20, 1),
+			want:    ResponseTimeStats{Samples: 20, MinMs: 1, AvgMs: 10.5, P95Ms: 19, P99Ms: 20},
+		},
+		{
+			// 1..150ms: the first 50 were overwritten, leaving 51..150ms
+			name:    "wrapped",
+			samples: durations(1, 150, 1),
+			want:    ResponseTimeStats{Samples: 100, MinMs: 51, AvgMs: 100.5, P95Ms: 145, P99Ms: 149},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r responseTimes
+			for _, d := range tt.samples {
+				r.record(d)
+			}
+			if got := r.stats(); got != tt.want {
+				t.Errorf("stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// durations returns from..to milliseconds in steps of step.
+func durations(from, to, step int) []time.Duration {
+	var ds []time.Duration
+	for ms := from; ms != to+step; ms += step {
+		ds = append(ds, time.Duration(ms)*time.Millisecond)
+	}
+	return ds
+}
@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+
+	"github.com/quic-go/quic-go"
+)
+
+// sessionCacheSize is how many TLS session tickets are kept per server.
+const sessionCacheSize = 4
+
+// dial connects to a server, tagging the connection's trace with its
+// address. With 0-RTT enabled, a server whose TLS session can be resumed
+// is dialed with quic.DialAddrEarly, so HELLO goes out in the first flight.
+func (lb *LoadBalancer) dial(serverAddr string) (quic.Connection, error) {
+	ctx := context.WithValue(lb.ctx, serverAddrKey{}, serverAddr)
+	if !lb.cfg.ZeroRTT {
+		return quic.DialAddr(ctx, serverAddr, lb.tls, lb.quicConfig())
+	}
+	tlsConf := lb.tls.Clone()
+	tlsConf.ClientSessionCache = lb.sessionCache(serverAddr)
+	return quic.DialAddrEarly(ctx, serverAddr, tlsConf, lb.quicConfig())
+}
+
+// sessionCache returns the TLS session cache of a server. Servers get a
+// cache of their own because Go keys tickets by host name, which servers
+// sharing a host have in common.
+func (lb *LoadBalancer) sessionCache(serverAddr string) tls.ClientSessionCache {
+	cache, _ := lb.sessionCaches.LoadOrStore(serverAddr, tls.NewLRUClientSessionCache(sessionCacheSize))
+	return cache.(tls.ClientSessionCache)
+}
+
+// openSession runs HELLO/ACK on a new connection. If the server rejected
+// the 0-RTT data HELLO went out in, HELLO is sent again once the
+// handshake has completed. Any other failure is returned as is.
+func (lb *LoadBalancer) openSession(conn quic.Connection) (quic.Connection, *session, error) {
+	sess, err := lb.protocolHandler(conn)
+	if err == nil {
+		if state := conn.ConnectionState(); state.TLS.DidResume {
+			log.Printf("[loadbalancer] Resumed TLS session with server %s (0-RTT: %t)", sess.serverID, state.Used0RTT)
+		}
+		return conn, sess, nil
+	}
+	early, ok := conn.(quic.EarlyConnection)
+	// quic-go only reports a rejection if 0-RTT was attempted, i.e. a
+	// ticket was cached and HELLO went out early
+	if !ok || !errors.Is(err, quic.Err0RTTRejected) {
+		return conn, nil, err
+	}
+	log.Printf("[loadbalancer] Server %s rejected 0-RTT, sending HELLO again", conn.RemoteAddr())
+	conn = early.NextConnection()
+	sess, err = lb.protocolHandler(conn)
+	return conn, sess, err
+}
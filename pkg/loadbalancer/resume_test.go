@@ -0,0 +1,106 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/server"
+	"github.com/quic-go/quic-go"
+)
+
+// serveTestServer runs s on a loopback port and returns its address.
+func serveTestServer(t *testing.T, s *server.Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+// sentHellos counts the HELLOs the trace at path records as sent.
+func sentHellos(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := pdu.NewTraceReader(f)
+	hellos := 0
+	for {
+		rec, err := tr.Next()
+		if err != nil {
+			return hellos
+		}
+		if rec.Direction == pdu.TRACE_SEND && rec.PDU != nil && rec.PDU.Mtype == pdu.TYPE_HELLO {
+			hellos++
+		}
+	}
+}
+
+func TestFirstConnectionWithoutTicket(t *testing.T) {
+	s := server.NewServer(server.ServerConfig{GenTLS: true})
+	addr := serveTestServer(t, s)
+	trace := filepath.Join(t.TempDir(), "trace.jsonl")
+	lb := NewLoadBalancer(LoadBalancerConfig{ClientID: "lb-1", ZeroRTT: true, TraceFile: trace})
+
+	// Without a ticket there is no 0-RTT to be rejected, so a HELLO the
+	// server turns down isn't sent again
+	s.Drain()
+	if _, err := lb.connect(addr); err == nil || errors.Is(err, quic.Err0RTTRejected) {
+		t.Fatalf("connecting to a draining server got %v, want the server's ERROR", err)
+	}
+	if n := sentHellos(t, trace); n != 1 {
+		t.Errorf("sent %d HELLOs, want 1", n)
+	}
+
+	addr = serveTestServer(t, server.NewServer(server.ServerConfig{GenTLS: true}))
+	sess, err := lb.connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.conn.CloseWithError(0, "")
+	if state := sess.conn.ConnectionState(); state.TLS.DidResume || state.Used0RTT {
+		t.Errorf("first connection resumed: %t, used 0-RTT: %t; want neither", state.TLS.DidResume, state.Used0RTT)
+	}
+	if n := sentHellos(t, trace); n != 2 {
+		t.Errorf("sent %d HELLOs in all, want 2", n)
+	}
+}
+
+func TestRejectedZeroRTT(t *testing.T) {
+	first := serveTestServer(t, server.NewServer(server.ServerConfig{GenTLS: true}))
+	second := serveTestServer(t, server.NewServer(server.ServerConfig{GenTLS: true}))
+	trace := filepath.Join(t.TempDir(), "trace.jsonl")
+	lb := NewLoadBalancer(LoadBalancerConfig{ClientID: "lb-1", ZeroRTT: true, TraceFile: trace})
+	sess, err := lb.connect(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the session ticket
+	time.Sleep(100 * time.Millisecond)
+	sess.conn.CloseWithError(0, "")
+
+	// Offering the first server's ticket to the second, which has a
+	// ticket key of its own, gets the 0-RTT HELLO rejected
+	lb.sessionCaches.Store(second, lb.sessionCache(first))
+	sess, err = lb.connect(second)
+	if err != nil {
+		t.Fatalf("connecting after 0-RTT was rejected: %v", err)
+	}
+	defer sess.conn.CloseWithError(0, "")
+	if sess.conn.ConnectionState().Used0RTT {
+		t.Fatal("second server accepted 0-RTT")
+	}
+	if n := sentHellos(t, trace); n != 3 {
+		t.Errorf("sent %d HELLOs in all, want 3", n)
+	}
+}
@@ -0,0 +1,318 @@
+package loadbalancer
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// maxInFlight caps the number of unanswered requests on a channel.
+	maxInFlight = 3
+	// responseTimeoutIntervals is how many check intervals a request may
+	// wait for its response before it counts as failed.
+	responseTimeoutIntervals = 2
+	// ackTimeout is how long a server has to answer HELLO.
+	ackTimeout = 10 * time.Second
+)
+
+var (
+	errTooManyInFlight = errors.New("too many requests in flight")
+	errSessionClosed   = errors.New("session closed")
+)
+
+// pendingRequest is a request waiting for its response.
+type pendingRequest struct {
+	id     uint32
+	mtype  uint8
+	sentAt time.Time
+	// reply receives the response, or is closed if the session ends first.
+	reply chan *pdu.PDU
+}
+
+// session is an established protocol session with a server. It has a
+// control stream and, from protocol version 5, a dedicated health stream.
+type session struct {
+	serverID string
+	conn     quic.Connection
+	version  int
+	// pushMode is set when the server pushes HEALTH_DATA on its own.
+	pushMode bool
+	// trace holds the connection's transport statistics.
+	trace *connTrace
+	// ack is what the server said about itself and the session in ACK.
+	ack *pdu.AckPayload
+
+	control *channel
+	// health carries health checks; it is the control channel on
+	// sessions without a health stream.
+	health *channel
+
+	mu         sync.Mutex
+	lastData   time.Time
+	heartbeats HeartbeatStats
+	// responseTimes holds the round trip times of the latest health checks.
+	responseTimes responseTimes
+	// backoffUntil holds off health checks after the server asked us to slow down
+	backoffUntil time.Time
+	// checkInterval and metrics are agreed in HELLO/ACK and changed by CONFIG_UPDATE
+	checkInterval int
+	metrics       []string
+	// reconfigured is signalled when CONFIG_UPDATE changes the session.
+	reconfigured chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// channel is one framed stream of a session. Requests may be pipelined:
+// the channel's read loop hands every response to the request it
+// answers, matched by correlation ID.
+type channel struct {
+	name   string
+	sess   *session
+	reader *pdu.Reader
+	writer *pdu.Writer
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending []*pendingRequest // in the order they were sent
+}
+
+// newSession creates a session whose control stream has completed HELLO/ACK.
+func newSession(serverID string, conn quic.Connection, version int, checkInterval int, metrics []string) *session {
+	return &session{
+		serverID:      serverID,
+		conn:          conn,
+		version:       version,
+		checkInterval: checkInterval,
+		metrics:       metrics,
+		lastData:      time.Now(),
+		reconfigured:  make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+	}
+}
+
+// newChannel creates a channel of the session on a stream's reader and writer.
+func (s *session) newChannel(name string, reader *pdu.Reader, writer *pdu.Writer) *channel {
+	return &channel{name: name, sess: s, reader: reader, writer: writer}
+}
+
+// interval returns the session's check interval.
+func (s *session) interval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Duration(s.checkInterval) * time.Second
+}
+
+// healthConfig returns the session's check interval in seconds and the
+// metrics the server reports.
+func (s *session) healthConfig() (int, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkInterval, s.metrics
+}
+
+// setHealthConfig changes the session's check interval and metrics, and
+// lets its health check loop know.
+func (s *session) setHealthConfig(checkInterval int, metrics []string) {
+	s.mu.Lock()
+	s.checkInterval = checkInterval
+	s.metrics = metrics
+	s.mu.Unlock()
+	select {
+	case s.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// touch records that the server just pushed health data.
+func (s *session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastData = time.Now()
+}
+
+// lastSeen returns when the server last pushed health data, or when the
+// session started if it hasn't yet.
+func (s *session) lastSeen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastData
+}
+
+// backOff holds off health checks for d.
+func (s *session) backOff(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backoffUntil = time.Now().Add(d)
+}
+
+// backingOff reports whether health checks are being held off.
+func (s *session) backingOff() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.backoffUntil)
+}
+
+// recordHeartbeat accounts for a heartbeat datagram.
+func (s *session) recordHeartbeat(seq uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats.record(seq, time.Now())
+}
+
+// heartbeatStats returns a snapshot of the session's heartbeat statistics.
+func (s *session) heartbeatStats() HeartbeatStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.heartbeats
+}
+
+// recordResponseTime accounts for a health check answered after d.
+func (s *session) recordResponseTime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responseTimes.record(d)
+}
+
+// responseTimeStats returns the statistics of the latest health checks'
+// response times.
+func (s *session) responseTimeStats() ResponseTimeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.responseTimes.stats()
+}
+
+// transportStats returns a snapshot of the connection's transport statistics.
+func (s *session) transportStats() TransportStats {
+	return s.trace.snapshot()
+}
+
+// close fails every pending request and marks the session as closed.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.control.failPending()
+		if s.health != s.control {
+			s.health.failPending()
+		}
+	})
+}
+
+// request sends a PDU with a fresh correlation ID and registers it as pending.
+func (c *channel) request(mtype uint8, data []byte) (*pendingRequest, error) {
+	c.mu.Lock()
+	select {
+	case <-c.sess.closed:
+		c.mu.Unlock()
+		return nil, errSessionClosed
+	default:
+	}
+	limit := maxInFlight
+	if !pdu.SupportsCorrelation(c.sess.version) {
+		// Without IDs a late reply can't be told apart, so don't pipeline
+		limit = 1
+	}
+	if len(c.pending) >= limit {
+		c.mu.Unlock()
+		return nil, errTooManyInFlight
+	}
+	c.nextID++
+	if c.nextID == 0 {
+		// 0 means "no correlation", skip it on wrap-around
+		c.nextID++
+	}
+	req := &pendingRequest{
+		id:     c.nextID,
+		mtype:  mtype,
+		sentAt: time.Now(),
+		reply:  make(chan *pdu.PDU, 1),
+	}
+	c.pending = append(c.pending, req)
+	c.mu.Unlock()
+
+	msg := pdu.NewPDU(mtype, data)
+	msg.ID = req.id
+	if err := c.writer.WritePDU(msg); err != nil {
+		c.cancel(req)
+		return nil, err
+	}
+	return req, nil
+}
+
+// cancel gives up on a request, so a response arriving later is treated
+// as stale. It returns false if the response was already delivered.
+func (c *channel) cancel(req *pendingRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, p := range c.pending {
+		if p == req {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// match removes and returns the pending request that rsp answers, or nil
+// if there is none.
+func (c *channel) match(rsp *pdu.PDU) *pendingRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !pdu.SupportsCorrelation(c.sess.version) {
+		// Older servers don't echo IDs, so replies arrive in request order
+		if len(c.pending) == 0 {
+			return nil
+		}
+		req := c.pending[0]
+		c.pending = c.pending[1:]
+		return req
+	}
+	if rsp.ID == 0 {
+		return nil
+	}
+	for i, req := range c.pending {
+		if req.id == rsp.ID {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return req
+		}
+	}
+	return nil
+}
+
+// failPending closes the reply channel of every pending request.
+func (c *channel) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, req := range c.pending {
+		close(req.reply)
+	}
+	c.pending = nil
+}
+
+// readLoop reads PDUs until the stream fails, then closes the session.
+// Responses go to their pending request; anything else is passed to
+// unmatched.
+func (c *channel) readLoop(unmatched func(rsp *pdu.PDU)) error {
+	defer c.sess.close()
+	for {
+		rsp, err := c.reader.ReadPDU()
+		if errors.Is(err, pdu.ErrFrameTooLarge) {
+			// The frame was skipped; its request will time out
+			log.Printf("[loadbalancer] Rejected PDU on %s stream from server %s: %s", c.name, c.sess.serverID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if req := c.match(rsp); req != nil {
+			req.reply <- rsp
+			continue
+		}
+		unmatched(rsp)
+	}
+}
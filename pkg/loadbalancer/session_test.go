@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// testSession returns a session speaking version whose control channel
+// writes into a buffer.
+func testSession(version int) *session {
+	sess := newSession("web-1", nil, version, 5, nil)
+	sess.control = sess.newChannel("control", pdu.NewReader(&bytes.Buffer{}), pdu.NewWriter(&bytes.Buffer{}))
+	sess.health = sess.control
+	return sess
+}
+
+func TestMatch(t *testing.T) {
+	sess := testSession(pdu.MAX_PROTOCOL_VERSION)
+	first, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   uint32
+		want *pendingRequest
+	}{
+		{"no correlation ID", 0, nil},
+		{"unknown ID", second.id + 1, nil},
+		{"out of order", second.id, second},
+		{"already answered", second.id, nil},
+		{"in order", first.id, first},
+	}
+	for _, tt := range tests {
+		if got := sess.health.match(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_RESPONSE, ID: tt.id}); got != tt.want {
+			t.Errorf("%s: match(%d) = %v, want %v", tt.name, tt.id, got, tt.want)
+		}
+	}
+
+	// A request given up on leaves its response stale
+	third, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sess.health.cancel(third) {
+		t.Fatal("cancel of a pending request failed")
+	}
+	if got := sess.health.match(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_RESPONSE, ID: third.id}); got != nil {
+		t.Errorf("response to a cancelled request matched %v", got)
+	}
+}
+
+func TestMatchWithoutCorrelation(t *testing.T) {
+	sess := testSession(pdu.PROTOCOL_VERSION_1)
+	req, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil); !errors.Is(err, errTooManyInFlight) {
+		t.Errorf("second request got %v, want %v", err, errTooManyInFlight)
+	}
+	// Older servers don't echo IDs, so the reply goes to the oldest request
+	if got := sess.health.match(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_RESPONSE}); got != req {
+		t.Errorf("match = %v, want the pending request", got)
+	}
+	if got := sess.health.match(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_RESPONSE}); got != nil {
+		t.Errorf("match without pending requests = %v", got)
+	}
+}
+
+func TestCancelAfterTimeout(t *testing.T) {
+	sess := testSession(pdu.MAX_PROTOCOL_VERSION)
+	lb := &LoadBalancer{
+		serverHealthMap:    map[string]*ServerHealth{"web-1": {ServerID: "web-1", MaxFailAttempts: 3, session: sess}},
+		serverFailureCount: make(map[string]int),
+	}
+	req, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.awaitHealthResponse(sess, req, 10*time.Millisecond)
+	if failed := lb.serverHealthMap["web-1"].FailedAttempts; failed != 1 {
+		t.Errorf("failed attempts = %d after a timeout, want 1", failed)
+	}
+	if sess.health.cancel(req) {
+		t.Error("timed out request is still pending")
+	}
+	if got := sess.health.match(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_RESPONSE, ID: req.id}); got != nil {
+		t.Errorf("late response matched %v", got)
+	}
+	// The slot is free again
+	for range maxInFlight {
+		if _, err := sess.health.request(pdu.TYPE_HEALTH_REQUEST, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFailPendingOnClose(t *testing.T) {
+	sess := testSession(pdu.MAX_PROTOCOL_VERSION)
+	sess.health = sess.newChannel("health", pdu.NewReader(&bytes.Buffer{}), pdu.NewWriter(&bytes.Buffer{}))
+	var pending []*pendingRequest
+	for _, ch := range []*channel{sess.control, sess.control, sess.health} {
+		req, err := ch.request(pdu.TYPE_HEALTH_REQUEST, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, req)
+	}
+
+	sess.close()
+	sess.close()
+	for _, req := range pending {
+		select {
+		case rsp, ok := <-req.reply:
+			if ok {
+				t.Errorf("request %d got %v after close", req.id, rsp)
+			}
+		default:
+			t.Errorf("request %d is still waiting after close", req.id)
+		}
+	}
+	if _, err := sess.control.request(pdu.TYPE_HEALTH_REQUEST, nil); !errors.Is(err, errSessionClosed) {
+		t.Errorf("request after close got %v, want %v", err, errSessionClosed)
+	}
+}
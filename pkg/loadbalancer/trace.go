@@ -0,0 +1,185 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// TransportStats summarizes what QUIC saw on the connection to a server.
+type TransportStats struct {
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+	LatestRTT   time.Duration
+	// CongestionWindow and BytesInFlight are in bytes.
+	CongestionWindow int64
+	BytesInFlight    int64
+	CongestionState  string
+	PacketsSent      uint64
+	PacketsLost      uint64
+	// CloseReason says why the connection ended, or is empty while it is open.
+	CloseReason string
+}
+
+// LossRate returns the fraction of sent packets that were declared lost.
+func (s TransportStats) LossRate() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+// serverAddrKey is the dial context key holding the address being dialed.
+type serverAddrKey struct{}
+
+// connTrace follows one connection to a server. It keeps the connection's
+// transport statistics and, if enabled, the path of its qlog file.
+type connTrace struct {
+	odcid quic.ConnectionID
+
+	mu       sync.Mutex
+	stats    TransportStats
+	qlogPath string
+}
+
+// newConnectionTracer is the quic.Config Tracer for connections to
+// servers. The trace is kept until takeTrace claims it for a session.
+func (lb *LoadBalancer) newConnectionTracer(ctx context.Context, p logging.Perspective, odcid quic.ConnectionID) *logging.ConnectionTracer {
+	id, _ := ctx.Value(quic.ConnectionTracingKey).(quic.ConnectionTracingID)
+	trace := &connTrace{odcid: odcid}
+	tracers := []*logging.ConnectionTracer{trace.tracer(func() { lb.traces.Delete(id) })}
+	if lb.cfg.QlogDir != "" {
+		serverAddr, _ := ctx.Value(serverAddrKey{}).(string)
+		path := util.QlogPath(lb.cfg.QlogDir, serverAddr, p, odcid)
+		qlogTracer, err := util.NewQlogTracer(path, p, odcid)
+		if err != nil {
+			log.Printf("[loadbalancer] Not writing qlog for %s: %s", serverAddr, err)
+		} else {
+			trace.qlogPath = path
+			tracers = append(tracers, qlogTracer)
+		}
+	}
+	lb.traces.Store(id, trace)
+	return logging.NewMultiplexedConnectionTracer(tracers...)
+}
+
+// takeTrace returns the trace of conn, or an empty one if it has none.
+func (lb *LoadBalancer) takeTrace(conn quic.Connection) *connTrace {
+	id := conn.Context().Value(quic.ConnectionTracingKey)
+	if trace, ok := lb.traces.LoadAndDelete(id); ok {
+		return trace.(*connTrace)
+	}
+	return &connTrace{}
+}
+
+// tracer returns a tracer that keeps the trace's statistics up to date.
+// closed is called once the connection is gone.
+func (t *connTrace) tracer(closed func()) *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			t.update(func(s *TransportStats) { s.PacketsSent++ })
+		},
+		SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+			t.update(func(s *TransportStats) { s.PacketsSent++ })
+		},
+		LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+			t.update(func(s *TransportStats) { s.PacketsLost++ })
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+			t.update(func(s *TransportStats) {
+				s.SmoothedRTT = rttStats.SmoothedRTT()
+				s.MinRTT = rttStats.MinRTT()
+				s.LatestRTT = rttStats.LatestRTT()
+				s.CongestionWindow = int64(cwnd)
+				s.BytesInFlight = int64(bytesInFlight)
+			})
+		},
+		UpdatedCongestionState: func(state logging.CongestionState) {
+			t.update(func(s *TransportStats) { s.CongestionState = congestionStateName(state) })
+		},
+		ClosedConnection: func(err error) {
+			t.update(func(s *TransportStats) { s.CloseReason = closeReason(err) })
+		},
+		Close: closed,
+	}
+}
+
+func (t *connTrace) update(f func(s *TransportStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.stats)
+}
+
+// snapshot returns a copy of the connection's statistics.
+func (t *connTrace) snapshot() TransportStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// nameQlog renames the qlog file after the server ID, which isn't known
+// until the ACK arrives.
+func (t *connTrace) nameQlog(dir string, serverID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.qlogPath == "" {
+		return
+	}
+	path := util.QlogPath(dir, serverID, logging.PerspectiveClient, t.odcid)
+	if err := os.Rename(t.qlogPath, path); err != nil {
+		log.Printf("[loadbalancer] Error renaming qlog file: %s", err)
+		return
+	}
+	t.qlogPath = path
+}
+
+// closeReason describes why a connection ended, telling transport
+// timeouts apart from the protocol closing the session.
+func closeReason(err error) string {
+	var (
+		idleErr      *quic.IdleTimeoutError
+		handshakeErr *quic.HandshakeTimeoutError
+		appErr       *quic.ApplicationError
+		resetErr     *quic.StatelessResetError
+	)
+	switch {
+	case errors.As(err, &idleErr):
+		return "idle timeout"
+	case errors.As(err, &handshakeErr):
+		return "handshake timeout"
+	case errors.As(err, &resetErr):
+		return "stateless reset"
+	case errors.As(err, &appErr):
+		side := "server"
+		if !appErr.Remote {
+			side = "load balancer"
+		}
+		return fmt.Sprintf("closed by %s with %d (%s)", side, appErr.ErrorCode, pdu.ErrorName(int(appErr.ErrorCode)))
+	default:
+		return err.Error()
+	}
+}
+
+func congestionStateName(state logging.CongestionState) string {
+	switch state {
+	case logging.CongestionStateSlowStart:
+		return "slow start"
+	case logging.CongestionStateCongestionAvoidance:
+		return "congestion avoidance"
+	case logging.CongestionStateRecovery:
+		return "recovery"
+	case logging.CongestionStateApplicationLimited:
+		return "application limited"
+	default:
+		return fmt.Sprintf("CongestionState(%d)", state)
+	}
+}
@@ -0,0 +1,152 @@
+package pdu
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	CODEC_JSON   = "json"
+	CODEC_BINARY = "binary"
+
+	// BINARY_HEADER_SIZE is the size of the binary codec header:
+	// Mtype (1) + ID (4) + Length (4).
+	BINARY_HEADER_SIZE = 9
+	// BINARY_HEADER_SIZE_V3 is the header size used by protocol version 3,
+	// which has no ID field.
+	BINARY_HEADER_SIZE_V3 = 5
+	// BINARY_HEADER_SIZE_V2 is the header size used by protocol version 2,
+	// whose Length field is only 2 bytes.
+	BINARY_HEADER_SIZE_V2 = 3
+
+	// jsonOverhead bounds the size of the JSON object around the base64 payload.
+	jsonOverhead = 128
+)
+
+// Codec converts PDUs to and from their wire representation.
+type Codec interface {
+	Name() string
+	Encode(pdu *PDU) ([]byte, error)
+	Decode(raw []byte) (*PDU, error)
+	// MaxEncodedSize returns the largest encoding of a payload of the given size.
+	MaxEncodedSize(payload int) int
+}
+
+var (
+	// JsonCodec encodes the whole PDU as JSON. It is the default until a
+	// session negotiates something else and is handy for debugging.
+	JsonCodec Codec = jsonCodec{}
+	// BinaryCodec encodes a fixed header followed by the raw payload.
+	BinaryCodec Codec = binaryCodec{lengthSize: 4, hasID: true}
+	// BinaryCodecV3 is the binary codec of protocol version 3, without the ID field.
+	BinaryCodecV3 Codec = binaryCodec{lengthSize: 4}
+	// BinaryCodecV2 is the binary codec with the 2-byte Length field of protocol version 2.
+	BinaryCodecV2 Codec = binaryCodec{lengthSize: 2}
+)
+
+// CodecByName returns the codec with the given name as spoken by the
+// given protocol version.
+func CodecByName(name string, version int) (Codec, bool) {
+	switch name {
+	case CODEC_JSON:
+		return JsonCodec, true
+	case CODEC_BINARY:
+		switch {
+		case SupportsCorrelation(version):
+			return BinaryCodec, true
+		case SupportsLargePdus(version):
+			return BinaryCodecV3, true
+		default:
+			return BinaryCodecV2, true
+		}
+	default:
+		return nil, false
+	}
+}
+
+// NegotiateCodec picks the first codec in offered that is supported,
+// falling back to JSON when nothing matches.
+func NegotiateCodec(offered []string, version int) Codec {
+	for _, name := range offered {
+		if codec, ok := CodecByName(name, version); ok {
+			return codec
+		}
+	}
+	return JsonCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CODEC_JSON }
+
+func (jsonCodec) Encode(pdu *PDU) ([]byte, error) { return PduToBytes(pdu) }
+
+func (jsonCodec) Decode(raw []byte) (*PDU, error) { return PduFromBytes(raw) }
+
+func (jsonCodec) MaxEncodedSize(payload int) int {
+	return base64.StdEncoding.EncodedLen(payload) + jsonOverhead
+}
+
+type binaryCodec struct {
+	lengthSize int
+	hasID      bool
+}
+
+func (binaryCodec) Name() string { return CODEC_BINARY }
+
+func (c binaryCodec) headerSize() int {
+	size := 1 + c.lengthSize
+	if c.hasID {
+		size += 4
+	}
+	return size
+}
+
+func (c binaryCodec) Encode(pdu *PDU) ([]byte, error) {
+	if c.lengthSize == 2 && len(pdu.Data) > 0xFFFF {
+		return nil, fmt.Errorf("pdu: payload of %d bytes does not fit the version 2 length field", len(pdu.Data))
+	}
+	raw := make([]byte, c.headerSize()+len(pdu.Data))
+	raw[0] = pdu.Mtype
+	off := 1
+	if c.hasID {
+		binary.BigEndian.PutUint32(raw[off:], pdu.ID)
+		off += 4
+	}
+	if c.lengthSize == 2 {
+		binary.BigEndian.PutUint16(raw[off:], uint16(len(pdu.Data)))
+	} else {
+		binary.BigEndian.PutUint32(raw[off:], uint32(len(pdu.Data)))
+	}
+	copy(raw[c.headerSize():], pdu.Data)
+	return raw, nil
+}
+
+func (c binaryCodec) Decode(raw []byte) (*PDU, error) {
+	headerSize := c.headerSize()
+	if len(raw) < headerSize {
+		return nil, fmt.Errorf("pdu: binary PDU too short (%d bytes)", len(raw))
+	}
+	pdu := &PDU{Mtype: raw[0]}
+	off := 1
+	if c.hasID {
+		pdu.ID = binary.BigEndian.Uint32(raw[off:])
+		off += 4
+	}
+	if c.lengthSize == 2 {
+		pdu.Length = uint32(binary.BigEndian.Uint16(raw[off:]))
+	} else {
+		pdu.Length = binary.BigEndian.Uint32(raw[off:])
+	}
+	if int64(pdu.Length) != int64(len(raw)-headerSize) {
+		return nil, fmt.Errorf("pdu: binary PDU length mismatch: header %d, payload %d", pdu.Length, len(raw)-headerSize)
+	}
+	pdu.Data = make([]byte, pdu.Length)
+	copy(pdu.Data, raw[headerSize:])
+	return pdu, nil
+}
+
+func (c binaryCodec) MaxEncodedSize(payload int) int {
+	return c.headerSize() + payload
+}
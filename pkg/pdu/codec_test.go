@@ -0,0 +1,134 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	msgs := []*PDU{
+		{Mtype: TYPE_HEALTH_REQUEST},
+		{Mtype: TYPE_HEALTH_RESPONSE, Data: []byte(`{"metrics":{"cpu":12.5}}`)},
+		{Mtype: TYPE_ERROR, Data: bytes.Repeat([]byte{0xff}, MAX_PDU_SIZE)},
+	}
+	for _, msg := range msgs {
+		msg.Length = uint32(len(msg.Data))
+	}
+	for _, codec := range []Codec{JsonCodec, BinaryCodec} {
+		for _, msg := range msgs {
+			raw, err := codec.Encode(msg)
+			if err != nil {
+				t.Fatalf("%s: Encode(%+v): %v", codec.Name(), msg, err)
+			}
+			if len(raw) > codec.MaxEncodedSize(len(msg.Data)) {
+				t.Fatalf("%s: %d byte payload encoded to %d bytes, more than MaxEncodedSize %d",
+					codec.Name(), len(msg.Data), len(raw), codec.MaxEncodedSize(len(msg.Data)))
+			}
+			got, err := codec.Decode(raw)
+			if err != nil {
+				t.Fatalf("%s: Decode(%x): %v", codec.Name(), raw, err)
+			}
+			if got.Mtype != msg.Mtype || !bytes.Equal(got.Data, msg.Data) || got.Length != msg.Length {
+				t.Fatalf("%s: round trip of %+v gave %+v", codec.Name(), msg, got)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecIsCompact(t *testing.T) {
+	msg := &PDU{Mtype: TYPE_HEALTH_RESPONSE, Data: []byte(`{"metrics":{"cpu":12.5}}`)}
+	binary, _ := BinaryCodec.Encode(msg)
+	json, _ := JsonCodec.Encode(msg)
+	if len(binary) != BINARY_HEADER_SIZE+len(msg.Data) {
+		t.Fatalf("binary encoding is %d bytes, want header plus payload (%d)", len(binary), BINARY_HEADER_SIZE+len(msg.Data))
+	}
+	if len(binary) >= len(json) {
+		t.Fatalf("binary encoding (%d bytes) isn't smaller than JSON (%d bytes)", len(binary), len(json))
+	}
+}
+
+func TestBinaryCodecRejectsBadLength(t *testing.T) {
+	raw, _ := BinaryCodec.Encode(&PDU{Mtype: TYPE_HEALTH_RESPONSE, Data: []byte("abc")})
+	for _, test := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"short header", raw[:BINARY_HEADER_SIZE-1]},
+		{"truncated payload", raw[:len(raw)-1]},
+		{"trailing bytes", append(raw, 0)},
+	} {
+		if pdu, err := BinaryCodec.Decode(test.raw); err == nil {
+			t.Errorf("%s: Decode gave %+v, want an error", test.name, pdu)
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		offered []string
+		want    string
+	}{
+		{"binary preferred", []string{CODEC_BINARY, CODEC_JSON}, CODEC_BINARY},
+		{"json preferred", []string{CODEC_JSON, CODEC_BINARY}, CODEC_JSON},
+		{"unknown codecs skipped", []string{"cbor", CODEC_BINARY}, CODEC_BINARY},
+		{"nothing known", []string{"cbor"}, CODEC_JSON},
+		{"nothing offered", nil, CODEC_JSON},
+	} {
+		if got := NegotiateCodec(test.offered, MAX_PROTOCOL_VERSION); got.Name() != test.want {
+			t.Errorf("%s: NegotiateCodec(%v) = %s, want %s", test.name, test.offered, got.Name(), test.want)
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version int
+		want    Codec
+	}{
+		{CODEC_JSON, PROTOCOL_VERSION_2, JsonCodec},
+		{CODEC_JSON, MAX_PROTOCOL_VERSION, JsonCodec},
+		{CODEC_BINARY, PROTOCOL_VERSION_2, BinaryCodecV2},
+		{CODEC_BINARY, PROTOCOL_VERSION_3, BinaryCodecV3},
+		{CODEC_BINARY, PROTOCOL_VERSION_4, BinaryCodec},
+		{CODEC_BINARY, MAX_PROTOCOL_VERSION, BinaryCodec},
+	} {
+		got, ok := CodecByName(test.name, test.version)
+		if !ok || got != test.want {
+			t.Errorf("CodecByName(%s, %d) = %v, %t; want %v", test.name, test.version, got, ok, test.want)
+		}
+	}
+	if codec, ok := CodecByName("cbor", MAX_PROTOCOL_VERSION); ok {
+		t.Errorf("CodecByName(cbor) = %v, want no codec", codec)
+	}
+}
+
+func TestBinaryLengthField(t *testing.T) {
+	large := &PDU{Mtype: TYPE_HEALTH_RESPONSE, Data: bytes.Repeat([]byte("x"), 0x10000)}
+	if _, err := BinaryCodecV2.Encode(large); err == nil {
+		t.Fatal("version 2 codec encoded a payload too large for its 16-bit length")
+	}
+	for _, codec := range []Codec{BinaryCodecV3, BinaryCodec} {
+		raw, err := codec.Encode(large)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := codec.Decode(raw)
+		if err != nil || !bytes.Equal(got.Data, large.Data) {
+			t.Fatalf("round trip of a %d byte payload gave %d bytes, %v", len(large.Data), len(got.Data), err)
+		}
+	}
+	for _, test := range []struct {
+		codec      Codec
+		headerSize int
+	}{
+		{BinaryCodecV2, BINARY_HEADER_SIZE_V2},
+		{BinaryCodecV3, BINARY_HEADER_SIZE_V3},
+		{BinaryCodec, BINARY_HEADER_SIZE},
+	} {
+		if raw, _ := test.codec.Encode(&PDU{Mtype: TYPE_HEALTH_REQUEST}); len(raw) != test.headerSize {
+			t.Errorf("%+v: empty PDU encoded to %d bytes, want a %d byte header", test.codec, len(raw), test.headerSize)
+		}
+	}
+}
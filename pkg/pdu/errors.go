@@ -0,0 +1,90 @@
+package pdu
+
+import "fmt"
+
+// Error codes carried in the error_code field of a TYPE_ERROR payload.
+const (
+	ERROR_MALFORMED_PAYLOAD  = 400
+	ERROR_AUTH_FAILED        = 401
+	ERROR_UNKNOWN_TYPE       = 404
+	ERROR_UNEXPECTED_MESSAGE = 409
+	ERROR_PAYLOAD_TOO_LARGE  = 413
+	// ERROR_DUPLICATE_SERVER_ID is only used as a QUIC application error
+	// code, when a load balancer closes a connection to a server that
+	// claims the ID of another server it has a session with.
+	ERROR_DUPLICATE_SERVER_ID = 422
+	ERROR_METRIC_UNAVAILABLE  = 424
+	ERROR_RATE_LIMITED        = 429
+	// ERROR_TOO_MANY_SESSIONS answers the HELLO of a load balancer when the
+	// server already has as many sessions as it allows.
+	ERROR_TOO_MANY_SESSIONS   = 430
+	ERROR_INTERNAL            = 500
+	ERROR_DRAINING            = 503
+	ERROR_UNSUPPORTED_VERSION = 505
+)
+
+// ErrorClass tells the receiver of an ERROR whether trying again can help.
+type ErrorClass int
+
+const (
+	// ERROR_CLASS_FATAL errors don't go away by themselves: the session
+	// can't be used until one of the peers is fixed or reconfigured.
+	ERROR_CLASS_FATAL ErrorClass = iota
+	// ERROR_CLASS_RETRYABLE errors are transient, so the same request may
+	// succeed later.
+	ERROR_CLASS_RETRYABLE
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ERROR_CLASS_FATAL:
+		return "fatal"
+	case ERROR_CLASS_RETRYABLE:
+		return "retryable"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+type errorInfo struct {
+	name  string
+	class ErrorClass
+}
+
+// errorRegistry describes every error code this package defines.
+var errorRegistry = map[int]errorInfo{
+	ERROR_MALFORMED_PAYLOAD:   {"malformed payload", ERROR_CLASS_FATAL},
+	ERROR_AUTH_FAILED:         {"authentication failed", ERROR_CLASS_FATAL},
+	ERROR_UNKNOWN_TYPE:        {"unknown message type", ERROR_CLASS_FATAL},
+	ERROR_UNEXPECTED_MESSAGE:  {"unexpected message", ERROR_CLASS_FATAL},
+	ERROR_PAYLOAD_TOO_LARGE:   {"payload too large", ERROR_CLASS_FATAL},
+	ERROR_DUPLICATE_SERVER_ID: {"duplicate server ID", ERROR_CLASS_FATAL},
+	ERROR_METRIC_UNAVAILABLE:  {"metric unavailable", ERROR_CLASS_RETRYABLE},
+	ERROR_RATE_LIMITED:        {"rate limited", ERROR_CLASS_RETRYABLE},
+	ERROR_TOO_MANY_SESSIONS:   {"too many sessions", ERROR_CLASS_RETRYABLE},
+	ERROR_INTERNAL:            {"internal error", ERROR_CLASS_RETRYABLE},
+	ERROR_DRAINING:            {"draining", ERROR_CLASS_RETRYABLE},
+	ERROR_UNSUPPORTED_VERSION: {"unsupported version", ERROR_CLASS_FATAL},
+}
+
+// ErrorName returns a short description of an error code.
+func ErrorName(code int) string {
+	if info, ok := errorRegistry[code]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("error %d", code)
+}
+
+// ClassifyError returns the class of an error code. Codes that aren't
+// registered are fatal, since there is no telling whether a retry helps.
+func ClassifyError(code int) ErrorClass {
+	if info, ok := errorRegistry[code]; ok {
+		return info.class
+	}
+	return ERROR_CLASS_FATAL
+}
+
+// IsRetryable reports whether a request that failed with code may succeed later.
+func IsRetryable(code int) bool {
+	return ClassifyError(code) == ERROR_CLASS_RETRYABLE
+}
@@ -0,0 +1,105 @@
+package pdu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func FuzzPduFromBytes(f *testing.F) {
+	for _, seed := range []string{
+		`{"mtype":2,"length":0,"data":null}`,
+		`{"mtype":6,"id":7,"length":3,"data":"YWJj"}`,
+		`{"mtype":300}`,
+		`{"data":"not base64"}`,
+		`{}`,
+		`[]`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		pdu, err := PduFromBytes(raw)
+		if err != nil {
+			return
+		}
+		encoded, err := PduToBytes(pdu)
+		if err != nil {
+			t.Fatalf("PduToBytes(%+v): %v", pdu, err)
+		}
+		again, err := PduFromBytes(encoded)
+		if err != nil {
+			t.Fatalf("PduFromBytes(%q) of a re-encoded PDU: %v", encoded, err)
+		}
+		assertSamePDU(t, again, pdu)
+	})
+}
+
+// frame prefixes raw with its length, as Writer does.
+func frame(raw []byte) []byte {
+	out := make([]byte, FRAME_HEADER_SIZE+len(raw))
+	binary.BigEndian.PutUint32(out, uint32(len(raw)))
+	copy(out[FRAME_HEADER_SIZE:], raw)
+	return out
+}
+
+func FuzzReader(f *testing.F) {
+	hello, _ := NewPayloadPDU(TYPE_HELLO, &HelloPayload{AuthToken: "token", MinVersion: 1, MaxVersion: 5})
+	hello.ID = 1
+	for _, codec := range []Codec{JsonCodec, BinaryCodec, BinaryCodecV3, BinaryCodecV2} {
+		raw, _ := codec.Encode(hello)
+		f.Add(frame(raw))
+		f.Add(frame(raw)[:len(raw)/2])
+	}
+	f.Add(frame(bytes.Repeat([]byte{0xff}, 2*MAX_PDU_SIZE)))
+	f.Add(frame([]byte{TYPE_HEALTH_REQUEST, 0, 0, 0, 1, 0, 0, 0, 9}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, codec := range []Codec{JsonCodec, BinaryCodec, BinaryCodecV3, BinaryCodecV2} {
+			reader := NewReader(bytes.NewReader(input))
+			reader.SetCodec(codec)
+			for {
+				pdu, err := reader.ReadPDU()
+				if errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrMalformedFrame) {
+					// The frame was consumed, so the next one can still be read
+					continue
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%s: unexpected error %v", codec.Name(), err)
+				}
+				if len(pdu.Data) > MAX_PDU_SIZE {
+					t.Fatalf("%s: read a %d byte payload past the %d byte limit", codec.Name(), len(pdu.Data), MAX_PDU_SIZE)
+				}
+
+				// Whatever was accepted must survive a round trip
+				var buf bytes.Buffer
+				writer := NewWriter(&buf)
+				writer.SetCodec(codec)
+				if err := writer.WritePDU(pdu); err != nil {
+					t.Fatalf("%s: WritePDU(%+v): %v", codec.Name(), pdu, err)
+				}
+				echo := NewReader(&buf)
+				echo.SetCodec(codec)
+				again, err := echo.ReadPDU()
+				if err != nil {
+					t.Fatalf("%s: reading back %+v: %v", codec.Name(), pdu, err)
+				}
+				assertSamePDU(t, again, pdu)
+			}
+		}
+	})
+}
+
+func assertSamePDU(t *testing.T, got, want *PDU) {
+	t.Helper()
+	if got.Mtype != want.Mtype || got.ID != want.ID || got.Length != want.Length || !bytes.Equal(got.Data, want.Data) {
+		t.Fatalf("round trip changed the PDU: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+package pdu
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// HEARTBEAT_TYPE is the first byte of every heartbeat datagram.
+	HEARTBEAT_TYPE = 0x01
+	// HEARTBEAT_SIZE is the size of a heartbeat datagram: type (1) + Seq (4).
+	HEARTBEAT_SIZE = 5
+	// MIN_HEARTBEAT_INTERVAL_MS is the shortest heartbeat interval a server will agree to.
+	MIN_HEARTBEAT_INTERVAL_MS = 100
+)
+
+// Heartbeat is a tiny liveness signal sent as an unreliable QUIC datagram
+// (RFC 9221). Seq increases by one per heartbeat, so gaps reveal loss.
+type Heartbeat struct {
+	Seq uint32
+}
+
+// ToBytes encodes the heartbeat as a datagram payload.
+func (h Heartbeat) ToBytes() []byte {
+	raw := make([]byte, HEARTBEAT_SIZE)
+	raw[0] = HEARTBEAT_TYPE
+	binary.BigEndian.PutUint32(raw[1:], h.Seq)
+	return raw
+}
+
+// HeartbeatFromBytes decodes a heartbeat datagram.
+func HeartbeatFromBytes(raw []byte) (Heartbeat, error) {
+	if len(raw) != HEARTBEAT_SIZE || raw[0] != HEARTBEAT_TYPE {
+		return Heartbeat{}, fmt.Errorf("pdu: not a heartbeat datagram (%d bytes)", len(raw))
+	}
+	return Heartbeat{Seq: binary.BigEndian.Uint32(raw[1:])}, nil
+}
@@ -0,0 +1,363 @@
+package pdu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrMalformedPayload is returned when a payload can't be decoded or fails validation.
+var ErrMalformedPayload = errors.New("pdu: malformed payload")
+
+// Payload is implemented by every typed message payload.
+type Payload interface {
+	Validate() error
+}
+
+// EncodePayload validates a payload and encodes it as JSON.
+func EncodePayload(p Payload) ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(p)
+}
+
+// DecodePayload decodes JSON data into p and validates it. An empty
+// payload decodes to the zero value, which still has to validate.
+func DecodePayload(data []byte, p Payload) error {
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, p); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+		}
+	}
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+	}
+	return nil
+}
+
+// NewPayloadPDU encodes the payload and wraps it in a PDU of the given type.
+func NewPayloadPDU(mtype uint8, p Payload) (*PDU, error) {
+	data, err := EncodePayload(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewPDU(mtype, data), nil
+}
+
+// NewPayloadFor returns an empty payload of the type carried by PDUs of
+// type mtype, or nil if they carry none.
+func NewPayloadFor(mtype uint8) Payload {
+	switch mtype {
+	case TYPE_HELLO:
+		return &HelloPayload{}
+	case TYPE_ACK:
+		return &AckPayload{}
+	case TYPE_HEALTH_RESPONSE, TYPE_HEALTH_DATA:
+		return &HealthResponsePayload{}
+	case TYPE_CONFIG_UPDATE:
+		return &ConfigUpdatePayload{}
+	case TYPE_CONFIG_ACK:
+		return &ConfigAckPayload{}
+	case TYPE_ERROR:
+		return &ErrorPayload{}
+	case TYPE_TERMINATE, TYPE_TERMINATE_ACK:
+		return &TerminatePayload{}
+	default:
+		return nil
+	}
+}
+
+// HelloPayload is sent by the load balancer to open a session.
+type HelloPayload struct {
+	SupportedMetrics []string `json:"supported_metrics"`
+	CheckInterval    int      `json:"check_interval"`
+	AuthToken        string   `json:"auth_token"`
+	// Version is the single version sent by load balancers that predate negotiation.
+	Version    float64  `json:"version,omitempty"`
+	MinVersion int      `json:"min_version,omitempty"`
+	MaxVersion int      `json:"max_version,omitempty"`
+	Codecs     []string `json:"codecs,omitempty"`
+	// MaxPduSize is the largest payload the load balancer accepts.
+	MaxPduSize int `json:"max_pdu_size,omitempty"`
+	// PushMode asks the server to send HEALTH_DATA every check_interval
+	// instead of waiting for HEALTH_REQUESTs.
+	PushMode bool `json:"push_mode,omitempty"`
+	// PushThresholds maps metric names to values that trigger an
+	// immediate HEALTH_DATA when crossed in either direction.
+	PushThresholds map[string]float64 `json:"push_thresholds,omitempty"`
+	// HeartbeatInterval asks for heartbeat datagrams every this many milliseconds.
+	HeartbeatInterval int `json:"heartbeat_interval_ms,omitempty"`
+	// AggregateWindows asks for aggregates of the metrics over these
+	// windows (WINDOW_*) with every health report.
+	AggregateWindows []string `json:"aggregate_windows,omitempty"`
+}
+
+func (p *HelloPayload) Validate() error {
+	if p.AuthToken == "" {
+		return errors.New("auth_token is required")
+	}
+	if p.CheckInterval < 0 {
+		return fmt.Errorf("check_interval must not be negative, got %d", p.CheckInterval)
+	}
+	if p.MaxVersion == 0 && p.Version == 0 {
+		return errors.New("either version or min_version/max_version is required")
+	}
+	if p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return fmt.Errorf("min_version %d is greater than max_version %d", p.MinVersion, p.MaxVersion)
+	}
+	if p.MaxPduSize < 0 {
+		return fmt.Errorf("max_pdu_size must not be negative, got %d", p.MaxPduSize)
+	}
+	if p.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat_interval_ms must not be negative, got %d", p.HeartbeatInterval)
+	}
+	return nil
+}
+
+// AckPayload is the server's answer to HELLO.
+type AckPayload struct {
+	ConfirmedMetrics []string `json:"confirmed_metrics"`
+	CheckInterval    int      `json:"check_interval"`
+	ServerID         string   `json:"server_id"`
+	Version          int      `json:"version,omitempty"`
+	Codec            string   `json:"codec,omitempty"`
+	// MaxPduSize is the payload limit agreed for the session.
+	MaxPduSize int `json:"max_pdu_size,omitempty"`
+	// PushMode confirms that the server will push HEALTH_DATA.
+	PushMode bool `json:"push_mode,omitempty"`
+	// HeartbeatInterval is the agreed heartbeat interval in milliseconds,
+	// or 0 if the server won't send heartbeats.
+	HeartbeatInterval int `json:"heartbeat_interval_ms,omitempty"`
+	// Hostname is the host the server runs on.
+	Hostname string `json:"hostname,omitempty"`
+	// InstanceID is new every time the server starts, so a load balancer
+	// can tell a restarted server from one it lost touch with.
+	InstanceID string `json:"instance_id,omitempty"`
+	// StartedAt is when the server started, in RFC 3339 format.
+	StartedAt string `json:"started_at,omitempty"`
+	// Weight is the server's capacity relative to other servers. 0 means
+	// the server doesn't say, which load balancers treat as 1.
+	Weight int `json:"weight,omitempty"`
+	// MaxConnections is how many client connections the server takes at
+	// once, or 0 for no limit.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// Labels describe where and what the server is, e.g. zone, rack,
+	// version or role.
+	Labels map[string]string `json:"labels,omitempty"`
+	// AggregateWindows are the requested windows the server will report
+	// aggregates over.
+	AggregateWindows []string `json:"aggregate_windows,omitempty"`
+}
+
+func (p *AckPayload) Validate() error {
+	if p.ServerID == "" {
+		return errors.New("server_id is required")
+	}
+	if p.MaxPduSize < 0 {
+		return fmt.Errorf("max_pdu_size must not be negative, got %d", p.MaxPduSize)
+	}
+	if p.CheckInterval < 0 {
+		return fmt.Errorf("check_interval must not be negative, got %d", p.CheckInterval)
+	}
+	if p.Weight < 0 {
+		return fmt.Errorf("weight must not be negative, got %d", p.Weight)
+	}
+	if p.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative, got %d", p.MaxConnections)
+	}
+	if _, ok := p.Labels[""]; ok {
+		return errors.New("labels must not have an empty key")
+	}
+	return nil
+}
+
+const (
+	PUSH_TRIGGER_INTERVAL  = "interval"
+	PUSH_TRIGGER_THRESHOLD = "threshold"
+)
+
+// Statuses a server reports in HEALTH_RESPONSE and HEALTH_DATA.
+const (
+	// STATUS_HEALTHY means the server should get traffic.
+	STATUS_HEALTHY = "healthy"
+	// STATUS_DEGRADED means the server can take traffic but is under
+	// strain, so healthy servers should be preferred.
+	STATUS_DEGRADED = "degraded"
+	// STATUS_NOT_READY means the server is alive but shouldn't get
+	// traffic yet, e.g. while it warms up after a deploy.
+	STATUS_NOT_READY = "not-ready"
+	// STATUS_DRAINING means the server is alive but leaving rotation.
+	STATUS_DRAINING = "draining"
+	// STATUS_DOWN means the application the server fronts is dead.
+	STATUS_DOWN = "down"
+)
+
+// ValidStatus reports whether status is one of the STATUS_* values.
+func ValidStatus(status string) bool {
+	switch status {
+	case STATUS_HEALTHY, STATUS_DEGRADED, STATUS_NOT_READY, STATUS_DRAINING, STATUS_DOWN:
+		return true
+	}
+	return false
+}
+
+// Windows that health reports can carry metric aggregates over.
+const (
+	WINDOW_10S = "10s"
+	WINDOW_1M  = "1m"
+	WINDOW_5M  = "5m"
+)
+
+// WindowDuration returns the length of the WINDOW_* value window, or
+// false if window isn't one.
+func WindowDuration(window string) (time.Duration, bool) {
+	switch window {
+	case WINDOW_10S:
+		return 10 * time.Second, true
+	case WINDOW_1M:
+		return time.Minute, true
+	case WINDOW_5M:
+		return 5 * time.Minute, true
+	}
+	return 0, false
+}
+
+// HealthResponsePayload carries a snapshot of the server's health
+// metrics. It is used for both HEALTH_RESPONSE and HEALTH_DATA.
+type HealthResponsePayload struct {
+	Timestamp string             `json:"timestamp"`
+	Metrics   map[string]float64 `json:"metrics"`
+	// Trigger says why a HEALTH_DATA was pushed (PUSH_TRIGGER_*).
+	Trigger string `json:"trigger,omitempty"`
+	// Probes are the results of the server's application probes.
+	Probes []ProbeResult `json:"probes,omitempty"`
+	// Status is the server's own view of whether it should get traffic
+	// (STATUS_*). Servers that predate it leave it empty, meaning healthy.
+	Status string `json:"status,omitempty"`
+	// StatusReason says why the server isn't healthy.
+	StatusReason string `json:"status_reason,omitempty"`
+	// Aggregates maps each window the load balancer asked for to the
+	// aggregates of the reported metrics over that window.
+	Aggregates map[string]map[string]MetricAggregate `json:"aggregates,omitempty"`
+}
+
+// MetricAggregate summarizes the samples of a metric taken within a window.
+type MetricAggregate struct {
+	Samples int     `json:"samples"`
+	Avg     float64 `json:"avg"`
+	Max     float64 `json:"max"`
+	P95     float64 `json:"p95"`
+}
+
+// ProbeResult is the outcome of one application probe run by the server.
+type ProbeResult struct {
+	Name      string  `json:"name"`
+	Passed    bool    `json:"passed"`
+	LatencyMs float64 `json:"latency_ms"`
+	// Output is the start of what the probe returned or why it failed.
+	Output string `json:"output,omitempty"`
+}
+
+// FailedProbes returns the names of the probes that didn't pass.
+func (p *HealthResponsePayload) FailedProbes() []string {
+	var failed []string
+	for _, probe := range p.Probes {
+		if !probe.Passed {
+			failed = append(failed, probe.Name)
+		}
+	}
+	return failed
+}
+
+func (p *HealthResponsePayload) Validate() error {
+	if _, err := time.Parse(time.RFC3339, p.Timestamp); err != nil {
+		return fmt.Errorf("invalid timestamp %q", p.Timestamp)
+	}
+	if p.Status != "" && !ValidStatus(p.Status) {
+		return fmt.Errorf("unknown status %q", p.Status)
+	}
+	for window := range p.Aggregates {
+		if _, ok := WindowDuration(window); !ok {
+			return fmt.Errorf("unknown aggregate window %q", window)
+		}
+	}
+	return nil
+}
+
+// ConfigUpdatePayload asks the server to change its health check configuration.
+type ConfigUpdatePayload struct {
+	NewMetrics       []string `json:"new_metrics,omitempty"`
+	NewCheckInterval int      `json:"new_check_interval,omitempty"`
+}
+
+func (p *ConfigUpdatePayload) Validate() error {
+	if p.NewCheckInterval < 0 {
+		return fmt.Errorf("new_check_interval must not be negative, got %d", p.NewCheckInterval)
+	}
+	if len(p.NewMetrics) == 0 && p.NewCheckInterval == 0 {
+		return errors.New("nothing to update")
+	}
+	return nil
+}
+
+const (
+	// CONFIG_STATUS_SUCCESS means everything in the update was applied.
+	CONFIG_STATUS_SUCCESS = "success"
+	// CONFIG_STATUS_PARTIAL means some of the requested metrics were
+	// unknown and left out; the rest of the update was applied.
+	CONFIG_STATUS_PARTIAL = "partial"
+	// CONFIG_STATUS_REJECTED means nothing was changed.
+	CONFIG_STATUS_REJECTED = "rejected"
+)
+
+// ConfigAckPayload confirms a CONFIG_UPDATE (CONFIG_STATUS_*) and says
+// what the session's configuration is now.
+type ConfigAckPayload struct {
+	UpdateStatus string `json:"update_status"`
+	Message      string `json:"message"`
+	// CheckInterval is the session's check interval after the update.
+	CheckInterval int `json:"check_interval,omitempty"`
+	// Metrics are the collectors and metrics the session reports after the update.
+	Metrics []string `json:"metrics,omitempty"`
+	// RejectedMetrics are the requested metrics the server doesn't know.
+	RejectedMetrics []string `json:"rejected_metrics,omitempty"`
+}
+
+func (p *ConfigAckPayload) Validate() error {
+	if p.UpdateStatus == "" {
+		return errors.New("update_status is required")
+	}
+	return nil
+}
+
+// ErrorPayload is carried by TYPE_ERROR.
+type ErrorPayload struct {
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+	// MinVersion and MaxVersion are set with ERROR_UNSUPPORTED_VERSION.
+	MinVersion int `json:"min_version,omitempty"`
+	MaxVersion int `json:"max_version,omitempty"`
+}
+
+func (p *ErrorPayload) Validate() error {
+	if p.ErrorCode == 0 {
+		return errors.New("error_code is required")
+	}
+	return nil
+}
+
+// Error lets an ERROR from the peer be returned as a Go error.
+func (p *ErrorPayload) Error() string {
+	return fmt.Sprintf("%d %s (%s): %s", p.ErrorCode, ErrorName(p.ErrorCode), ClassifyError(p.ErrorCode), p.ErrorMessage)
+}
+
+// TerminatePayload is carried by TYPE_TERMINATE and TYPE_TERMINATE_ACK.
+type TerminatePayload struct {
+	Message string `json:"message,omitempty"`
+}
+
+func (p *TerminatePayload) Validate() error {
+	return nil
+}
@@ -18,12 +18,18 @@ const (
 	TYPE_TERMINATE       = 9
 	TYPE_TERMINATE_ACK   = 10
 
+	// MAX_PDU_SIZE is the payload limit until a session negotiates a larger one.
 	MAX_PDU_SIZE = 1024
+	// MAX_NEGOTIABLE_PDU_SIZE is the largest payload limit either side may ask for.
+	MAX_NEGOTIABLE_PDU_SIZE = 16 << 20
 )
 
 type PDU struct {
-	Mtype  uint8  `json:"mtype"`
-	Length uint16 `json:"length"`
+	Mtype uint8 `json:"mtype"`
+	// ID correlates a response with its request. Responses echo the
+	// request's ID; 0 means the PDU isn't part of an exchange.
+	ID     uint32 `json:"id,omitempty"`
+	Length uint32 `json:"length"`
 	Data   []byte `json:"data"`
 }
 
@@ -34,7 +40,7 @@ func MakePduBuffer() []byte {
 func NewPDU(mtype uint8, data []byte) *PDU {
 	return &PDU{
 		Mtype:  mtype,
-		Length: uint16(len(data)),
+		Length: uint32(len(data)),
 		Data:   data,
 	}
 }
@@ -68,6 +74,14 @@ func (pdu *PDU) GetTypeAsString() string {
 	}
 }
 
+// SafeInEarlyData reports whether a message from the load balancer may be
+// acted on while it can still be 0-RTT data, which an attacker could
+// replay. Only messages whose effects stay within the connection they
+// arrive on qualify: HELLO and HEALTH_REQUEST.
+func SafeInEarlyData(mtype uint8) bool {
+	return mtype == TYPE_HELLO || mtype == TYPE_HEALTH_REQUEST
+}
+
 func (pdu *PDU) ToJsonString() string {
 	jsonData, err := json.MarshalIndent(pdu, "", "    ")
 	if err != nil {
@@ -0,0 +1,217 @@
+package pdu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FRAME_HEADER_SIZE is the size of the big-endian length prefix that
+// precedes every PDU written to a stream.
+const FRAME_HEADER_SIZE = 4
+
+// Stream types, sent as a single preamble byte when a stream is opened.
+// Streams from load balancers that predate the preamble start directly
+// with a frame, whose first byte is always STREAM_LEGACY since HELLO is
+// far below 16MiB.
+const (
+	STREAM_LEGACY  = 0x00
+	STREAM_CONTROL = 0x01
+	STREAM_HEALTH  = 0x02
+)
+
+// ErrFrameTooLarge is returned when a PDU exceeds the session's maximum
+// payload size. The offending frame has been skipped, so the stream
+// stays usable.
+var ErrFrameTooLarge = errors.New("pdu: frame too large")
+
+// ErrMalformedFrame is returned when a whole frame was read but doesn't
+// decode to a PDU. The stream is still on a frame boundary.
+var ErrMalformedFrame = errors.New("pdu: malformed frame")
+
+// WriteStreamType writes the preamble that tells the peer what a newly
+// opened stream is for.
+func WriteStreamType(w io.Writer, streamType uint8) error {
+	_, err := w.Write([]byte{streamType})
+	return err
+}
+
+// ReadStreamType reads the preamble of a newly accepted stream. A stream
+// without a preamble is reported as STREAM_LEGACY and nothing is consumed.
+func ReadStreamType(r *bufio.Reader) (uint8, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] == STREAM_LEGACY {
+		return STREAM_LEGACY, nil
+	}
+	return r.ReadByte()
+}
+
+// Reader reads length-delimited PDU frames from a stream such as a
+// quic.Stream. QUIC may coalesce or split writes, so every read goes
+// through the length prefix rather than relying on read boundaries.
+type Reader struct {
+	r          io.Reader
+	codec      Codec
+	maxPduSize int
+	hdr        [FRAME_HEADER_SIZE]byte
+	trace      *Trace
+	peer       string
+	stream     string
+}
+
+// NewReader creates a new frame reader on top of r using the JSON codec
+// and a MAX_PDU_SIZE payload limit.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, codec: JsonCodec, maxPduSize: MAX_PDU_SIZE}
+}
+
+// SetCodec switches the codec used to decode subsequent frames.
+func (r *Reader) SetCodec(codec Codec) {
+	r.codec = codec
+}
+
+// SetMaxPduSize changes the largest payload the reader accepts.
+func (r *Reader) SetMaxPduSize(size int) {
+	r.maxPduSize = size
+}
+
+// SetTrace records every PDU read from now on in t as received from
+// peer on the named stream.
+func (r *Reader) SetTrace(t *Trace, peer, stream string) {
+	r.trace, r.peer, r.stream = t, peer, stream
+}
+
+// ReadPDU blocks until a whole frame has been read and returns the decoded PDU.
+func (r *Reader) ReadPDU() (*PDU, error) {
+	if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(r.hdr[:])
+	if int64(size) > int64(r.codec.MaxEncodedSize(r.maxPduSize)) {
+		// Skip the frame so the next read starts on a frame boundary
+		if _, err := io.CopyN(io.Discard, r.r, int64(size)); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, r.reject(fmt.Errorf("%w: %d byte frame exceeds the %d byte limit", ErrFrameTooLarge, size, r.maxPduSize))
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	pdu, err := r.codec.Decode(frame)
+	if err != nil {
+		return nil, r.reject(fmt.Errorf("%w: %v", ErrMalformedFrame, err))
+	}
+	if len(pdu.Data) > r.maxPduSize {
+		return nil, r.reject(fmt.Errorf("%w: %d byte payload exceeds the %d byte limit", ErrFrameTooLarge, len(pdu.Data), r.maxPduSize))
+	}
+	if r.trace != nil {
+		// Tracing is best effort and never fails the stream
+		r.trace.Record(TRACE_RECV, r.peer, r.stream, pdu)
+	}
+	return pdu, nil
+}
+
+// reject records a frame that was read but couldn't be used in the
+// trace, and returns err.
+func (r *Reader) reject(err error) error {
+	if r.trace != nil {
+		r.trace.RecordError(TRACE_RECV, r.peer, r.stream, err)
+	}
+	return err
+}
+
+// Writer writes length-delimited PDU frames to a stream such as a
+// quic.Stream. It is safe for concurrent use.
+type Writer struct {
+	mu         sync.Mutex
+	w          io.Writer
+	codec      Codec
+	maxPduSize int
+	trace      *Trace
+	peer       string
+	stream     string
+}
+
+// NewWriter creates a new frame writer on top of w using the JSON codec
+// and a MAX_PDU_SIZE payload limit.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, codec: JsonCodec, maxPduSize: MAX_PDU_SIZE}
+}
+
+// SetCodec switches the codec used to encode subsequent frames.
+func (w *Writer) SetCodec(codec Codec) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.codec = codec
+}
+
+// SetMaxPduSize changes the largest payload the writer will send. It
+// should match what the peer agreed to receive.
+func (w *Writer) SetMaxPduSize(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.maxPduSize = size
+}
+
+// SetTrace records every PDU written from now on in t as sent to peer
+// on the named stream.
+func (w *Writer) SetTrace(t *Trace, peer, stream string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.trace, w.peer, w.stream = t, peer, stream
+}
+
+// WritePDU encodes the PDU and writes it as a single frame.
+func (w *Writer) WritePDU(pdu *PDU) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(pdu.Data) > w.maxPduSize {
+		return fmt.Errorf("%w: %d byte payload exceeds the %d byte limit", ErrFrameTooLarge, len(pdu.Data), w.maxPduSize)
+	}
+	raw, err := w.codec.Encode(pdu)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, FRAME_HEADER_SIZE+len(raw))
+	binary.BigEndian.PutUint32(frame, uint32(len(raw)))
+	copy(frame[FRAME_HEADER_SIZE:], raw)
+	if _, err := w.w.Write(frame); err != nil {
+		return err
+	}
+	if w.trace != nil {
+		w.trace.Record(TRACE_SEND, w.peer, w.stream, pdu)
+	}
+	return nil
+}
+
+// WritePayload wraps the payload in a PDU of the given type and writes it.
+func (w *Writer) WritePayload(mtype uint8, p Payload) error {
+	pdu, err := NewPayloadPDU(mtype, p)
+	if err != nil {
+		return err
+	}
+	return w.WritePDU(pdu)
+}
+
+// WriteResponse writes a payload in reply to req, echoing its ID. A nil
+// req sends the payload without an ID.
+func (w *Writer) WriteResponse(req *PDU, mtype uint8, p Payload) error {
+	pdu, err := NewPayloadPDU(mtype, p)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		pdu.ID = req.ID
+	}
+	return w.WritePDU(pdu)
+}
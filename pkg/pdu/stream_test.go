@@ -0,0 +1,89 @@
+package pdu
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamType(t *testing.T) {
+	for _, streamType := range []uint8{STREAM_CONTROL, STREAM_HEALTH} {
+		var stream bytes.Buffer
+		WriteStreamType(&stream, streamType)
+		NewWriter(&stream).WritePDU(&PDU{Mtype: TYPE_HEALTH_REQUEST, ID: 1})
+		r := bufio.NewReader(&stream)
+		got, err := ReadStreamType(r)
+		if err != nil || got != streamType {
+			t.Fatalf("ReadStreamType = %d, %v; want %d", got, err, streamType)
+		}
+		if msg, err := NewReader(r).ReadPDU(); err != nil || msg.Mtype != TYPE_HEALTH_REQUEST {
+			t.Fatalf("ReadPDU after the preamble = %v, %v; want HEALTH_REQUEST", msg, err)
+		}
+	}
+}
+
+func TestLegacyStreamType(t *testing.T) {
+	// Streams of load balancers that predate the preamble start with a frame
+	var stream bytes.Buffer
+	NewWriter(&stream).WritePDU(&PDU{Mtype: TYPE_HELLO, Data: []byte("{}")})
+	r := bufio.NewReader(&stream)
+	got, err := ReadStreamType(r)
+	if err != nil || got != STREAM_LEGACY {
+		t.Fatalf("ReadStreamType = %d, %v; want STREAM_LEGACY", got, err)
+	}
+	if msg, err := NewReader(r).ReadPDU(); err != nil || msg.Mtype != TYPE_HELLO {
+		t.Fatalf("ReadPDU of a legacy stream = %v, %v; want HELLO", msg, err)
+	}
+
+	if _, err := ReadStreamType(bufio.NewReader(&bytes.Buffer{})); err != io.EOF {
+		t.Fatalf("ReadStreamType of an empty stream = %v, want EOF", err)
+	}
+}
+
+func TestWriterRefusesLargePayloads(t *testing.T) {
+	var stream bytes.Buffer
+	writer := NewWriter(&stream)
+	msg := &PDU{Mtype: TYPE_HEALTH_RESPONSE, Data: bytes.Repeat([]byte("x"), MAX_PDU_SIZE+1)}
+	if err := writer.WritePDU(msg); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("WritePDU of %d bytes = %v, want ErrFrameTooLarge", len(msg.Data), err)
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("refused PDU left %d bytes on the stream", stream.Len())
+	}
+
+	// A negotiated limit lets it through
+	writer.SetMaxPduSize(2 * MAX_PDU_SIZE)
+	if err := writer.WritePDU(msg); err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReader(&stream)
+	reader.SetMaxPduSize(2 * MAX_PDU_SIZE)
+	got, err := reader.ReadPDU()
+	if err != nil || !bytes.Equal(got.Data, msg.Data) {
+		t.Fatalf("ReadPDU = %v, %v; want the %d byte PDU", got, err, len(msg.Data))
+	}
+}
+
+func TestReaderSkipsLargeFrames(t *testing.T) {
+	for _, codec := range []Codec{JsonCodec, BinaryCodec} {
+		var stream bytes.Buffer
+		writer := NewWriter(&stream)
+		writer.SetCodec(codec)
+		writer.SetMaxPduSize(4 * MAX_PDU_SIZE)
+		writer.WritePDU(&PDU{Mtype: TYPE_HEALTH_RESPONSE, Data: bytes.Repeat([]byte("x"), 4*MAX_PDU_SIZE)})
+		writer.WritePDU(&PDU{Mtype: TYPE_HEALTH_REQUEST, ID: 2})
+
+		reader := NewReader(&stream)
+		reader.SetCodec(codec)
+		if _, err := reader.ReadPDU(); !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("%s: ReadPDU of an oversized frame = %v, want ErrFrameTooLarge", codec.Name(), err)
+		}
+		// The stream is still on a frame boundary
+		got, err := reader.ReadPDU()
+		if err != nil || got.Mtype != TYPE_HEALTH_REQUEST || got.ID != 2 {
+			t.Fatalf("%s: ReadPDU after the oversized frame = %v, %v; want HEALTH_REQUEST 2", codec.Name(), got, err)
+		}
+	}
+}
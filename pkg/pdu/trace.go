@@ -0,0 +1,274 @@
+package pdu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// TRACE_JSONL writes one JSON object per PDU and line.
+	TRACE_JSONL = "jsonl"
+	// TRACE_BINARY writes TRACE_MAGIC followed by one frame per PDU.
+	TRACE_BINARY = "binary"
+
+	TRACE_SEND = "send"
+	TRACE_RECV = "recv"
+
+	// TRACE_MAGIC starts every binary trace.
+	TRACE_MAGIC = "QHCPTRACE\x01"
+
+	// TRACE_REDACTED replaces secrets, such as HELLO's auth_token, in
+	// traced payloads.
+	TRACE_REDACTED = "[redacted]"
+)
+
+// ErrMalformedTrace is returned when a trace record can't be decoded.
+var ErrMalformedTrace = errors.New("pdu: malformed trace record")
+
+// TraceRecord is a PDU as it was sent or received on a stream.
+type TraceRecord struct {
+	Time time.Time `json:"time"`
+	// Direction is TRACE_SEND or TRACE_RECV.
+	Direction string `json:"dir"`
+	// Peer is the address of the other end of the connection.
+	Peer string `json:"peer"`
+	// Stream is the name of the stream the PDU was on.
+	Stream string `json:"stream"`
+	// PDU is nil if the frame couldn't be read, e.g. because it was
+	// malformed or too large. Error then says why.
+	PDU   *PDU   `json:"pdu"`
+	Error string `json:"error,omitempty"`
+}
+
+// Trace writes a record of every PDU a Reader or Writer handles. It is
+// safe for concurrent use.
+type Trace struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	c      io.Closer
+	format string
+}
+
+// NewTrace creates a trace that writes records to w in the given format.
+func NewTrace(w io.WriteCloser, format string) (*Trace, error) {
+	t := &Trace{w: bufio.NewWriter(w), c: w, format: format}
+	switch format {
+	case TRACE_JSONL:
+	case TRACE_BINARY:
+		if _, err := t.w.WriteString(TRACE_MAGIC); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("pdu: unknown trace format %q", format)
+	}
+	return t, nil
+}
+
+// Record writes a record of pdu, with any secrets in its payload
+// redacted. Records are flushed right away so that the trace survives a
+// crash.
+func (t *Trace) Record(direction, peer, stream string, pdu *PDU) error {
+	return t.write(&TraceRecord{Time: time.Now(), Direction: direction, Peer: peer, Stream: stream, PDU: redact(pdu)})
+}
+
+// RecordError writes a record of a frame that couldn't be read.
+func (t *Trace) RecordError(direction, peer, stream string, frameErr error) error {
+	return t.write(&TraceRecord{Time: time.Now(), Direction: direction, Peer: peer, Stream: stream, Error: frameErr.Error()})
+}
+
+func (t *Trace) write(rec *TraceRecord) error {
+	var raw []byte
+	var err error
+	if t.format == TRACE_BINARY {
+		raw, err = encodeBinaryRecord(rec)
+	} else {
+		raw, err = json.Marshal(rec)
+		raw = append(raw, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(raw); err != nil {
+		return err
+	}
+	return t.w.Flush()
+}
+
+// redact returns pdu with HELLO's auth_token replaced by TRACE_REDACTED.
+// A HELLO whose payload can't be parsed is recorded without it.
+func redact(pdu *PDU) *PDU {
+	if pdu.Mtype != TYPE_HELLO || len(pdu.Data) == 0 {
+		return pdu
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(pdu.Data, &fields); err != nil {
+		return &PDU{Mtype: pdu.Mtype, ID: pdu.ID}
+	}
+	if _, ok := fields["auth_token"]; !ok {
+		return pdu
+	}
+	fields["auth_token"], _ = json.Marshal(TRACE_REDACTED)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return &PDU{Mtype: pdu.Mtype, ID: pdu.ID}
+	}
+	return &PDU{Mtype: pdu.Mtype, ID: pdu.ID, Length: uint32(len(data)), Data: data}
+}
+
+// Close flushes the trace and closes the underlying writer.
+func (t *Trace) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.w.Flush(); err != nil {
+		t.c.Close()
+		return err
+	}
+	return t.c.Close()
+}
+
+// traceErrorFlag is set in the direction byte of binary records of frames
+// that couldn't be read.
+const traceErrorFlag = 0x80
+
+// encodeBinaryRecord encodes a record as a frame whose body is the time
+// in Unix nanoseconds (8), the direction (1, 0 for send, with
+// traceErrorFlag set for frames that couldn't be read), the peer and
+// stream names (1-byte length each) and the PDU in the binary codec, or
+// the error message.
+func encodeBinaryRecord(rec *TraceRecord) ([]byte, error) {
+	if len(rec.Peer) > 0xFF || len(rec.Stream) > 0xFF {
+		return nil, errors.New("pdu: trace peer or stream name too long")
+	}
+	dir := byte(0)
+	if rec.Direction == TRACE_RECV {
+		dir = 1
+	}
+	raw := []byte(rec.Error)
+	if rec.PDU != nil {
+		var err error
+		if raw, err = BinaryCodec.Encode(rec.PDU); err != nil {
+			return nil, err
+		}
+	} else {
+		dir |= traceErrorFlag
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, FRAME_HEADER_SIZE))
+	binary.Write(&buf, binary.BigEndian, rec.Time.UnixNano())
+	buf.WriteByte(dir)
+	buf.WriteByte(byte(len(rec.Peer)))
+	buf.WriteString(rec.Peer)
+	buf.WriteByte(byte(len(rec.Stream)))
+	buf.WriteString(rec.Stream)
+	buf.Write(raw)
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-FRAME_HEADER_SIZE))
+	return frame, nil
+}
+
+// TraceReader reads the records of a trace in either format.
+type TraceReader struct {
+	r      *bufio.Reader
+	format string
+}
+
+// NewTraceReader creates a reader for the trace in r, telling the format
+// by whether it starts with TRACE_MAGIC.
+func NewTraceReader(r io.Reader) *TraceReader {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(TRACE_MAGIC))
+	if err == nil && string(magic) == TRACE_MAGIC {
+		br.Discard(len(TRACE_MAGIC))
+		return &TraceReader{r: br, format: TRACE_BINARY}
+	}
+	return &TraceReader{r: br, format: TRACE_JSONL}
+}
+
+// Format returns the format of the trace.
+func (tr *TraceReader) Format() string {
+	return tr.format
+}
+
+// Next returns the next record, or io.EOF at the end of the trace.
+func (tr *TraceReader) Next() (*TraceRecord, error) {
+	if tr.format == TRACE_BINARY {
+		return tr.nextBinary()
+	}
+	for {
+		line, err := tr.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		rec := &TraceRecord{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedTrace, err)
+		}
+		if rec.PDU == nil && rec.Error == "" {
+			return nil, fmt.Errorf("%w: no PDU", ErrMalformedTrace)
+		}
+		return rec, nil
+	}
+}
+
+// maxBinaryRecordSize is the largest body of a binary record: the time,
+// the direction, the longest peer and stream names and the largest PDU.
+var maxBinaryRecordSize = 8 + 1 + 2*(1+0xFF) + BinaryCodec.MaxEncodedSize(MAX_NEGOTIABLE_PDU_SIZE)
+
+func (tr *TraceReader) nextBinary() (*TraceRecord, error) {
+	var hdr [FRAME_HEADER_SIZE]byte
+	if _, err := io.ReadFull(tr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if int64(size) > int64(maxBinaryRecordSize) {
+		// Most likely not a trace, don't try to allocate it
+		return nil, fmt.Errorf("%w: %d byte record exceeds the %d byte limit", ErrMalformedTrace, size, maxBinaryRecordSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(tr.r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if len(body) < 10 {
+		return nil, ErrMalformedTrace
+	}
+	rec := &TraceRecord{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(body))),
+		Direction: TRACE_SEND,
+	}
+	if body[8]&^traceErrorFlag == 1 {
+		rec.Direction = TRACE_RECV
+	}
+	rest := body[9:]
+	for _, field := range []*string{&rec.Peer, &rec.Stream} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, ErrMalformedTrace
+		}
+		*field = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	}
+	if body[8]&traceErrorFlag != 0 {
+		if len(rest) == 0 {
+			return nil, fmt.Errorf("%w: no error message", ErrMalformedTrace)
+		}
+		rec.Error = string(rest)
+		return rec, nil
+	}
+	pdu, err := BinaryCodec.Decode(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedTrace, err)
+	}
+	rec.PDU = pdu
+	return rec, nil
+}
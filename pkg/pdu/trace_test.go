@@ -0,0 +1,132 @@
+package pdu
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// nopCloser lets a bytes.Buffer stand in for a trace file.
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestTraceRoundTrip(t *testing.T) {
+	hello, _ := NewPayloadPDU(TYPE_HELLO, &HelloPayload{AuthToken: "token", MinVersion: 1, MaxVersion: 5})
+	hello.ID = 1
+	request := &PDU{Mtype: TYPE_HEALTH_REQUEST, ID: 2}
+	for _, format := range []string{TRACE_JSONL, TRACE_BINARY} {
+		var buf bytes.Buffer
+		trace, err := NewTrace(nopCloser{&buf}, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Tracing happens as PDUs go through a Writer and a Reader
+		var stream bytes.Buffer
+		writer := NewWriter(&stream)
+		writer.SetTrace(trace, "10.0.0.1:4243", "control")
+		reader := NewReader(&stream)
+		reader.SetTrace(trace, "10.0.0.2:5000", "health")
+		for _, msg := range []*PDU{hello, request} {
+			if err := writer.WritePDU(msg); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := reader.ReadPDU(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trace.Close()
+
+		tr := NewTraceReader(&buf)
+		if tr.Format() != format {
+			t.Fatalf("trace written as %s read as %s", format, tr.Format())
+		}
+		want := []struct {
+			dir, peer, stream string
+			pdu               *PDU
+		}{
+			{TRACE_SEND, "10.0.0.1:4243", "control", hello},
+			{TRACE_RECV, "10.0.0.2:5000", "health", hello},
+			{TRACE_SEND, "10.0.0.1:4243", "control", request},
+			{TRACE_RECV, "10.0.0.2:5000", "health", request},
+		}
+		for _, w := range want {
+			rec, err := tr.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if rec.Direction != w.dir || rec.Peer != w.peer || rec.Stream != w.stream || rec.Time.IsZero() {
+				t.Fatalf("%s: got record %+v, want %s %s %s", format, rec, w.dir, w.peer, w.stream)
+			}
+			if rec.PDU.Mtype != w.pdu.Mtype || rec.PDU.ID != w.pdu.ID {
+				t.Fatalf("%s: got PDU %+v, want %+v", format, rec.PDU, w.pdu)
+			}
+			if w.pdu.Mtype != TYPE_HELLO {
+				if !bytes.Equal(rec.PDU.Data, w.pdu.Data) {
+					t.Fatalf("%s: got PDU %+v, want %+v", format, rec.PDU, w.pdu)
+				}
+				continue
+			}
+			// The token is kept out of the trace
+			traced := &HelloPayload{}
+			if err := DecodePayload(rec.PDU.Data, traced); err != nil || traced.AuthToken != TRACE_REDACTED || traced.MaxVersion != 5 {
+				t.Fatalf("%s: traced HELLO %+v, %v; want auth_token %s", format, traced, err, TRACE_REDACTED)
+			}
+			if int(rec.PDU.Length) != len(rec.PDU.Data) {
+				t.Fatalf("%s: traced HELLO length %d, want %d", format, rec.PDU.Length, len(rec.PDU.Data))
+			}
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Fatalf("%s: got %v after the last record, want EOF", format, err)
+		}
+	}
+}
+
+func TestTraceRejectedFrames(t *testing.T) {
+	for _, format := range []string{TRACE_JSONL, TRACE_BINARY} {
+		var buf bytes.Buffer
+		trace, err := NewTrace(nopCloser{&buf}, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stream bytes.Buffer
+		stream.Write([]byte{0, 0, 0, 3, 'b', 'a', 'd'})
+		stream.Write([]byte{0, 0, 0x10, 0})
+		stream.Write(make([]byte, 0x1000))
+		reader := NewReader(&stream)
+		reader.SetMaxPduSize(64)
+		reader.SetTrace(trace, "10.0.0.2:5000", "control")
+		for _, want := range []error{ErrMalformedFrame, ErrFrameTooLarge} {
+			if _, err := reader.ReadPDU(); !errors.Is(err, want) {
+				t.Fatalf("%s: ReadPDU() = %v, want %v", format, err, want)
+			}
+		}
+		trace.Close()
+
+		tr := NewTraceReader(&buf)
+		for _, want := range []error{ErrMalformedFrame, ErrFrameTooLarge} {
+			rec, err := tr.Next()
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+			if rec.PDU != nil || !strings.HasPrefix(rec.Error, want.Error()) || rec.Direction != TRACE_RECV || rec.Stream != "control" {
+				t.Errorf("%s: got record %+v, want %q error", format, rec, want)
+			}
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Fatalf("%s: got %v after the last record, want EOF", format, err)
+		}
+	}
+}
+
+func TestTraceReaderRejectsGarbage(t *testing.T) {
+	for _, input := range []string{"not json\n", TRACE_MAGIC + "\x00\x00\x00\x02ab", TRACE_MAGIC + "\xff\xff\xff\xff", `{"time":"2026-01-01T00:00:00Z"}` + "\n"} {
+		_, err := NewTraceReader(bytes.NewBufferString(input)).Next()
+		if !errors.Is(err, ErrMalformedTrace) {
+			t.Errorf("Next() on %q = %v, want ErrMalformedTrace", input, err)
+		}
+	}
+}
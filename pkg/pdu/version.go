@@ -0,0 +1,87 @@
+package pdu
+
+const (
+	// PROTOCOL_VERSION_1 is the original protocol: JSON PDUs, no negotiation.
+	PROTOCOL_VERSION_1 = 1
+	// PROTOCOL_VERSION_2 adds codec negotiation in HELLO/ACK.
+	PROTOCOL_VERSION_2 = 2
+	// PROTOCOL_VERSION_3 widens the binary Length field to 32 bits and
+	// negotiates max_pdu_size in HELLO/ACK.
+	PROTOCOL_VERSION_3 = 3
+	// PROTOCOL_VERSION_4 adds a correlation ID to the PDU header that every
+	// response echoes, so requests can be pipelined.
+	PROTOCOL_VERSION_4 = 4
+	// PROTOCOL_VERSION_5 moves health traffic off the control stream onto
+	// a dedicated health stream.
+	PROTOCOL_VERSION_5 = 5
+
+	MIN_PROTOCOL_VERSION = PROTOCOL_VERSION_1
+	MAX_PROTOCOL_VERSION = PROTOCOL_VERSION_5
+)
+
+// LocalMaxVersion caps a configured version limit to what this build
+// supports. A limit of 0 means MAX_PROTOCOL_VERSION.
+func LocalMaxVersion(limit int) int {
+	if limit <= 0 || limit > MAX_PROTOCOL_VERSION {
+		return MAX_PROTOCOL_VERSION
+	}
+	return limit
+}
+
+// NegotiateVersion picks the highest version that lies both in the
+// offered range [offeredMin, offeredMax] and in [MIN_PROTOCOL_VERSION, localMax].
+// It returns false if the ranges don't overlap.
+func NegotiateVersion(offeredMin, offeredMax, localMax int) (int, bool) {
+	version := offeredMax
+	if version > localMax {
+		version = localMax
+	}
+	if version < offeredMin || version < MIN_PROTOCOL_VERSION {
+		return 0, false
+	}
+	return version, true
+}
+
+// SupportsCodecNegotiation reports whether the agreed version lets the
+// session switch away from the JSON codec.
+func SupportsCodecNegotiation(version int) bool {
+	return version >= PROTOCOL_VERSION_2
+}
+
+// SupportsLargePdus reports whether the agreed version negotiates a
+// payload limit above MAX_PDU_SIZE.
+func SupportsLargePdus(version int) bool {
+	return version >= PROTOCOL_VERSION_3
+}
+
+// SupportsCorrelation reports whether responses echo the request's ID.
+func SupportsCorrelation(version int) bool {
+	return version >= PROTOCOL_VERSION_4
+}
+
+// SupportsHealthStreams reports whether health traffic uses its own stream.
+func SupportsHealthStreams(version int) bool {
+	return version >= PROTOCOL_VERSION_5
+}
+
+// UsesStreamPreamble reports whether a load balancer that may negotiate up
+// to localMax opens its streams with a stream-type preamble.
+func UsesStreamPreamble(localMax int) bool {
+	return localMax >= PROTOCOL_VERSION_5
+}
+
+// NegotiatePduSize returns the payload limit both sides accept. A limit of
+// 0 on either side means it didn't ask for more than MAX_PDU_SIZE.
+func NegotiatePduSize(offered, local int) int {
+	size := offered
+	if local < size {
+		size = local
+	}
+	if size < MAX_PDU_SIZE {
+		return MAX_PDU_SIZE
+	}
+	if size > MAX_NEGOTIABLE_PDU_SIZE {
+		return MAX_NEGOTIABLE_PDU_SIZE
+	}
+	return size
+}
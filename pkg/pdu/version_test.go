@@ -0,0 +1,58 @@
+package pdu
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, test := range []struct {
+		name                             string
+		offeredMin, offeredMax, localMax int
+		want                             int
+		ok                               bool
+	}{
+		{"same range", MIN_PROTOCOL_VERSION, MAX_PROTOCOL_VERSION, MAX_PROTOCOL_VERSION, MAX_PROTOCOL_VERSION, true},
+		{"older peer", MIN_PROTOCOL_VERSION, PROTOCOL_VERSION_2, MAX_PROTOCOL_VERSION, PROTOCOL_VERSION_2, true},
+		{"older local side", MIN_PROTOCOL_VERSION, MAX_PROTOCOL_VERSION, PROTOCOL_VERSION_3, PROTOCOL_VERSION_3, true},
+		{"single version", PROTOCOL_VERSION_4, PROTOCOL_VERSION_4, MAX_PROTOCOL_VERSION, PROTOCOL_VERSION_4, true},
+		{"peer too new", PROTOCOL_VERSION_4, PROTOCOL_VERSION_5, PROTOCOL_VERSION_3, 0, false},
+		{"below the minimum", 0, 0, MAX_PROTOCOL_VERSION, 0, false},
+	} {
+		got, ok := NegotiateVersion(test.offeredMin, test.offeredMax, test.localMax)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: NegotiateVersion(%d, %d, %d) = %d, %t; want %d, %t", test.name,
+				test.offeredMin, test.offeredMax, test.localMax, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestLocalMaxVersion(t *testing.T) {
+	for limit, want := range map[int]int{
+		0:                        MAX_PROTOCOL_VERSION,
+		-1:                       MAX_PROTOCOL_VERSION,
+		PROTOCOL_VERSION_2:       PROTOCOL_VERSION_2,
+		MAX_PROTOCOL_VERSION:     MAX_PROTOCOL_VERSION,
+		MAX_PROTOCOL_VERSION + 1: MAX_PROTOCOL_VERSION,
+	} {
+		if got := LocalMaxVersion(limit); got != want {
+			t.Errorf("LocalMaxVersion(%d) = %d, want %d", limit, got, want)
+		}
+	}
+}
+
+func TestNegotiatePduSize(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		offered, local int
+		want           int
+	}{
+		{"neither side asks", 0, 0, MAX_PDU_SIZE},
+		{"only the peer asks", 64 << 10, 0, MAX_PDU_SIZE},
+		{"only the local side asks", 0, 64 << 10, MAX_PDU_SIZE},
+		{"smaller limit wins", 64 << 10, 1 << 20, 64 << 10},
+		{"never below MAX_PDU_SIZE", 512, 1 << 20, MAX_PDU_SIZE},
+		{"never above MAX_NEGOTIABLE_PDU_SIZE", 1 << 30, 1 << 30, MAX_NEGOTIABLE_PDU_SIZE},
+	} {
+		if got := NegotiatePduSize(test.offered, test.local); got != test.want {
+			t.Errorf("%s: NegotiatePduSize(%d, %d) = %d, want %d", test.name, test.offered, test.local, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"drexel.edu/net-quic/pkg/admin"
+)
+
+// Sessions returns the established sessions, sorted by load balancer.
+func (s *Server) Sessions() []admin.SessionStatus {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	statuses := make([]admin.SessionStatus, 0, len(s.sessions))
+	for lbID, sess := range s.sessions {
+		select {
+		case <-sess.established:
+		default:
+			// Still sending its ACK
+			continue
+		}
+		checkInterval, metrics := sess.healthConfig()
+		statuses = append(statuses, admin.SessionStatus{
+			LoadBalancer:     lbID,
+			Address:          sess.conn.RemoteAddr().String(),
+			EstablishedAt:    sess.establishedAt,
+			Version:          sess.version,
+			Codec:            sess.codec.Name(),
+			CheckInterval:    checkInterval,
+			Metrics:          metrics.confirmed,
+			PushMode:         sess.pushMode,
+			AggregateWindows: sess.aggregateWindows,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].LoadBalancer < statuses[j].LoadBalancer })
+	return statuses
+}
+
+// serveAdmin serves the admin API on addr:
+//
+//	GET /sessions  the sessions of the load balancers watching the server
+func (s *Server) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", s.handleSessions)
+	log.Printf("[server] Admin API listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("[server] Admin API stopped: %s", err)
+	}
+}
+
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Sessions())
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/admin"
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+func TestSessionTable(t *testing.T) {
+	s := NewServer(ServerConfig{GenTLS: true, MaxSessions: 2})
+	addr := serveTestServer(t, s)
+	hello := func(lbID string, checkInterval int) *pdu.HelloPayload {
+		return &pdu.HelloPayload{
+			AuthToken:        util.GenerateJWT(lbID),
+			SupportedMetrics: []string{"cpu"},
+			CheckInterval:    checkInterval,
+			MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+		}
+	}
+	// sessions waits for the table to show the check interval of each load balancer
+	sessions := func(want map[string]int) []admin.SessionStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			statuses := s.Sessions()
+			got := make(map[string]int)
+			for _, st := range statuses {
+				got[st.LoadBalancer] = st.CheckInterval
+			}
+			if len(got) == len(want) && !slices.ContainsFunc(statuses, func(st admin.SessionStatus) bool { return want[st.LoadBalancer] != st.CheckInterval }) {
+				return statuses
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("sessions %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	openTestSession(t, addr, hello("lb-2", 7))
+	_, oldReader, _ := openTestSession(t, addr, hello("lb-1", 5))
+	statuses := sessions(map[string]int{"lb-1": 5, "lb-2": 7})
+	if statuses[0].LoadBalancer != "lb-1" || !slices.Equal(statuses[0].Metrics, []string{"cpu"}) || statuses[0].Codec != pdu.CODEC_JSON {
+		t.Errorf("first session = %+v, want lb-1 reporting cpu in JSON", statuses[0])
+	}
+
+	// The cap turns away a third load balancer, with an ERROR unless the
+	// connection closes first
+	rsp, _, _, err := sendTestHello(t, addr, hello("lb-3", 5))
+	errorData := &pdu.ErrorPayload{}
+	var appErr *quic.ApplicationError
+	switch {
+	case err == nil:
+		if rsp.Mtype != pdu.TYPE_ERROR || pdu.DecodePayload(rsp.Data, errorData) != nil || errorData.ErrorCode != pdu.ERROR_TOO_MANY_SESSIONS {
+			t.Fatalf("third HELLO got %v, want ERROR %d", rsp, pdu.ERROR_TOO_MANY_SESSIONS)
+		}
+	case !errors.As(err, &appErr) || int(appErr.ErrorCode) != pdu.ERROR_TOO_MANY_SESSIONS:
+		t.Fatalf("third HELLO got %v, want ERROR %d", err, pdu.ERROR_TOO_MANY_SESSIONS)
+	}
+
+	// but not one that reconnects, which replaces its old session
+	openTestSession(t, addr, hello("lb-1", 9))
+	sessions(map[string]int{"lb-1": 9, "lb-2": 7})
+	if _, err := oldReader.ReadPDU(); err == nil {
+		t.Error("replaced session is still open")
+	}
+
+	w := httptest.NewRecorder()
+	s.handleSessions(w, httptest.NewRequest("GET", "/sessions", nil))
+	var listed []admin.SessionStatus
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil || len(listed) != 2 || listed[1].LoadBalancer != "lb-2" {
+		t.Errorf("GET /sessions = %+v, %v; want lb-1 and lb-2", listed, err)
+	}
+}
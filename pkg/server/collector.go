@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// Collector reads one group of health metrics, e.g. CPU or disk usage.
+// Collectors may be called from several sessions and the background
+// sampler at once.
+type Collector interface {
+	// Name is how load balancers ask for all of the collector's metrics
+	// in HELLO's supported_metrics, e.g. "disk".
+	Name() string
+	// Metrics lists the names of the metrics Collect returns. Metrics
+	// measured per device, such as per mount, are returned as
+	// "<metric>:<device>", e.g. "disk_usage_percent:/var".
+	Metrics() []string
+	// Collect returns the current value of each metric.
+	Collect() (map[string]float64, error)
+}
+
+var (
+	collectorsMu sync.RWMutex
+	collectors   = make(map[string]Collector)
+)
+
+// defaultMetrics are collected for load balancers that don't ask for any.
+var defaultMetrics = []string{"cpu", "memory"}
+
+// metricAliases maps names that older load balancers ask for to collectors.
+var metricAliases = map[string]string{
+	"cpu_load":     "cpu",
+	"memory_usage": "memory",
+}
+
+// RegisterCollector makes a collector available to load balancers under
+// its name. Collector and metric names must be unique; registering one
+// twice panics.
+func RegisterCollector(c Collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	if c.Name() == "" {
+		panic("server: collector has no name")
+	}
+	if _, dup := collectors[c.Name()]; dup {
+		panic(fmt.Sprintf("server: collector %q registered twice", c.Name()))
+	}
+	for _, metric := range c.Metrics() {
+		if other := collectorOf(metric); other != nil {
+			panic(fmt.Sprintf("server: metric %q of collector %q is already reported by %q", metric, c.Name(), other.Name()))
+		}
+	}
+	collectors[c.Name()] = c
+}
+
+// Collectors returns the names of the registered collectors, sorted.
+func Collectors() []string {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// metricSelection is what a session collects: whole collectors, or single
+// metrics of a collector.
+type metricSelection struct {
+	// confirmed are the requested names that matched something, in request order.
+	confirmed []string
+	// unknown are the requested names that matched nothing.
+	unknown []string
+	// collectors maps each collector to run to the metrics wanted from
+	// it, or to nil for all of them.
+	collectors map[Collector]map[string]bool
+	// probeLatency reports the probes' latency as RESPONSE_TIME_METRIC.
+	probeLatency bool
+}
+
+// selectMetrics resolves the names in HELLO's supported_metrics. A name is
+// either a collector, which selects all its metrics, or a metric, which
+// selects it on every device. RESPONSE_TIME selects the probes' latency
+// if the server has probes. Names that match nothing are left out and
+// listed as unknown.
+func selectMetrics(requested []string, probes bool) *metricSelection {
+	if len(requested) == 0 {
+		requested = defaultMetrics
+	}
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	sel := &metricSelection{collectors: make(map[Collector]map[string]bool)}
+	for _, name := range requested {
+		if alias, ok := metricAliases[name]; ok {
+			name = alias
+		}
+		if probes && (name == RESPONSE_TIME || name == RESPONSE_TIME_METRIC) {
+			sel.probeLatency = true
+			sel.confirmed = append(sel.confirmed, name)
+			continue
+		}
+		if c, ok := collectors[name]; ok {
+			sel.collectors[c] = nil
+			sel.confirmed = append(sel.confirmed, name)
+			continue
+		}
+		if c := collectorOf(name); c != nil {
+			if wanted, ok := sel.collectors[c]; !ok {
+				sel.collectors[c] = map[string]bool{name: true}
+			} else if wanted != nil {
+				wanted[name] = true
+			}
+			sel.confirmed = append(sel.confirmed, name)
+			continue
+		}
+		log.Printf("[server] Load balancer asked for unknown metric %q", name)
+		sel.unknown = append(sel.unknown, name)
+	}
+	return sel
+}
+
+// collectorOf returns the collector that reports metric, or nil.
+func collectorOf(metric string) Collector {
+	for _, c := range collectors {
+		for _, m := range c.Metrics() {
+			if m == metric {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// collect runs the selected collectors. Collectors that fail are left
+// out; it fails only if no metric could be read and the probes' latency
+// wasn't selected either.
+func (sel *metricSelection) collect() (*pdu.HealthResponsePayload, error) {
+	metrics := make(map[string]float64)
+	for c, wanted := range sel.collectors {
+		values, err := c.Collect()
+		if err != nil {
+			log.Printf("[server] Error collecting %s metrics: %v", c.Name(), err)
+			continue
+		}
+		for metric, value := range values {
+			base, _, _ := strings.Cut(metric, ":")
+			if wanted == nil || wanted[base] {
+				metrics[metric] = value
+			}
+		}
+	}
+	if len(metrics) == 0 && !sel.probeLatency {
+		return nil, errors.New("no metrics available")
+	}
+	return &pdu.HealthResponsePayload{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Metrics:   metrics,
+	}, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+)
+
+// testCollector reports fixed metrics, or fails if err is set.
+type testCollector struct {
+	name    string
+	names   []string
+	metrics map[string]float64
+	err     error
+}
+
+func (c *testCollector) Name() string      { return c.name }
+func (c *testCollector) Metrics() []string { return c.names }
+
+func (c *testCollector) Collect() (map[string]float64, error) {
+	return c.metrics, c.err
+}
+
+func init() {
+	RegisterCollector(&testCollector{name: "test", names: []string{"test_size", "test_usage"}, metrics: map[string]float64{
+		"test_usage:/":    1,
+		"test_usage:/var": 2,
+		"test_size:/":     3,
+	}})
+	RegisterCollector(&testCollector{name: "test_broken", err: errors.New("broken")})
+}
+
+func TestSelectMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		confirmed []string
+		metrics   map[string]float64
+	}{
+		{
+			name:      "collector",
+			requested: []string{"test"},
+			confirmed: []string{"test"},
+			metrics:   map[string]float64{"test_usage:/": 1, "test_usage:/var": 2, "test_size:/": 3},
+		},
+		{
+			name:      "metric on every device",
+			requested: []string{"test_usage"},
+			confirmed: []string{"test_usage"},
+			metrics:   map[string]float64{"test_usage:/": 1, "test_usage:/var": 2},
+		},
+		{
+			name:      "collector and one of its metrics",
+			requested: []string{"test_usage", "test"},
+			confirmed: []string{"test_usage", "test"},
+			metrics:   map[string]float64{"test_usage:/": 1, "test_usage:/var": 2, "test_size:/": 3},
+		},
+		{
+			name:      "unknown and failing",
+			requested: []string{"response_time", "test_size", "test_broken"},
+			confirmed: []string{"test_size", "test_broken"},
+			metrics:   map[string]float64{"test_size:/": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := selectMetrics(tt.requested, false)
+			if !slices.Equal(sel.confirmed, tt.confirmed) {
+				t.Errorf("confirmed %v, want %v", sel.confirmed, tt.confirmed)
+			}
+			healthData, err := sel.collect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(healthData.Metrics, tt.metrics) {
+				t.Errorf("collected %v, want %v", healthData.Metrics, tt.metrics)
+			}
+		})
+	}
+}
+
+func TestSelectMetricsDefaults(t *testing.T) {
+	if sel := selectMetrics(nil, false); !slices.Equal(sel.confirmed, defaultMetrics) {
+		t.Errorf("no metrics requested confirmed %v, want %v", sel.confirmed, defaultMetrics)
+	}
+	// Names sent by older load balancers still work
+	if sel := selectMetrics([]string{"cpu_load", "memory_usage"}, false); !slices.Equal(sel.confirmed, []string{"cpu", "memory"}) {
+		t.Errorf("legacy names confirmed %v, want [cpu memory]", sel.confirmed)
+	}
+	if _, err := selectMetrics([]string{"test_broken"}, false).collect(); err == nil {
+		t.Error("collecting nothing but a failing collector succeeded")
+	}
+}
+
+func TestBuiltinCollectors(t *testing.T) {
+	for _, name := range []string{"cpu", "memory", "load", "disk", "network", "fds", "goroutines"} {
+		if !slices.Contains(Collectors(), name) {
+			t.Errorf("collector %q isn't registered", name)
+		}
+	}
+	healthData, err := selectMetrics([]string{"goroutines", "memory_usage_percent"}, false).collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if healthData.Metrics["goroutines"] < 1 {
+		t.Errorf("goroutines = %v, want at least 1", healthData.Metrics["goroutines"])
+	}
+	if _, ok := healthData.Metrics["memory_available_bytes"]; ok || len(healthData.Metrics) != 2 {
+		t.Errorf("collected %v, want only goroutines and memory_usage_percent", healthData.Metrics)
+	}
+}
+
+func TestCPUCollectorInterleaved(t *testing.T) {
+	// Each measurement adds busy and idle time in the given proportion
+	times := []cpu.TimesStat{{}, {User: 30, Idle: 70}, {User: 120, Idle: 80}}
+	calls := 0
+	c := newCPUCollector(func() (cpu.TimesStat, error) {
+		if calls == len(times) {
+			return cpu.TimesStat{}, errors.New("no more measurements")
+		}
+		calls++
+		return times[calls-1], nil
+	}, 20*time.Millisecond)
+
+	// A session and the sampler reading the collector in turn both get the
+	// usage over the whole period, not the other's leftovers
+	for i, want := range []float64{30, 90} {
+		time.Sleep(30 * time.Millisecond)
+		for _, reader := range []string{"sampler", "session"} {
+			metrics, err := c.Collect()
+			if err != nil || metrics["cpu_usage_percent"] != want {
+				t.Errorf("period %d: %s got %v, %v; want %v%%", i, reader, metrics, err, want)
+			}
+		}
+	}
+	if calls != len(times) {
+		t.Errorf("CPU times read %d times, want %d", calls, len(times))
+	}
+}
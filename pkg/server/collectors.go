@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+)
+
+func init() {
+	RegisterCollector(newCPUCollector(cpuTimes, minCPUSample))
+	RegisterCollector(&funcCollector{"memory", []string{"memory_usage_percent", "memory_available_bytes"}, collectMemory})
+	RegisterCollector(&funcCollector{"load", []string{"load_average_1m", "load_average_5m", "load_average_15m"}, collectLoad})
+	RegisterCollector(&funcCollector{"disk", []string{"disk_usage_percent", "disk_free_bytes"}, collectDisk})
+	RegisterCollector(newNetworkCollector())
+	RegisterCollector(&funcCollector{"fds", []string{"open_fds"}, collectFDs})
+	RegisterCollector(&funcCollector{"goroutines", []string{"goroutines"}, collectGoroutines})
+}
+
+// funcCollector is a Collector that has no state of its own.
+type funcCollector struct {
+	name    string
+	metrics []string
+	collect func() (map[string]float64, error)
+}
+
+func (c *funcCollector) Name() string                         { return c.name }
+func (c *funcCollector) Metrics() []string                    { return c.metrics }
+func (c *funcCollector) Collect() (map[string]float64, error) { return c.collect() }
+
+// minCPUSample is the shortest period CPU usage is measured over.
+// Collecting more often returns the last measurement again.
+const minCPUSample = time.Second
+
+// cpuCollector reports the CPU usage since its previous measurement. It
+// keeps its own CPU times rather than using cpu.Percent(0, ...), whose
+// previous measurement is shared by every caller in the process, so
+// that sessions and the sampler reading it in turn all see the usage
+// over a full period.
+type cpuCollector struct {
+	mu       sync.Mutex
+	times    func() (cpu.TimesStat, error)
+	period   time.Duration
+	last     cpu.TimesStat
+	lastTime time.Time
+	usage    map[string]float64
+}
+
+func newCPUCollector(times func() (cpu.TimesStat, error), period time.Duration) *cpuCollector {
+	c := &cpuCollector{times: times, period: period}
+	// Start measuring right away, so that the first request gets a usage
+	if t, err := times(); err == nil {
+		c.last, c.lastTime = t, time.Now()
+	}
+	return c
+}
+
+// cpuTimes returns the CPU times of all CPUs together.
+func cpuTimes() (cpu.TimesStat, error) {
+	times, err := cpu.Times(false)
+	if err != nil {
+		return cpu.TimesStat{}, err
+	}
+	if len(times) == 0 {
+		return cpu.TimesStat{}, errors.New("no CPU usage reported")
+	}
+	return times[0], nil
+}
+
+func (c *cpuCollector) Name() string      { return "cpu" }
+func (c *cpuCollector) Metrics() []string { return []string{"cpu_usage_percent"} }
+
+func (c *cpuCollector) Collect() (map[string]float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.usage != nil && now.Sub(c.lastTime) < c.period {
+		return c.usage, nil
+	}
+	t, err := c.times()
+	if err != nil {
+		return nil, err
+	}
+	last, lastTime := c.last, c.lastTime
+	c.last, c.lastTime = t, now
+	if lastTime.IsZero() {
+		return nil, errors.New("no earlier measurement yet")
+	}
+	c.usage = map[string]float64{"cpu_usage_percent": busyPercent(last, t)}
+	return c.usage, nil
+}
+
+// busyPercent returns the share of CPU time between two measurements that
+// wasn't spent idle.
+func busyPercent(last, now cpu.TimesStat) float64 {
+	total := now.Total() - last.Total()
+	if total <= 0 {
+		return 0
+	}
+	idle := now.Idle - last.Idle
+	return min(100, max(0, 100*(total-idle)/total))
+}
+
+func collectMemory() (map[string]float64, error) {
+	memStat, err := mem.VirtualMemory()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"memory_usage_percent":   memStat.UsedPercent,
+		"memory_available_bytes": float64(memStat.Available),
+	}, nil
+}
+
+func collectLoad() (map[string]float64, error) {
+	avg, err := load.Avg()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{
+		"load_average_1m":  avg.Load1,
+		"load_average_5m":  avg.Load5,
+		"load_average_15m": avg.Load15,
+	}, nil
+}
+
+// collectDisk reports the usage of every mounted physical file system.
+func collectDisk() (map[string]float64, error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]float64)
+	for _, p := range partitions {
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil || usage.Total == 0 {
+			continue
+		}
+		metrics["disk_usage_percent:"+p.Mountpoint] = usage.UsedPercent
+		metrics["disk_free_bytes:"+p.Mountpoint] = float64(usage.Free)
+	}
+	if len(metrics) == 0 {
+		return nil, errors.New("no mounted file systems")
+	}
+	return metrics, nil
+}
+
+// collectFDs reports the file descriptors the server process has open.
+func collectFDs() (map[string]float64, error) {
+	proc, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	fds, err := proc.NumFDs()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]float64{"open_fds": float64(fds)}, nil
+}
+
+func collectGoroutines() (map[string]float64, error) {
+	return map[string]float64{"goroutines": float64(runtime.NumGoroutine())}, nil
+}
+
+// minNetworkSample is the shortest period network throughput is measured
+// over. Collecting more often returns the last measurement again.
+const minNetworkSample = time.Second
+
+// networkCollector reports the bytes per second received and sent on all
+// interfaces since the previous measurement.
+type networkCollector struct {
+	mu       sync.Mutex
+	last     net.IOCountersStat
+	lastTime time.Time
+	rates    map[string]float64
+}
+
+func newNetworkCollector() *networkCollector {
+	c := &networkCollector{}
+	// Start measuring right away, so that the first request gets a rate
+	if counters, err := net.IOCounters(false); err == nil && len(counters) > 0 {
+		c.last, c.lastTime = counters[0], time.Now()
+	}
+	return c
+}
+
+func (c *networkCollector) Name() string { return "network" }
+
+func (c *networkCollector) Metrics() []string {
+	return []string{"network_rx_bytes_per_sec", "network_tx_bytes_per_sec"}
+}
+
+func (c *networkCollector) Collect() (map[string]float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.rates != nil && now.Sub(c.lastTime) < minNetworkSample {
+		return c.rates, nil
+	}
+	counters, err := net.IOCounters(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(counters) == 0 {
+		return nil, errors.New("no network interfaces")
+	}
+	last, lastTime := c.last, c.lastTime
+	c.last, c.lastTime = counters[0], now
+	if lastTime.IsZero() {
+		return nil, errors.New("no earlier measurement yet")
+	}
+	seconds := now.Sub(lastTime).Seconds()
+	c.rates = map[string]float64{
+		"network_rx_bytes_per_sec": perSecond(counters[0].BytesRecv, last.BytesRecv, seconds),
+		"network_tx_bytes_per_sec": perSecond(counters[0].BytesSent, last.BytesSent, seconds),
+	}
+	return c.rates, nil
+}
+
+// perSecond returns the rate at which a counter grew, or 0 if it was reset.
+func perSecond(now, last uint64, seconds float64) float64 {
+	if now < last {
+		return 0
+	}
+	return float64(now-last) / seconds
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"testing"
+
+	"drexel.edu/net-quic/pkg/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, MaxPduSize: 64 * 1024}))
+	conformance.Run(t, conformance.Target{Addr: addr})
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"github.com/quic-go/quic-go"
+)
+
+// sendHeartbeats sends a sequence-numbered heartbeat datagram every
+// interval until done is closed or the connection fails.
+func (s *Server) sendHeartbeats(conn quic.Connection, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var seq uint32
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		seq++
+		if err := conn.SendDatagram(pdu.Heartbeat{Seq: seq}.ToBytes()); err != nil {
+			log.Printf("[server] Error sending heartbeat: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+const (
+	// defaultSampleInterval applies to servers that don't set one.
+	defaultSampleInterval = time.Second
+	// historyLength is how far back the metric history goes, enough for
+	// the longest aggregate window.
+	historyLength = 5 * time.Minute
+)
+
+// metricSample is the value of every metric at one point in time.
+type metricSample struct {
+	at      time.Time
+	metrics map[string]float64
+}
+
+// metricHistory keeps the samples of the last historyLength in a ring buffer.
+type metricHistory struct {
+	mu      sync.Mutex
+	samples []metricSample
+	next    int
+	count   int
+}
+
+// newMetricHistory creates a history for samples taken every interval.
+func newMetricHistory(interval time.Duration) *metricHistory {
+	size := int(historyLength/interval) + 1
+	return &metricHistory{samples: make([]metricSample, size)}
+}
+
+// record adds a sample, replacing the oldest once the buffer is full.
+func (h *metricHistory) record(sample metricSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % len(h.samples)
+	h.count = min(h.count+1, len(h.samples))
+}
+
+// latest returns the most recent sample, if there is one.
+func (h *metricHistory) latest() (metricSample, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return metricSample{}, false
+	}
+	return h.samples[(h.next+len(h.samples)-1)%len(h.samples)], true
+}
+
+// aggregates summarizes the history of each of metrics over each of
+// windows. Windows without samples are left out.
+func (h *metricHistory) aggregates(windows []string, metrics map[string]float64) map[string]map[string]pdu.MetricAggregate {
+	if len(windows) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	aggregates := make(map[string]map[string]pdu.MetricAggregate)
+	for _, window := range windows {
+		length, _ := pdu.WindowDuration(window)
+		values := make(map[string][]float64)
+		for i := range h.count {
+			sample := h.samples[i]
+			if now.Sub(sample.at) > length {
+				continue
+			}
+			for metric := range metrics {
+				if value, ok := sample.metrics[metric]; ok {
+					values[metric] = append(values[metric], value)
+				}
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		aggregates[window] = make(map[string]pdu.MetricAggregate, len(values))
+		for metric, v := range values {
+			aggregates[window][metric] = aggregate(v)
+		}
+	}
+	if len(aggregates) == 0 {
+		return nil
+	}
+	return aggregates
+}
+
+// aggregate summarizes values, using the nearest-rank p95.
+func aggregate(values []float64) pdu.MetricAggregate {
+	slices.Sort(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	rank := int(math.Ceil(0.95 * float64(len(values))))
+	return pdu.MetricAggregate{
+		Samples: len(values),
+		Avg:     sum / float64(len(values)),
+		Max:     values[len(values)-1],
+		P95:     values[max(rank, 1)-1],
+	}
+}
+
+// selectWindows returns the requested windows the server knows, in
+// request order and without duplicates.
+func selectWindows(requested []string) []string {
+	var windows []string
+	for _, window := range requested {
+		if _, ok := pdu.WindowDuration(window); !ok {
+			log.Printf("[server] Load balancer asked for unknown aggregate window %q", window)
+			continue
+		}
+		if !slices.Contains(windows, window) {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// sampleMetrics reads every collector into the metric history each
+// sample interval until done is closed.
+func (s *Server) sampleMetrics(done <-chan struct{}) {
+	ticker := time.NewTicker(s.sampleInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.history.record(metricSample{at: now, metrics: collectAll()})
+		}
+	}
+}
+
+// sampleInterval returns how often the metric history is sampled.
+func (s *Server) sampleInterval() time.Duration {
+	if s.cfg.SampleInterval > 0 {
+		return s.cfg.SampleInterval
+	}
+	return defaultSampleInterval
+}
+
+// collectAll reads every registered collector. Collectors that fail are
+// left out; sessions that ask for their metrics log why.
+func collectAll() map[string]float64 {
+	collectorsMu.RLock()
+	all := make([]Collector, 0, len(collectors))
+	for _, c := range collectors {
+		all = append(all, c)
+	}
+	collectorsMu.RUnlock()
+	metrics := make(map[string]float64)
+	for _, c := range all {
+		values, err := c.Collect()
+		if err != nil {
+			continue
+		}
+		for metric, value := range values {
+			metrics[metric] = value
+		}
+	}
+	return metrics
+}
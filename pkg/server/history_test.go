@@ -0,0 +1,80 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+func TestMetricHistory(t *testing.T) {
+	h := newMetricHistory(time.Second)
+	now := time.Now()
+	// An old sample, overwritten once the buffer wraps around
+	h.record(metricSample{at: now.Add(-time.Hour), metrics: map[string]float64{"load": 1000}})
+	for i := range len(h.samples) - 3 {
+		h.record(metricSample{at: now.Add(-6 * time.Minute), metrics: map[string]float64{"load": 500 + float64(i)}})
+	}
+	h.record(metricSample{at: now.Add(-30 * time.Second), metrics: map[string]float64{"load": 80, "other": 1}})
+	for _, load := range []float64{10, 30} {
+		h.record(metricSample{at: now.Add(-2 * time.Second), metrics: map[string]float64{"load": load}})
+	}
+	h.record(metricSample{at: now.Add(-time.Second), metrics: map[string]float64{"load": 20}})
+
+	got := h.aggregates([]string{pdu.WINDOW_10S, pdu.WINDOW_1M}, map[string]float64{"load": 20})
+	want := map[string]map[string]pdu.MetricAggregate{
+		pdu.WINDOW_10S: {"load": {Samples: 3, Avg: 20, Max: 30, P95: 30}},
+		pdu.WINDOW_1M:  {"load": {Samples: 4, Avg: 35, Max: 80, P95: 80}},
+	}
+	for window, aggregates := range want {
+		if got[window]["load"] != aggregates["load"] || len(got[window]) != 1 {
+			t.Errorf("%s aggregates = %+v, want %+v", window, got[window], aggregates)
+		}
+	}
+	if got := h.aggregates(nil, map[string]float64{"load": 20}); got != nil {
+		t.Errorf("no windows asked for got %v", got)
+	}
+	if got := h.aggregates([]string{pdu.WINDOW_5M}, map[string]float64{"missing": 1}); got != nil {
+		t.Errorf("metric without history got %v", got)
+	}
+}
+
+func TestSelectWindows(t *testing.T) {
+	got := selectWindows([]string{pdu.WINDOW_1M, "2h", pdu.WINDOW_10S, pdu.WINDOW_1M})
+	if want := []string{pdu.WINDOW_1M, pdu.WINDOW_10S}; !slices.Equal(got, want) {
+		t.Errorf("selected %v, want %v", got, want)
+	}
+}
+
+func TestHealthResponseAggregates(t *testing.T) {
+	s := NewServer(ServerConfig{GenTLS: true, SampleInterval: 10 * time.Millisecond})
+	addr := serveTestServer(t, s)
+	ack, reader, writer := openTestSession(t, addr, &pdu.HelloPayload{
+		SupportedMetrics: []string{"goroutines"},
+		CheckInterval:    5,
+		MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+		AggregateWindows: []string{pdu.WINDOW_10S, "1h"},
+	})
+	if !slices.Equal(ack.AggregateWindows, []string{pdu.WINDOW_10S}) {
+		t.Fatalf("ACK confirmed windows %v, want [%s]", ack.AggregateWindows, pdu.WINDOW_10S)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	writer.WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 2})
+	rsp, err := reader.ReadPDU()
+	if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_RESPONSE {
+		t.Fatalf("HEALTH_REQUEST got %v, %v; want HEALTH_RESPONSE", rsp, err)
+	}
+	healthData := &pdu.HealthResponsePayload{}
+	if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+		t.Fatal(err)
+	}
+	goroutines := healthData.Aggregates[pdu.WINDOW_10S]["goroutines"]
+	if goroutines.Samples < 2 || goroutines.Avg < 1 || goroutines.Max < goroutines.Avg {
+		t.Errorf("10s aggregate of goroutines = %+v, want several samples", goroutines)
+	}
+	if len(healthData.Aggregates) != 1 || len(healthData.Aggregates[pdu.WINDOW_10S]) != 1 {
+		t.Errorf("aggregates = %v, want goroutines over 10s only", healthData.Aggregates)
+	}
+}
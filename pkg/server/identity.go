@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// maxServerIDLength keeps server IDs usable in file names and URLs.
+const maxServerIDLength = 64
+
+// resolveServerID picks the ID the server introduces itself with: the
+// configured one, the one saved in the ID file, or <hostname>-<port>.
+func (s *Server) resolveServerID() (string, error) {
+	hostname := sanitizeID(s.hostname)
+	if hostname == "" {
+		hostname = "server"
+	}
+	// Leave room for the suffix
+	hostname = hostname[:min(len(hostname), maxServerIDLength-16)]
+	var id string
+	var err error
+	switch {
+	case s.cfg.ServerID != "":
+		id = s.cfg.ServerID
+	case s.cfg.IDFile != "":
+		id, err = loadServerID(s.cfg.IDFile, hostname)
+		if err != nil {
+			return "", err
+		}
+	default:
+		id = fmt.Sprintf("%s-%d", hostname, s.cfg.Port)
+	}
+	if err := validateServerID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// loadServerID reads the server ID saved in path, or generates one from
+// the hostname and saves it there if the file doesn't exist.
+func loadServerID(path string, hostname string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id := fmt.Sprintf("%s-%s", hostname, randomHex(4))
+		if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+			return "", fmt.Errorf("error saving server ID: %w", err)
+		}
+		log.Printf("[server] Generated server ID %s and saved it in %s", id, path)
+		return id, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading server ID: %w", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// validateServerID checks that id is safe to use in file names and URLs.
+func validateServerID(id string) error {
+	if id == "" || len(id) > maxServerIDLength {
+		return fmt.Errorf("server ID %q must be 1 to %d characters", id, maxServerIDLength)
+	}
+	if sanitizeID(id) != id {
+		return fmt.Errorf("server ID %q may only contain letters, digits, '.', '_' and '-'", id)
+	}
+	return nil
+}
+
+// sanitizeID replaces the characters a server ID can't contain with '-'.
+func sanitizeID(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+func TestResolveServerID(t *testing.T) {
+	idFile := filepath.Join(t.TempDir(), "server-id")
+	tests := []struct {
+		name     string
+		cfg      ServerConfig
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{name: "configured", cfg: ServerConfig{ServerID: "web-1", IDFile: idFile, Port: 4243}, want: "web-1"},
+		{name: "hostname and port", cfg: ServerConfig{Port: 4243}, hostname: "host.example", want: "host.example-4243"},
+		{name: "hostname sanitized", cfg: ServerConfig{Port: 4243}, hostname: "my host", want: "my-host-4243"},
+		{name: "no hostname", cfg: ServerConfig{Port: 4243}, want: "server-4243"},
+		{name: "invalid", cfg: ServerConfig{ServerID: "web/1"}, wantErr: true},
+		{name: "too long", cfg: ServerConfig{ServerID: strings.Repeat("a", maxServerIDLength+1)}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{cfg: test.cfg, hostname: test.hostname}
+			id, err := s.resolveServerID()
+			if (err != nil) != test.wantErr || id != test.want {
+				t.Errorf("got %q, %v; want %q", id, err, test.want)
+			}
+		})
+	}
+}
+
+func TestServerIDFile(t *testing.T) {
+	idFile := filepath.Join(t.TempDir(), "server-id")
+	s := &Server{cfg: ServerConfig{IDFile: idFile, Port: 4243}, hostname: strings.Repeat("h", 100)}
+	id, err := s.resolveServerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "hhh") || len(id) > maxServerIDLength {
+		t.Errorf("generated ID %q isn't based on the hostname or is too long", id)
+	}
+	saved, err := os.ReadFile(idFile)
+	if err != nil || strings.TrimSpace(string(saved)) != id {
+		t.Fatalf("ID file holds %q, %v; want %q", saved, err, id)
+	}
+	// Later runs keep the saved ID
+	again, err := s.resolveServerID()
+	if err != nil || again != id {
+		t.Errorf("second run got %q, %v; want %q", again, err, id)
+	}
+}
+
+func TestAckIdentity(t *testing.T) {
+	s := NewServer(ServerConfig{ServerID: "web-1", GenTLS: true})
+	addr := serveTestServer(t, s)
+	ack, _, _ := openTestSession(t, addr, &pdu.HelloPayload{CheckInterval: 5, MaxVersion: pdu.MAX_PROTOCOL_VERSION})
+	hostname, _ := os.Hostname()
+	if ack.ServerID != "web-1" || ack.Hostname != hostname || ack.InstanceID != s.instanceID || ack.StartedAt == "" {
+		t.Errorf("ACK = %+v, want server web-1 on %s, instance %s", ack, hostname, s.instanceID)
+	}
+	if other := NewServer(ServerConfig{ServerID: "web-1", GenTLS: true}); other.instanceID == s.instanceID {
+		t.Error("two servers got the same instance ID")
+	}
+}
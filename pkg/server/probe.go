@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// Kinds of application probes.
+const (
+	// PROBE_HTTP sends a GET to Target and expects ExpectStatus (any 2xx by default).
+	PROBE_HTTP = "http"
+	// PROBE_TCP connects to the host:port in Target.
+	PROBE_TCP = "tcp"
+	// PROBE_UNIX connects to the unix socket at the path in Target.
+	PROBE_UNIX = "unix"
+	// PROBE_EXEC runs Command and expects it to exit with status 0.
+	PROBE_EXEC = "exec"
+)
+
+const (
+	// RESPONSE_TIME is how load balancers ask for the application's response
+	// time in HELLO's supported_metrics.
+	RESPONSE_TIME = "response_time"
+	// RESPONSE_TIME_METRIC reports the application's response time: the
+	// latency of the slowest probe, in milliseconds.
+	RESPONSE_TIME_METRIC = "response_time_ms"
+)
+
+const (
+	// defaultProbeTimeout applies to probes that don't set a timeout.
+	defaultProbeTimeout = 2 * time.Second
+	// defaultProbeInterval applies to servers that don't set one.
+	defaultProbeInterval = time.Second
+	// probeWaitDelay is how long an exec probe's output is waited for
+	// after it exits or is killed, in case a child it started still
+	// holds the output open.
+	probeWaitDelay = time.Second
+	// maxProbeOutput is how much of a probe's output goes into a
+	// HEALTH_RESPONSE, so that a chatty probe can't outgrow the PDU limit.
+	maxProbeOutput = 200
+)
+
+// ProbeConfig describes a check of the application the server is
+// fronting, run when the server reports its health, at most once per
+// probe interval.
+type ProbeConfig struct {
+	Name string `json:"name"`
+	// Type is one of the PROBE_* kinds.
+	Type string `json:"type"`
+	// Target is the URL, host:port or socket path to probe.
+	Target string `json:"target,omitempty"`
+	// Command is the program and arguments run by PROBE_EXEC, without a shell.
+	Command []string `json:"command,omitempty"`
+	// ExpectStatus is the HTTP status PROBE_HTTP expects (0 for any 2xx).
+	ExpectStatus int `json:"expect_status,omitempty"`
+	// TimeoutMs fails the probe if it takes longer (0 for 2000).
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+}
+
+// Validate checks that the probe can be run.
+func (p *ProbeConfig) Validate() error {
+	if p.Name == "" {
+		return errors.New("probe has no name")
+	}
+	switch p.Type {
+	case PROBE_HTTP, PROBE_TCP, PROBE_UNIX:
+		if p.Target == "" {
+			return fmt.Errorf("%s probe %q has no target", p.Type, p.Name)
+		}
+	case PROBE_EXEC:
+		if len(p.Command) == 0 {
+			return fmt.Errorf("exec probe %q has no command", p.Name)
+		}
+	default:
+		return fmt.Errorf("probe %q has unknown type %q", p.Name, p.Type)
+	}
+	if p.TimeoutMs < 0 {
+		return fmt.Errorf("probe %q has a negative timeout", p.Name)
+	}
+	return nil
+}
+
+// LoadProbes reads a JSON array of probes from a file.
+func LoadProbes(path string) ([]ProbeConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading probes: %w", err)
+	}
+	var probes []ProbeConfig
+	if err := json.Unmarshal(raw, &probes); err != nil {
+		return nil, fmt.Errorf("error parsing probes in %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i := range probes {
+		if err := probes[i].Validate(); err != nil {
+			return nil, err
+		}
+		if names[probes[i].Name] {
+			return nil, fmt.Errorf("probe %q is defined twice", probes[i].Name)
+		}
+		names[probes[i].Name] = true
+	}
+	return probes, nil
+}
+
+// runProbes returns the results of the server's probes. The probes are
+// run, all at once, only if the last results are older than the probe
+// interval, so sessions asking at the same time share one run.
+func (s *Server) runProbes() []pdu.ProbeResult {
+	if len(s.cfg.Probes) == 0 {
+		return nil
+	}
+	s.probesMu.Lock()
+	defer s.probesMu.Unlock()
+	if s.probeResults == nil || time.Since(s.probedAt) >= s.probeInterval() {
+		s.probeResults = s.probeAll()
+		s.probedAt = time.Now()
+	}
+	return slices.Clone(s.probeResults)
+}
+
+// probeInterval returns how long probe results are reused for.
+func (s *Server) probeInterval() time.Duration {
+	if s.cfg.ProbeInterval > 0 {
+		return s.cfg.ProbeInterval
+	}
+	return defaultProbeInterval
+}
+
+// probeAll runs all of the server's probes at once and returns their results.
+func (s *Server) probeAll() []pdu.ProbeResult {
+	results := make([]pdu.ProbeResult, len(s.cfg.Probes))
+	var wg sync.WaitGroup
+	for i := range s.cfg.Probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.cfg.Probes[i].run(s.ctx)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// slowestProbe returns the highest latency of the probe results, or false
+// if there are none.
+func slowestProbe(results []pdu.ProbeResult) (float64, bool) {
+	if len(results) == 0 {
+		return 0, false
+	}
+	slowest := results[0].LatencyMs
+	for _, r := range results[1:] {
+		slowest = max(slowest, r.LatencyMs)
+	}
+	return slowest, true
+}
+
+// run runs the probe once.
+func (p *ProbeConfig) run(ctx context.Context) pdu.ProbeResult {
+	timeout := defaultProbeTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	var output string
+	var err error
+	switch p.Type {
+	case PROBE_HTTP:
+		output, err = p.probeHTTP(ctx)
+	case PROBE_TCP, PROBE_UNIX:
+		err = probeConnect(ctx, p.Type, p.Target)
+	case PROBE_EXEC:
+		output, err = p.probeExec(ctx)
+	default:
+		err = fmt.Errorf("unknown probe type %q", p.Type)
+	}
+	result := pdu.ProbeResult{
+		Name:      p.Name,
+		Passed:    err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Output:    output,
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		result.Output = strings.TrimSpace(err.Error() + "\n" + output)
+	}
+	result.Output = truncateOutput(result.Output)
+	return result
+}
+
+func (p *ProbeConfig) probeHTTP(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Target, nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, maxProbeOutput))
+	output := fmt.Sprintf("%s %s", rsp.Status, body)
+	passed := rsp.StatusCode/100 == 2
+	if p.ExpectStatus != 0 {
+		passed = rsp.StatusCode == p.ExpectStatus
+	}
+	if !passed {
+		return "", errors.New(output)
+	}
+	return output, nil
+}
+
+func probeConnect(ctx context.Context, network string, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *ProbeConfig) probeExec(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.WaitDelay = probeWaitDelay
+	output, err := cmd.CombinedOutput()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The command succeeded, but left a child behind holding its output
+		err = nil
+	}
+	return string(output), err
+}
+
+// truncateOutput trims output to maxProbeOutput bytes without splitting a character.
+func truncateOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) <= maxProbeOutput {
+		return output
+	}
+	output = output[:maxProbeOutput]
+	for !utf8.ValidString(output) {
+		output = output[:len(output)-1]
+	}
+	return output + "..."
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+func TestProbes(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer web.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// An address nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	tests := []struct {
+		name   string
+		probe  ProbeConfig
+		passed bool
+		output string
+	}{
+		{"http", ProbeConfig{Type: PROBE_HTTP, Target: web.URL + "/health"}, true, "200 OK ok"},
+		{"http error status", ProbeConfig{Type: PROBE_HTTP, Target: web.URL + "/broken"}, false, "503 Service Unavailable database unreachable"},
+		{"http expected status", ProbeConfig{Type: PROBE_HTTP, Target: web.URL + "/broken", ExpectStatus: http.StatusServiceUnavailable}, true, "503"},
+		{"http unexpected status", ProbeConfig{Type: PROBE_HTTP, Target: web.URL + "/health", ExpectStatus: http.StatusNoContent}, false, "200 OK"},
+		{"tcp", ProbeConfig{Type: PROBE_TCP, Target: listener.Addr().String()}, true, ""},
+		{"tcp refused", ProbeConfig{Type: PROBE_TCP, Target: closed.Addr().String()}, false, "refused"},
+		{"unix", ProbeConfig{Type: PROBE_UNIX, Target: socket}, true, ""},
+		{"unix missing", ProbeConfig{Type: PROBE_UNIX, Target: socket + ".missing"}, false, "no such file"},
+		{"exec", ProbeConfig{Type: PROBE_EXEC, Command: []string{"sh", "-c", "echo ready"}}, true, "ready"},
+		{"exec failure", ProbeConfig{Type: PROBE_EXEC, Command: []string{"sh", "-c", "echo not ready; exit 3"}}, false, "exit status 3\nnot ready"},
+		{"exec timeout", ProbeConfig{Type: PROBE_EXEC, Command: []string{"sleep", "5"}, TimeoutMs: 100}, false, "timed out after 100ms"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.probe.Name = test.name
+			result := test.probe.run(context.Background())
+			if result.Name != test.name || result.Passed != test.passed {
+				t.Fatalf("got %+v, want passed=%v", result, test.passed)
+			}
+			if !strings.Contains(result.Output, test.output) {
+				t.Errorf("output %q doesn't contain %q", result.Output, test.output)
+			}
+			if result.LatencyMs <= 0 {
+				t.Errorf("latency %v isn't positive", result.LatencyMs)
+			}
+		})
+	}
+}
+
+func TestProbeOutputTruncated(t *testing.T) {
+	probe := ProbeConfig{Name: "chatty", Type: PROBE_EXEC, Command: []string{"sh", "-c", "yes é | head -c 1000"}}
+	result := probe.run(context.Background())
+	if len(result.Output) > maxProbeOutput+len("...") || !strings.HasSuffix(result.Output, "...") {
+		t.Errorf("output of %d bytes wasn't truncated: %q", len(result.Output), result.Output)
+	}
+}
+
+func TestProbeExecLeavesChild(t *testing.T) {
+	// The child keeps the output open long after the probe times out
+	probe := ProbeConfig{Name: "daemon", Type: PROBE_EXEC, Command: []string{"sh", "-c", "sleep 10 & echo started"}, TimeoutMs: 100}
+	start := time.Now()
+	result := probe.run(context.Background())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("probe took %s, want it to stop waiting for the child", elapsed)
+	}
+	if !result.Passed || result.Output != "started" {
+		t.Errorf("got %+v, want the command's own result", result)
+	}
+}
+
+func TestProbeResultsReused(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	s := NewServer(ServerConfig{
+		GenTLS:        true,
+		Probes:        []ProbeConfig{{Name: "count", Type: PROBE_EXEC, Command: []string{"sh", "-c", "echo run >> " + runs}}},
+		ProbeInterval: 300 * time.Millisecond,
+	})
+	countRuns := func() int {
+		raw, _ := os.ReadFile(runs)
+		return strings.Count(string(raw), "run")
+	}
+
+	// Sessions asking at once share one run
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if results := s.runProbes(); len(results) != 1 || !results[0].Passed {
+				t.Errorf("got %+v, want one passed probe", results)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := countRuns(); n != 1 {
+		t.Errorf("probes ran %d times for five reports, want once", n)
+	}
+
+	time.Sleep(350 * time.Millisecond)
+	s.runProbes()
+	if n := countRuns(); n != 2 {
+		t.Errorf("probes ran %d times after the interval, want twice", n)
+	}
+}
+
+func TestLoadProbes(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		valid bool
+	}{
+		{"valid", `[{"name":"web","type":"http","target":"http://127.0.0.1:8080/health","expect_status":200},
+			{"name":"check","type":"exec","command":["/bin/true"],"timeout_ms":500}]`, true},
+		{"no name", `[{"type":"tcp","target":"127.0.0.1:5432"}]`, false},
+		{"unknown type", `[{"name":"db","type":"udp","target":"127.0.0.1:5432"}]`, false},
+		{"no target", `[{"name":"db","type":"tcp"}]`, false},
+		{"no command", `[{"name":"check","type":"exec"}]`, false},
+		{"duplicate", `[{"name":"db","type":"tcp","target":"a:1"},{"name":"db","type":"tcp","target":"b:1"}]`, false},
+		{"malformed", `{"name":"db"}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "probes.json")
+			if err := os.WriteFile(path, []byte(test.json), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			probes, err := LoadProbes(path)
+			if (err == nil) != test.valid {
+				t.Fatalf("got error %v, want valid=%v", err, test.valid)
+			}
+			if test.valid && len(probes) != 2 {
+				t.Errorf("got %d probes, want 2", len(probes))
+			}
+		})
+	}
+}
+
+func TestProbeResponseTime(t *testing.T) {
+	if sel := selectMetrics([]string{RESPONSE_TIME}, false); !slices.Equal(sel.unknown, []string{RESPONSE_TIME}) {
+		t.Errorf("without probes, %s was confirmed", RESPONSE_TIME)
+	}
+	s := NewServer(ServerConfig{
+		GenTLS:             true,
+		Probes:             []ProbeConfig{{Name: "fast", Type: PROBE_EXEC, Command: []string{"true"}}, {Name: "slow", Type: PROBE_EXEC, Command: []string{"sleep", "0.05"}}},
+		DegradedThresholds: map[string]float64{RESPONSE_TIME_METRIC: 20},
+	})
+	sel := selectMetrics([]string{RESPONSE_TIME}, true)
+	if !slices.Equal(sel.confirmed, []string{RESPONSE_TIME}) {
+		t.Fatalf("confirmed %v, want [%s]", sel.confirmed, RESPONSE_TIME)
+	}
+	healthData, err := sel.collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.assess(healthData, sel, nil)
+	if latency := healthData.Metrics[RESPONSE_TIME_METRIC]; latency < 50 {
+		t.Errorf("%s = %v, want the slow probe's latency", RESPONSE_TIME_METRIC, latency)
+	}
+	if healthData.Status != pdu.STATUS_DEGRADED || !strings.HasPrefix(healthData.StatusReason, RESPONSE_TIME_METRIC) {
+		t.Errorf("got %s (%s), want %s for the probes' latency", healthData.Status, healthData.StatusReason, pdu.STATUS_DEGRADED)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// pushSampleInterval is how often a push session samples metrics to catch
+// threshold crossings between scheduled pushes.
+const pushSampleInterval = time.Second
+
+// pushLoop is a running pushHealthData loop.
+type pushLoop struct {
+	// stop is closed when another loop takes over the session's pushes.
+	stop chan struct{}
+	// reconfigured is signalled when CONFIG_UPDATE changes the session.
+	reconfigured chan struct{}
+}
+
+// startPush pushes the session's health data on writer from now on. A
+// loop already pushing for the session is stopped, so that a new health
+// stream takes the pushes over rather than getting a second copy of them.
+func (s *Server) startPush(sess *session, writer *pdu.Writer) {
+	loop := &pushLoop{
+		stop:         make(chan struct{}),
+		reconfigured: make(chan struct{}, 1),
+	}
+	sess.mu.Lock()
+	if sess.push != nil {
+		close(sess.push.stop)
+	}
+	sess.push = loop
+	sess.mu.Unlock()
+	go s.pushHealthData(writer, sess, loop)
+}
+
+// pushHealthData sends HEALTH_DATA every check interval, and right away
+// when a metric crosses one of the session's thresholds, until the
+// session ends or another loop takes over. CONFIG_UPDATE changes the
+// interval and metrics as it goes.
+func (s *Server) pushHealthData(writer *pdu.Writer, sess *session, loop *pushLoop) {
+	checkInterval, metrics := sess.healthConfig()
+	interval := time.Duration(checkInterval) * time.Second
+	thresholds := sess.pushThresholds
+	log.Printf("[server] Pushing health data every %s", interval)
+	pushTicker := time.NewTicker(interval)
+	defer pushTicker.Stop()
+
+	var sampleC <-chan time.Time
+	if len(thresholds) > 0 {
+		sampleTicker := time.NewTicker(pushSampleInterval)
+		defer sampleTicker.Stop()
+		sampleC = sampleTicker.C
+	}
+
+	// above records which side of its threshold each metric was last seen on
+	above := make(map[string]bool)
+	crossed := func(healthData *pdu.HealthResponsePayload) bool {
+		changed := false
+		for metric, threshold := range thresholds {
+			value, ok := healthData.Metrics[metric]
+			if !ok {
+				continue
+			}
+			wasAbove, seen := above[metric]
+			above[metric] = value >= threshold
+			if seen && wasAbove != above[metric] {
+				changed = true
+			}
+		}
+		return changed
+	}
+
+	for {
+		var healthData *pdu.HealthResponsePayload
+		select {
+		case <-sess.done:
+			return
+		case <-loop.stop:
+			return
+		case <-loop.reconfigured:
+			checkInterval, metrics = sess.healthConfig()
+			if newInterval := time.Duration(checkInterval) * time.Second; newInterval != interval {
+				interval = newInterval
+				pushTicker.Reset(interval)
+				log.Printf("[server] Pushing health data every %s", interval)
+			}
+			continue
+		case <-pushTicker.C:
+			var err error
+			if healthData, err = metrics.collect(); err != nil {
+				log.Printf("[server] Error collecting health data: %s", err)
+				if err := s.sendError(writer, nil, pdu.ERROR_METRIC_UNAVAILABLE, err.Error()); err != nil {
+					return
+				}
+				continue
+			}
+			healthData.Trigger = pdu.PUSH_TRIGGER_INTERVAL
+			s.assess(healthData, metrics, sess.aggregateWindows)
+			crossed(healthData)
+		case <-sampleC:
+			var err error
+			if healthData, err = metrics.collect(); err != nil || !crossed(healthData) {
+				continue
+			}
+			healthData.Trigger = pdu.PUSH_TRIGGER_THRESHOLD
+			s.assess(healthData, metrics, sess.aggregateWindows)
+			pushTicker.Reset(interval)
+		}
+		if err := writer.WritePayload(pdu.TYPE_HEALTH_DATA, healthData); err != nil {
+			log.Printf("[server] Error pushing health data: %s", err)
+			return
+		}
+		log.Printf("[server] Pushed health data (%s)", healthData.Trigger)
+	}
+}
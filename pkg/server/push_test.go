@@ -0,0 +1,79 @@
+package server
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// expectPush reads the next PDU and checks that it is HEALTH_DATA pushed
+// for the given reason.
+func expectPush(t *testing.T, reader *pdu.Reader, trigger string) *pdu.HealthResponsePayload {
+	t.Helper()
+	rsp, err := reader.ReadPDU()
+	if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_DATA {
+		t.Fatalf("got %v, %v; want HEALTH_DATA", rsp, err)
+	}
+	healthData := &pdu.HealthResponsePayload{}
+	if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+		t.Fatal(err)
+	}
+	if healthData.Trigger != trigger {
+		t.Fatalf("HEALTH_DATA trigger = %q, want %q", healthData.Trigger, trigger)
+	}
+	return healthData
+}
+
+func TestPushMode(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	// Pushing needs an interval to push at
+	ack, _, _ := openTestSession(t, addr, &pdu.HelloPayload{PushMode: true, MaxVersion: pdu.PROTOCOL_VERSION_4})
+	if ack.PushMode {
+		t.Fatal("server agreed to push without a check interval")
+	}
+
+	ack, reader, _ := openTestSession(t, addr, &pdu.HelloPayload{
+		SupportedMetrics: []string{"goroutines"},
+		CheckInterval:    1,
+		PushMode:         true,
+		MaxVersion:       pdu.PROTOCOL_VERSION_4,
+	})
+	if !ack.PushMode {
+		t.Fatal("server didn't agree to push")
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		healthData := expectPush(t, reader, pdu.PUSH_TRIGGER_INTERVAL)
+		if _, ok := healthData.Metrics["goroutines"]; !ok {
+			t.Fatalf("HEALTH_DATA metrics %v, want goroutines", healthData.Metrics)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 4*time.Second {
+		t.Fatalf("two pushes took %s, want about two seconds", elapsed)
+	}
+}
+
+func TestPushOnThreshold(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	threshold := float64(runtime.NumGoroutine() + 200)
+	_, reader, _ := openTestSession(t, addr, &pdu.HelloPayload{
+		SupportedMetrics: []string{"goroutines"},
+		CheckInterval:    60,
+		PushMode:         true,
+		PushThresholds:   map[string]float64{"goroutines": threshold},
+		MaxVersion:       pdu.PROTOCOL_VERSION_4,
+	})
+	// Let the first sample see goroutines below the threshold
+	time.Sleep(pushSampleInterval + 500*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 400; i++ {
+		go func() { <-release }()
+	}
+	healthData := expectPush(t, reader, pdu.PUSH_TRIGGER_THRESHOLD)
+	if healthData.Metrics["goroutines"] < threshold {
+		t.Fatalf("pushed goroutines %v, want at least %v", healthData.Metrics["goroutines"], threshold)
+	}
+}
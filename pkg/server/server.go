@@ -2,27 +2,85 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"drexel.edu/net-quic/pkg/pdu"
 	"drexel.edu/net-quic/pkg/util"
 	"github.com/quic-go/quic-go"
-	"github.com/shirou/gopsutil/cpu"
-	"github.com/shirou/gopsutil/mem"
+	"github.com/quic-go/quic-go/logging"
 )
 
 // ServerConfig represents the configuration for the server.
 type ServerConfig struct {
+	// ServerID is the ID load balancers know the server by. If it is
+	// empty, the ID saved in IDFile is used, generated there on first run.
+	// Without either, the ID is <hostname>-<port>.
+	ServerID string
+	IDFile   string
 	GenTLS   bool
 	CertFile string
 	KeyFile  string
 	Address  string
 	Port     int
+	// MaxVersion caps the protocol version the server will agree to (0 means the latest).
+	MaxVersion int
+	// MaxPduSize is the largest payload the server accepts once negotiated.
+	MaxPduSize int
+	// QlogDir is where a qlog file is written for every load balancer
+	// connection, named by server ID. Empty disables qlog.
+	QlogDir string
+	// TraceFile is where every PDU sent and received is recorded, in
+	// TraceFormat (pdu.TRACE_JSONL or pdu.TRACE_BINARY). Empty disables tracing.
+	TraceFile   string
+	TraceFormat string
+	// SessionTicketKeyFile holds the key that encrypts TLS session tickets.
+	// Keeping it across restarts lets load balancers resume sessions with
+	// 0-RTT. It is created if it doesn't exist; empty uses a new key per run.
+	SessionTicketKeyFile string
+	// TransportConfig sets the QUIC transport parameters of load balancer
+	// connections. Load balancers open two streams per connection.
+	util.TransportConfig
+	// Probes check the application the server fronts. Their results are
+	// sent with every health report, and the server reports itself down
+	// while any of them fails.
+	Probes []ProbeConfig
+	// ProbeInterval is how long probe results are reused for, however
+	// many load balancers ask for health reports. 0 means one second.
+	ProbeInterval time.Duration
+	// WarmUp is how long the server reports itself not ready after it
+	// starts, so that load balancers hold off traffic after a deploy.
+	WarmUp time.Duration
+	// DegradedThresholds maps metric names to values at or over which
+	// the server reports itself degraded.
+	DegradedThresholds map[string]float64
+	// Weight, MaxConnections and Labels are advertised in ACK so that load
+	// balancers can weight and group servers. See pdu.AckPayload.
+	Weight         int
+	MaxConnections int
+	Labels         map[string]string
+	// MaxSessions caps how many load balancers may have a session at once
+	// (0 means no limit). A load balancer that reconnects replaces its
+	// earlier session rather than taking another one.
+	MaxSessions int
+	// AdminAddr is where the admin API listens for session listings,
+	// e.g. "127.0.0.1:4241". Empty disables it.
+	AdminAddr string
+	// SampleInterval is how often every collector is read into the metric
+	// history that windowed aggregates are computed from. 0 means every
+	// second.
+	SampleInterval time.Duration
 }
 
 // Server represents the server.
@@ -30,44 +88,153 @@ type Server struct {
 	cfg ServerConfig
 	tls *tls.Config
 	ctx context.Context
+	// draining is set once the server stops taking on load balancers.
+	draining atomic.Bool
+	// trace records PDUs if a trace file is configured.
+	trace *pdu.Trace
+	// ready is cleared while the application holds the server back.
+	ready atomic.Bool
+	// readyAt is when the warm-up period ends.
+	readyAt time.Time
+	// id, hostname, instanceID and startedAt identify the server in ACK.
+	// instanceID changes every time the server starts.
+	id         string
+	hostname   string
+	instanceID string
+	startedAt  time.Time
+	// sessions maps the identity of each load balancer with a session,
+	// from the client_id of its token, to the session.
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+	// history holds the metrics sampled in the background while serving.
+	history *metricHistory
+	// probeResults are the latest probe results, run at probedAt.
+	probesMu     sync.Mutex
+	probeResults []pdu.ProbeResult
+	probedAt     time.Time
 }
 
 // NewServer creates a new server with the given configuration.
 func NewServer(cfg ServerConfig) *Server {
 	server := &Server{
-		cfg: cfg,
+		cfg:      cfg,
+		sessions: make(map[string]*session),
 	}
+	server.history = newMetricHistory(server.sampleInterval())
 	server.tls = server.getTLS()
 	server.ctx = context.TODO()
+	server.ready.Store(true)
+	server.startedAt = time.Now()
+	server.readyAt = server.startedAt.Add(cfg.WarmUp)
+	server.instanceID = randomHex(8)
+	server.hostname, _ = os.Hostname()
+	id, err := server.resolveServerID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.id = id
+	if !util.HasJWTSecret() {
+		// Every HELLO would fail authentication
+		log.Fatal("[server] ", util.ErrNoJWTSecret)
+	}
+	// Catch advertised values that would make every ACK fail
+	if err := server.checkAdvertised(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[server] Server ID %s (instance %s)", server.id, server.instanceID)
+	if cfg.TraceFile != "" {
+		trace, err := util.CreateTrace(cfg.TraceFile, cfg.TraceFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.trace = trace
+	}
 	return server
 }
 
 // getTLS returns the TLS configuration for the server.
 func (s *Server) getTLS() *tls.Config {
+	var tlsConfig *tls.Config
+	var err error
 	if s.cfg.GenTLS {
-		tlsConfig, err := util.GenerateTLSConfig()
-		if err != nil {
-			log.Fatal(err)
-		}
-		return tlsConfig
+		tlsConfig, err = util.GenerateTLSConfig()
 	} else {
-		tlsConfig, err := util.BuildTLSConfig(s.cfg.CertFile, s.cfg.KeyFile)
+		tlsConfig, err = util.BuildTLSConfig(s.cfg.CertFile, s.cfg.KeyFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.cfg.SessionTicketKeyFile != "" {
+		key, err := util.LoadSessionTicketKey(s.cfg.SessionTicketKeyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		return tlsConfig
+		tlsConfig.SetSessionTicketKeys([][32]byte{key})
+	}
+	return tlsConfig
+}
+
+// checkAdvertised checks the values the server advertises in ACK. The
+// ACK goes out before a larger PDU size is agreed, so it has to fit in
+// pdu.MAX_PDU_SIZE together with the largest values a session adds.
+func (s *Server) checkAdvertised() error {
+	ack := &pdu.AckPayload{
+		ConfirmedMetrics:  append(Collectors(), RESPONSE_TIME),
+		CheckInterval:     math.MaxInt32,
+		ServerID:          s.id,
+		Version:           pdu.MAX_PROTOCOL_VERSION,
+		Codec:             pdu.CODEC_BINARY,
+		MaxPduSize:        pdu.MAX_NEGOTIABLE_PDU_SIZE,
+		PushMode:          true,
+		HeartbeatInterval: math.MaxInt32,
+		Hostname:          s.hostname,
+		InstanceID:        s.instanceID,
+		StartedAt:         s.startedAt.Format(time.RFC3339),
+		Weight:            s.cfg.Weight,
+		MaxConnections:    s.cfg.MaxConnections,
+		Labels:            s.cfg.Labels,
+		AggregateWindows:  []string{pdu.WINDOW_10S, pdu.WINDOW_1M, pdu.WINDOW_5M},
+	}
+	if err := ack.Validate(); err != nil {
+		return err
+	}
+	msg, err := pdu.NewPayloadPDU(pdu.TYPE_ACK, ack)
+	if err != nil {
+		return err
+	}
+	if len(msg.Data) > pdu.MAX_PDU_SIZE {
+		return fmt.Errorf("ACK would take up to %d bytes, over the %d byte limit before negotiation; use fewer or shorter labels",
+			len(msg.Data), pdu.MAX_PDU_SIZE)
 	}
+	return nil
 }
 
 // Run starts the server.
 func (s *Server) Run() error {
+	if s.cfg.AdminAddr != "" {
+		go s.serveAdmin(s.cfg.AdminAddr)
+	}
 	address := fmt.Sprintf("%s:%d", s.cfg.Address, s.cfg.Port)
-	listener, err := quic.ListenAddr(address, s.tls, nil)
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Printf("error listening: %s", err)
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve accepts load balancer connections on conn until it fails. It
+// lets tests and embedders run the server on a socket of their own.
+func (s *Server) Serve(conn net.PacketConn) error {
+	listener, err := quic.ListenEarly(conn, s.tls, s.quicConfig())
 	if err != nil {
 		log.Printf("error listening: %s", err)
 		return err
 	}
-	log.Printf("[server] Listening on %s", address)
+	log.Printf("[server] Listening on %s", conn.LocalAddr())
+	stopSampling := make(chan struct{})
+	defer close(stopSampling)
+	go s.sampleMetrics(stopSampling)
 	// SERVER LOOP
 	for {
 		log.Println("[server] Waiting for loadbalancer to connect...")
@@ -81,171 +248,404 @@ func (s *Server) Run() error {
 	}
 }
 
+// Drain makes the server report pdu.STATUS_DRAINING in its health data
+// and answer new sessions with ERROR_DRAINING, so that load balancers
+// take it out of rotation before it shuts down.
+func (s *Server) Drain() {
+	if !s.draining.Swap(true) {
+		log.Print("[server] Draining")
+	}
+}
+
+// quicConfig returns the QUIC configuration for the listener.
+func (s *Server) quicConfig() *quic.Config {
+	// Heartbeats are sent as unreliable datagrams, if they are enabled
+	config := s.cfg.QuicConfig()
+	// Load balancers resuming a session may send HELLO and health
+	// checks as 0-RTT data; anything else waits for the handshake
+	config.Allow0RTT = true
+	if s.cfg.QlogDir != "" {
+		config.Tracer = s.newQlogTracer
+	}
+	return config
+}
+
+// newQlogTracer writes the qlog of a load balancer connection to a file of its own.
+func (s *Server) newQlogTracer(_ context.Context, p logging.Perspective, odcid quic.ConnectionID) *logging.ConnectionTracer {
+	tracer, err := util.NewQlogTracer(util.QlogPath(s.cfg.QlogDir, s.serverID(), p, odcid), p, odcid)
+	if err != nil {
+		log.Printf("[server] Not writing qlog: %s", err)
+		return nil
+	}
+	return tracer
+}
+
+// serverID returns the ID the server reports in ACK.
+func (s *Server) serverID() string {
+	return s.id
+}
+
 // streamHandler handles incoming streams from the load balancer.
-func (s *Server) streamHandler(sess quic.Connection) {
+func (s *Server) streamHandler(conn quic.Connection) {
+	sess := newSession(conn)
+	defer sess.end()
 	for {
 		log.Print("[server] waiting for client to open stream")
-		stream, err := sess.AcceptStream(s.ctx)
+		stream, err := conn.AcceptStream(s.ctx)
 		if err != nil {
-			log.Printf("[server] stream closed: %s", err)
+			var idleErr *quic.IdleTimeoutError
+			if errors.As(err, &idleErr) {
+				log.Printf("[server] Load balancer %s timed out: nothing received within the idle timeout", conn.RemoteAddr())
+			} else {
+				log.Printf("[server] stream closed: %s", err)
+			}
 			break
 		}
+		go s.routeStream(sess, stream)
+	}
+}
+
+// routeStream reads a stream's preamble and hands it to the matching handler.
+func (s *Server) routeStream(sess *session, stream quic.Stream) {
+	defer stream.Close()
+	r := bufio.NewReader(stream)
+	streamType, err := pdu.ReadStreamType(r)
+	if err != nil {
+		log.Printf("[server] Error reading stream type: %s", err)
+		return
+	}
+	switch streamType {
+	case pdu.STREAM_LEGACY, pdu.STREAM_CONTROL:
 		// Handle protocol activity on stream
-		s.protocolHandler(stream)
+		s.protocolHandler(sess, stream, r)
+	case pdu.STREAM_HEALTH:
+		s.healthHandler(sess, stream, r)
+	default:
+		log.Printf("[server] Unknown stream type %d", streamType)
+		stream.CancelRead(0)
 	}
 }
 
-// protocolHandler handles the protocol communication with the load balancer.
-func (s *Server) protocolHandler(stream quic.Stream) error {
+// protocolHandler handles the control stream: HELLO, CONFIG_UPDATE and
+// TERMINATE, plus health checks for sessions without a health stream.
+// Messages the session's state doesn't allow close the connection.
+func (s *Server) protocolHandler(sess *session, stream quic.Stream, r io.Reader) error {
 	// THIS IS WHERE YOU START HANDLING YOUR APP PROTOCOL
-	buff := pdu.MakePduBuffer()
+	reader := pdu.NewReader(r)
+	writer := pdu.NewWriter(stream)
+	s.setTrace(sess, reader, writer, "control")
+	// Ending the control stream ends the session and its background pushes
+	defer sess.end()
+	defer s.removeSession(sess)
 	for {
-		n, err := stream.Read(buff)
-		if err != nil {
-			log.Printf("[server] Error Reading Raw Data: %s", err)
-			return err
+		data, err := reader.ReadPDU()
+		if errors.Is(err, pdu.ErrFrameTooLarge) {
+			// The frame was skipped, so the session can carry on
+			log.Printf("[server] Rejected PDU: %s", err)
+			if err := s.sendError(writer, nil, pdu.ERROR_PAYLOAD_TOO_LARGE, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if errors.Is(err, pdu.ErrMalformedFrame) {
+			// The stream is still on a frame boundary, but a peer sending
+			// garbage can't be trusted with the session
+			return s.abort(sess, stream, writer, nil, pdu.ERROR_MALFORMED_PAYLOAD, err)
 		}
-		data, err := pdu.PduFromBytes(buff[:n])
 		if err != nil {
-			log.Printf("[server] Error decoding PDU: %s", err)
+			log.Printf("[server] Error reading PDU: %s", err)
 			return err
 		}
 
 		log.Printf("[server] Data In: [%s] %s",
 			data.GetTypeAsString(), string(data.Data))
 
+		next, err := sess.check(data.Mtype)
+		if err != nil {
+			return s.abort(sess, stream, writer, data, rejectCode(err), err)
+		}
+		if !pdu.SafeInEarlyData(data.Mtype) && !sess.waitHandshake() {
+			log.Printf("[server] Handshake failed before %s could be handled", data.GetTypeAsString())
+			return nil
+		}
+
 		switch data.Mtype {
 		case pdu.TYPE_HELLO:
 			// Process HELLO message and send ACK
-			var hello struct {
-				SupportedMetrics []string `json:"supported_metrics"`
-				CheckInterval    int      `json:"check_interval"`
-				AuthToken        string   `json:"auth_token"`
-				Version          float64  `json:"version"`
-			}
-			json.Unmarshal(data.Data, &hello)
-			// Verify JWT token (simplified, just trust the token)
-			serverID := fmt.Sprintf("server-%d", s.cfg.Port)
-			// Send ACK
-			ackData := map[string]interface{}{
-				"confirmed_metrics": hello.SupportedMetrics,
-				"check_interval":    hello.CheckInterval,
-				"server_id":         serverID,
-			}
-			ackBytes, _ := json.Marshal(ackData)
-			ackPdu := pdu.PDU{
-				Mtype:  pdu.TYPE_ACK,
-				Length: uint16(len(ackBytes)),
-				Data:   ackBytes,
-			}
-			ackBytes, _ = pdu.PduToBytes(&ackPdu)
-			stream.Write(ackBytes)
+			hello := &pdu.HelloPayload{}
+			if err := pdu.DecodePayload(data.Data, hello); err != nil {
+				log.Printf("[server] Error decoding HELLO: %s", err)
+				return s.abort(sess, stream, writer, data, pdu.ERROR_MALFORMED_PAYLOAD, err)
+			}
+			lbID, err := util.VerifyJWT(hello.AuthToken)
+			if err != nil {
+				return s.abort(sess, stream, writer, data, pdu.ERROR_AUTH_FAILED, err)
+			}
+			if s.draining.Load() {
+				return s.abort(sess, stream, writer, data, pdu.ERROR_DRAINING, errors.New("server is draining"))
+			}
+			if hello.MaxVersion == 0 {
+				// Load balancers that predate negotiation only send a single version
+				hello.MinVersion = int(hello.Version)
+				hello.MaxVersion = int(hello.Version)
+			}
+			localMax := pdu.LocalMaxVersion(s.cfg.MaxVersion)
+			version, ok := pdu.NegotiateVersion(hello.MinVersion, hello.MaxVersion, localMax)
+			if !ok {
+				log.Printf("[server] No common protocol version with [%d, %d]", hello.MinVersion, hello.MaxVersion)
+				return writer.WriteResponse(data, pdu.TYPE_ERROR, &pdu.ErrorPayload{
+					ErrorCode:    pdu.ERROR_UNSUPPORTED_VERSION,
+					ErrorMessage: "Unsupported protocol version.",
+					MinVersion:   pdu.MIN_PROTOCOL_VERSION,
+					MaxVersion:   localMax,
+				})
+			}
+			// A replayed HELLO must not close the load balancer's live session
+			if s.hasSession(lbID) && !sess.waitHandshake() {
+				log.Printf("[server] Handshake failed before load balancer %s could replace its session", lbID)
+				return nil
+			}
+			if err := s.addSession(lbID, sess); err != nil {
+				return s.abort(sess, stream, writer, data, pdu.ERROR_TOO_MANY_SESSIONS, err)
+			}
+			metrics := selectMetrics(hello.SupportedMetrics, len(s.cfg.Probes) > 0)
+			ack := &pdu.AckPayload{
+				ConfirmedMetrics: metrics.confirmed,
+				CheckInterval:    hello.CheckInterval,
+				ServerID:         s.serverID(),
+				Version:          version,
+				Hostname:         s.hostname,
+				InstanceID:       s.instanceID,
+				StartedAt:        s.startedAt.Format(time.RFC3339),
+				Weight:           s.cfg.Weight,
+				MaxConnections:   s.cfg.MaxConnections,
+				Labels:           s.cfg.Labels,
+				AggregateWindows: selectWindows(hello.AggregateWindows),
+			}
+			codec := pdu.JsonCodec
+			if pdu.SupportsCodecNegotiation(version) {
+				codec = pdu.NegotiateCodec(hello.Codecs, version)
+				ack.Codec = codec.Name()
+			}
+			maxPduSize := pdu.MAX_PDU_SIZE
+			if pdu.SupportsLargePdus(version) {
+				maxPduSize = pdu.NegotiatePduSize(hello.MaxPduSize, s.cfg.MaxPduSize)
+				ack.MaxPduSize = maxPduSize
+			}
+			ack.PushMode = hello.PushMode && hello.CheckInterval > 0
+			if hello.HeartbeatInterval > 0 && sess.conn.ConnectionState().SupportsDatagrams {
+				ack.HeartbeatInterval = max(hello.HeartbeatInterval, pdu.MIN_HEARTBEAT_INTERVAL_MS)
+			}
+			if err := writer.WriteResponse(data, pdu.TYPE_ACK, ack); err != nil {
+				log.Printf("[server] Error sending ACK: %s", err)
+				if errors.Is(err, pdu.ErrFrameTooLarge) {
+					// Tell the load balancer instead of leaving it waiting
+					return s.abort(sess, stream, writer, data, pdu.ERROR_PAYLOAD_TOO_LARGE, err)
+				}
+				return err
+			}
+			// The ACK goes out in JSON; everything after it uses the agreed settings
+			sess.version = version
+			sess.codec = codec
+			sess.maxPduSize = maxPduSize
+			sess.setHealthConfig(hello.CheckInterval, metrics)
+			sess.pushMode = ack.PushMode
+			sess.pushThresholds = hello.PushThresholds
+			sess.aggregateWindows = ack.AggregateWindows
+			sess.establishedAt = time.Now()
+			sess.configure(reader, writer)
+			sess.setState(next)
+			close(sess.established)
+			log.Printf("[server] Agreed on protocol version %d with %s codec and %d byte PDUs with load balancer %s",
+				version, codec.Name(), maxPduSize, lbID)
+			if ack.PushMode && !pdu.SupportsHealthStreams(version) {
+				// Without a health stream, pushes share the control stream
+				s.startPush(sess, writer)
+			}
+			if ack.HeartbeatInterval > 0 {
+				log.Printf("[server] Sending heartbeats every %d ms", ack.HeartbeatInterval)
+				go s.sendHeartbeats(sess.conn, time.Duration(ack.HeartbeatInterval)*time.Millisecond, sess.done)
+			}
 
 		case pdu.TYPE_HEALTH_REQUEST:
 			// Send current health metrics
-			healthData := s.getHealthData()
-			rspPdu := pdu.PDU{
-				Mtype:  pdu.TYPE_HEALTH_RESPONSE,
-				Length: uint16(len(healthData)),
-				Data:   healthData,
-			}
-			rspBytes, _ := pdu.PduToBytes(&rspPdu)
-			_, err := stream.Write(rspBytes)
-			if err != nil {
-				log.Printf("[server] Error sending health response: %s", err)
+			if err := s.sendHealthResponse(sess, writer, data); err != nil {
 				return err
 			}
-			log.Println("[server] Sent health response")
 
 		case pdu.TYPE_CONFIG_UPDATE:
 			// Update health check configuration
-			var configUpdate struct {
-				NewMetrics       []string `json:"new_metrics"`
-				NewCheckInterval int      `json:"new_check_interval"`
+			if !sess.allowRequest() {
+				if err := s.sendError(writer, data, pdu.ERROR_RATE_LIMITED, "Too many requests."); err != nil {
+					return err
+				}
+				continue
 			}
-			json.Unmarshal(data.Data, &configUpdate)
-			s.updateHealthCheckConfig(configUpdate.NewMetrics, configUpdate.NewCheckInterval)
-			// Send CONFIG_ACK
-			ackData := map[string]interface{}{
-				"update_status": "success",
-				"message":       "Configuration updated successfully.",
+			configUpdate := &pdu.ConfigUpdatePayload{}
+			if err := pdu.DecodePayload(data.Data, configUpdate); err != nil {
+				log.Printf("[server] Error decoding CONFIG_UPDATE: %s", err)
+				if err := s.sendError(writer, data, pdu.ERROR_MALFORMED_PAYLOAD, err.Error()); err != nil {
+					return err
+				}
+				continue
 			}
-			ackBytes, _ := json.Marshal(ackData)
-			ackPdu := pdu.PDU{
-				Mtype:  pdu.TYPE_CONFIG_ACK,
-				Length: uint16(len(ackBytes)),
-				Data:   ackBytes,
+			// Send CONFIG_ACK
+			if err := writer.WriteResponse(data, pdu.TYPE_CONFIG_ACK, s.updateHealthCheckConfig(sess, configUpdate)); err != nil {
+				log.Printf("[server] Error sending CONFIG_ACK: %s", err)
+				return err
 			}
-			ackBytes, _ = pdu.PduToBytes(&ackPdu)
-			stream.Write(ackBytes)
 
 		case pdu.TYPE_TERMINATE:
 			// Acknowledge termination and close the stream
-			ackData := map[string]interface{}{
-				"message": "Session terminated successfully.",
-			}
-			ackBytes, _ := json.Marshal(ackData)
-			ackPdu := pdu.PDU{
-				Mtype:  pdu.TYPE_TERMINATE_ACK,
-				Length: uint16(len(ackBytes)),
-				Data:   ackBytes,
+			sess.setState(next)
+			if err := writer.WriteResponse(data, pdu.TYPE_TERMINATE_ACK, &pdu.TerminatePayload{
+				Message: "Session terminated successfully.",
+			}); err != nil {
+				log.Printf("[server] Error sending TERMINATE_ACK: %s", err)
+				return err
 			}
-			ackBytes, _ = pdu.PduToBytes(&ackPdu)
-			stream.Write(ackBytes)
 			return nil
+		}
+	}
+}
 
-		default:
-			// Handle unknown message types
-			errorData := map[string]interface{}{
-				"error_code":    404,
-				"error_message": "Unknown message type.",
-			}
-			errorBytes, _ := json.Marshal(errorData)
-			errorPdu := pdu.PDU{
-				Mtype:  pdu.TYPE_ERROR,
-				Length: uint16(len(errorBytes)),
-				Data:   errorBytes,
-			}
-			errorBytes, _ = pdu.PduToBytes(&errorPdu)
-			_, err = stream.Write(errorBytes)
-			if err != nil {
-				log.Printf("[server] Error sending error response: %s", err)
+// healthHandler handles a dedicated health stream: HEALTH_REQUESTs from
+// the load balancer and, in push mode, HEALTH_DATA from the server.
+func (s *Server) healthHandler(sess *session, stream quic.Stream, r io.Reader) error {
+	if !sess.waitEstablished() {
+		return nil
+	}
+	reader := pdu.NewReader(r)
+	writer := pdu.NewWriter(stream)
+	s.setTrace(sess, reader, writer, "health")
+	sess.configure(reader, writer)
+	log.Print("[server] Health stream opened")
+	if sess.pushMode {
+		s.startPush(sess, writer)
+	}
+	for {
+		data, err := reader.ReadPDU()
+		if errors.Is(err, pdu.ErrFrameTooLarge) {
+			log.Printf("[server] Rejected PDU on health stream: %s", err)
+			if err := s.sendError(writer, nil, pdu.ERROR_PAYLOAD_TOO_LARGE, err.Error()); err != nil {
 				return err
 			}
-			return nil
+			continue
+		}
+		if errors.Is(err, pdu.ErrMalformedFrame) {
+			return s.abort(sess, stream, writer, nil, pdu.ERROR_MALFORMED_PAYLOAD, err)
+		}
+		if err != nil {
+			log.Printf("[server] Health stream closed: %s", err)
+			return err
+		}
+
+		if _, err := sess.check(data.Mtype); err != nil {
+			return s.abort(sess, stream, writer, data, rejectCode(err), err)
+		}
+		if data.Mtype != pdu.TYPE_HEALTH_REQUEST {
+			// Only health checks may use the health stream
+			err := &transitionError{State: sess.getState(), Mtype: data.Mtype, Code: pdu.ERROR_UNEXPECTED_MESSAGE}
+			return s.abort(sess, stream, writer, data, err.Code, err)
+		}
+		if err := s.sendHealthResponse(sess, writer, data); err != nil {
+			return err
 		}
 	}
 }
 
-// getHealthData retrieves the current health metrics of the server.
-func (s *Server) getHealthData() []byte {
-	// Get the current CPU usage percentage
-	cpuPercent, err := cpu.Percent(0, false)
+// setTrace records the PDUs of one of the session's streams in the trace file, if any.
+func (s *Server) setTrace(sess *session, reader *pdu.Reader, writer *pdu.Writer, stream string) {
+	if s.trace == nil {
+		return
+	}
+	peer := sess.conn.RemoteAddr().String()
+	reader.SetTrace(s.trace, peer, stream)
+	writer.SetTrace(s.trace, peer, stream)
+}
+
+// abort answers a message that ends the session with an ERROR carrying
+// code, then closes the connection. The close carries the same code as
+// its application error code, since it can overtake the ERROR on the stream.
+func (s *Server) abort(sess *session, stream quic.Stream, writer *pdu.Writer, req *pdu.PDU, code int, err error) error {
+	log.Printf("[server] Closing connection (%s): %s", pdu.ErrorName(code), err)
+	s.sendError(writer, req, code, err.Error())
+	stream.Close()
+	sess.end()
+	sess.conn.CloseWithError(quic.ApplicationErrorCode(code), err.Error())
+	return err
+}
+
+// sendHealthResponse answers a HEALTH_REQUEST with the current metrics,
+// or with an ERROR if they can't be sent right now. It only returns an
+// error if the stream failed.
+func (s *Server) sendHealthResponse(sess *session, writer *pdu.Writer, req *pdu.PDU) error {
+	if !sess.allowRequest() {
+		return s.sendError(writer, req, pdu.ERROR_RATE_LIMITED, "Too many requests.")
+	}
+	_, metrics := sess.healthConfig()
+	healthData, err := metrics.collect()
+	if err != nil {
+		log.Printf("[server] Error collecting health data: %s", err)
+		return s.sendError(writer, req, pdu.ERROR_METRIC_UNAVAILABLE, err.Error())
+	}
+	s.assess(healthData, metrics, sess.aggregateWindows)
+	rsp, err := pdu.NewPayloadPDU(pdu.TYPE_HEALTH_RESPONSE, healthData)
 	if err != nil {
-		log.Printf("[server] Error getting CPU usage: %v", err)
-		cpuPercent = []float64{0.0}
+		log.Printf("[server] Error encoding health response: %s", err)
+		return s.sendError(writer, req, pdu.ERROR_INTERNAL, "Failed to encode health data.")
 	}
-	// Get the current memory usage percentage
-	memStat, err := mem.VirtualMemory()
+	rsp.ID = req.ID
+	if err := writer.WritePDU(rsp); err != nil {
+		log.Printf("[server] Error sending health response: %s", err)
+		return err
+	}
+	log.Println("[server] Sent health response")
+	return nil
+}
+
+// sendError sends a TYPE_ERROR PDU with the given code and message in reply to req.
+func (s *Server) sendError(writer *pdu.Writer, req *pdu.PDU, code int, message string) error {
+	err := writer.WriteResponse(req, pdu.TYPE_ERROR, &pdu.ErrorPayload{
+		ErrorCode:    code,
+		ErrorMessage: message,
+	})
 	if err != nil {
-		log.Printf("[server] Error getting memory usage: %v", err)
-		memStat = &mem.VirtualMemoryStat{}
-	}
-	memPercent := memStat.UsedPercent
-	healthData := map[string]interface{}{
-		"timestamp": time.Now().Format(time.RFC3339),
-		"metrics": map[string]float64{
-			"cpu_usage_percent":    cpuPercent[0],
-			"memory_usage_percent": memPercent,
-		},
-	}
-	jsonData, _ := json.Marshal(healthData)
-	return jsonData
-}
-
-// updateHealthCheckConfig updates the health check configuration with the new metrics and interval.
-func (s *Server) updateHealthCheckConfig(newMetrics []string, newCheckInterval int) {
-	// Update health check configuration with the new metrics and interval
-	log.Printf("[server] Updated health check configuration: metrics=%v, interval=%d", newMetrics, newCheckInterval)
-	// Implement the logic to update the server's health check configuration
+		log.Printf("[server] Error sending error response: %s", err)
+	}
+	return err
+}
+
+// updateHealthCheckConfig applies a CONFIG_UPDATE to the session and
+// returns the CONFIG_ACK saying what was accepted. Unknown metrics are
+// left out; if none of the requested metrics are known, the session
+// keeps its configuration.
+func (s *Server) updateHealthCheckConfig(sess *session, update *pdu.ConfigUpdatePayload) *pdu.ConfigAckPayload {
+	checkInterval, metrics := sess.healthConfig()
+	ack := &pdu.ConfigAckPayload{UpdateStatus: pdu.CONFIG_STATUS_SUCCESS, Message: "Configuration updated successfully."}
+	if len(update.NewMetrics) > 0 {
+		sel := selectMetrics(update.NewMetrics, len(s.cfg.Probes) > 0)
+		ack.RejectedMetrics = sel.unknown
+		if len(sel.confirmed) == 0 {
+			ack.UpdateStatus = pdu.CONFIG_STATUS_REJECTED
+			ack.Message = "None of the requested metrics are known."
+			ack.CheckInterval = checkInterval
+			ack.Metrics = metrics.confirmed
+			log.Printf("[server] Rejected configuration update: unknown metrics %v", sel.unknown)
+			return ack
+		}
+		if len(sel.unknown) > 0 {
+			ack.UpdateStatus = pdu.CONFIG_STATUS_PARTIAL
+			ack.Message = "Configuration updated without unknown metrics."
+		}
+		metrics = sel
+	}
+	if update.NewCheckInterval > 0 {
+		checkInterval = update.NewCheckInterval
+	}
+	sess.setHealthConfig(checkInterval, metrics)
+	ack.CheckInterval = checkInterval
+	ack.Metrics = metrics.confirmed
+	log.Printf("[server] Updated health check configuration: metrics=%v, interval=%d", ack.Metrics, ack.CheckInterval)
+	return ack
 }
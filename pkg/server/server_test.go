@@ -0,0 +1,452 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/conformance"
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+func TestMain(m *testing.M) {
+	// Tests sign their HELLO tokens with util.GenerateJWT, so they need
+	// the same secret as the server
+	util.SetJWTSecret([]byte("test-secret"))
+	os.Exit(m.Run())
+}
+
+// serveTestServer runs s on a loopback port and returns its address.
+func serveTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func TestQlogPerConnection(t *testing.T) {
+	dir := t.TempDir()
+	addr := serveTestServer(t, NewServer(ServerConfig{ServerID: "server-4243", GenTLS: true, Port: 4243, QlogDir: dir}))
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		client, err := quic.DialAddr(ctx, addr, util.BuildTLSClientConfig(), &quic.Config{})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.CloseWithError(0, "")
+	}
+	// The files are flushed once the server notices the connections closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "server-4243_*_server.qlog"))
+		if len(files) == 2 && nonEmpty(files) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got qlog files %v, want one non-empty file per connection", files)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func nonEmpty(files []string) bool {
+	for _, f := range files {
+		if info, err := os.Stat(f); err != nil || info.Size() == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestZeroRTTResumption(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	tlsConf := util.BuildTLSClientConfig()
+	tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	hello := &pdu.HelloPayload{AuthToken: util.GenerateJWT("test"), MinVersion: 1, MaxVersion: pdu.MAX_PROTOCOL_VERSION}
+
+	// openControl dials the server and sends HELLO without waiting for the handshake
+	openControl := func() (quic.EarlyConnection, *pdu.Reader, *pdu.Writer) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, &quic.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.CloseWithError(0, "") })
+		stream, err := conn.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		pdu.WriteStreamType(stream, pdu.STREAM_CONTROL)
+		reader, writer := pdu.NewReader(stream), pdu.NewWriter(stream)
+		if err := writer.WritePayload(pdu.TYPE_HELLO, hello); err != nil {
+			t.Fatal(err)
+		}
+		if ack, err := reader.ReadPDU(); err != nil || ack.Mtype != pdu.TYPE_ACK {
+			t.Fatalf("HELLO got %v, %v; want ACK", ack, err)
+		}
+		reader.SetCodec(pdu.JsonCodec)
+		return conn, reader, writer
+	}
+
+	// The first connection gets a session ticket
+	first, _, _ := openControl()
+	<-first.HandshakeComplete()
+	time.Sleep(100 * time.Millisecond)
+	first.CloseWithError(0, "")
+
+	conn, reader, writer := openControl()
+	<-conn.HandshakeComplete()
+	if state := conn.ConnectionState(); !state.TLS.DidResume || !state.Used0RTT {
+		t.Fatalf("second connection resumed: %t, used 0-RTT: %t; want both", state.TLS.DidResume, state.Used0RTT)
+	}
+	// Messages that aren't safe in early data are still served once the handshake is done
+	if err := writer.WritePayload(pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if rsp, err := reader.ReadPDU(); err != nil || rsp.Mtype != pdu.TYPE_CONFIG_ACK {
+		t.Fatalf("CONFIG_UPDATE got %v, %v; want CONFIG_ACK", rsp, err)
+	}
+}
+
+func TestTransportConfig(t *testing.T) {
+	const idleTimeout = 300 * time.Millisecond
+	dial := func(t *testing.T, transport util.TransportConfig) quic.Connection {
+		addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, TransportConfig: transport}))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, addr, util.BuildTLSClientConfig(), &quic.Config{MaxIdleTimeout: idleTimeout, EnableDatagrams: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.CloseWithError(0, "") })
+		return conn
+	}
+
+	t.Run("keep-alive", func(t *testing.T) {
+		conn := dial(t, util.TransportConfig{MaxIdleTimeout: idleTimeout, KeepAlivePeriod: idleTimeout / 3})
+		select {
+		case <-conn.Context().Done():
+			t.Fatalf("connection closed despite keep-alives: %v", context.Cause(conn.Context()))
+		case <-time.After(4 * idleTimeout):
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn := dial(t, util.TransportConfig{MaxIdleTimeout: idleTimeout})
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(10 * idleTimeout):
+			t.Fatal("idle connection wasn't closed")
+		}
+		var idleErr *quic.IdleTimeoutError
+		if err := context.Cause(conn.Context()); !errors.As(err, &idleErr) {
+			t.Fatalf("connection closed with %v, want an idle timeout", err)
+		}
+	})
+
+	t.Run("datagrams", func(t *testing.T) {
+		conn := dial(t, util.TransportConfig{DisableDatagrams: true})
+		if conn.ConnectionState().SupportsDatagrams {
+			t.Fatal("datagrams are enabled")
+		}
+	})
+}
+
+// openTestSession dials the server at addr and completes HELLO/ACK on the
+// control stream, returning the ACK and the stream's reader and writer.
+func openTestSession(t *testing.T, addr string, hello *pdu.HelloPayload) (*pdu.AckPayload, *pdu.Reader, *pdu.Writer) {
+	t.Helper()
+	rsp, reader, writer, err := sendTestHello(t, addr, hello)
+	if err != nil || rsp.Mtype != pdu.TYPE_ACK {
+		t.Fatalf("HELLO got %v, %v; want ACK", rsp, err)
+	}
+	ack := &pdu.AckPayload{}
+	if err := pdu.DecodePayload(rsp.Data, ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack, reader, writer
+}
+
+// sendTestHello dials the server at addr and sends HELLO on the control
+// stream, authenticated as "test" unless it carries a token. It returns
+// the answer, the stream's reader and writer, and the error reading the
+// answer.
+func sendTestHello(t *testing.T, addr string, hello *pdu.HelloPayload) (*pdu.PDU, *pdu.Reader, *pdu.Writer, error) {
+	t.Helper()
+	p := conformance.Dial(t, conformance.Target{Addr: addr})
+	if !pdu.UsesStreamPreamble(hello.MaxVersion) {
+		p.Control = p.Open(-1)
+	}
+	p.Control.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader, writer := p.Control.Reader(), p.Control.Writer()
+	if hello.AuthToken == "" {
+		hello.AuthToken = util.GenerateJWT("test")
+	}
+	hello.MinVersion = pdu.MIN_PROTOCOL_VERSION
+	hello.Codecs = []string{pdu.CODEC_JSON}
+	if err := writer.WritePayload(pdu.TYPE_HELLO, hello); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := reader.ReadPDU()
+	return rsp, reader, writer, err
+}
+
+func TestConfigUpdate(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	ack, reader, writer := openTestSession(t, addr, &pdu.HelloPayload{
+		SupportedMetrics: []string{"cpu"},
+		CheckInterval:    5,
+		MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+	})
+	if !slices.Equal(ack.ConfirmedMetrics, []string{"cpu"}) {
+		t.Fatalf("ACK confirmed %v, want [cpu]", ack.ConfirmedMetrics)
+	}
+
+	update := func(id uint32, payload *pdu.ConfigUpdatePayload) *pdu.ConfigAckPayload {
+		t.Helper()
+		msg, _ := pdu.NewPayloadPDU(pdu.TYPE_CONFIG_UPDATE, payload)
+		msg.ID = id
+		if err := writer.WritePDU(msg); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := reader.ReadPDU()
+		if err != nil || rsp.Mtype != pdu.TYPE_CONFIG_ACK || rsp.ID != id {
+			t.Fatalf("CONFIG_UPDATE got %v, %v; want CONFIG_ACK %d", rsp, err, id)
+		}
+		configAck := &pdu.ConfigAckPayload{}
+		if err := pdu.DecodePayload(rsp.Data, configAck); err != nil {
+			t.Fatal(err)
+		}
+		return configAck
+	}
+
+	configAck := update(2, &pdu.ConfigUpdatePayload{NewMetrics: []string{"goroutines", "bogus"}, NewCheckInterval: 7})
+	if configAck.UpdateStatus != pdu.CONFIG_STATUS_PARTIAL || configAck.CheckInterval != 7 ||
+		!slices.Equal(configAck.Metrics, []string{"goroutines"}) || !slices.Equal(configAck.RejectedMetrics, []string{"bogus"}) {
+		t.Fatalf("CONFIG_ACK = %+v, want partial with interval 7, metrics [goroutines] and [bogus] rejected", configAck)
+	}
+	// Later health checks report the new metrics
+	writer.WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 3})
+	rsp, err := reader.ReadPDU()
+	if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_RESPONSE {
+		t.Fatalf("HEALTH_REQUEST got %v, %v; want HEALTH_RESPONSE", rsp, err)
+	}
+	healthData := &pdu.HealthResponsePayload{}
+	pdu.DecodePayload(rsp.Data, healthData)
+	if _, ok := healthData.Metrics["goroutines"]; !ok || len(healthData.Metrics) != 1 {
+		t.Fatalf("HEALTH_RESPONSE metrics %v, want only goroutines", healthData.Metrics)
+	}
+
+	// An update with no known metrics changes nothing
+	configAck = update(4, &pdu.ConfigUpdatePayload{NewMetrics: []string{"bogus"}, NewCheckInterval: 9})
+	if configAck.UpdateStatus != pdu.CONFIG_STATUS_REJECTED || configAck.CheckInterval != 7 || !slices.Equal(configAck.Metrics, []string{"goroutines"}) {
+		t.Fatalf("CONFIG_ACK = %+v, want rejected with interval 7 and metrics [goroutines]", configAck)
+	}
+}
+
+func TestConfigUpdateChangesPushInterval(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	// Without a health stream, pushes share the control stream
+	ack, reader, writer := openTestSession(t, addr, &pdu.HelloPayload{
+		CheckInterval: 60,
+		PushMode:      true,
+		MaxVersion:    pdu.PROTOCOL_VERSION_4,
+	})
+	if !ack.PushMode {
+		t.Fatal("server didn't agree to push")
+	}
+	msg, _ := pdu.NewPayloadPDU(pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 1})
+	msg.ID = 2
+	writer.WritePDU(msg)
+	start := time.Now()
+	for _, want := range []uint8{pdu.TYPE_CONFIG_ACK, pdu.TYPE_HEALTH_DATA} {
+		rsp, err := reader.ReadPDU()
+		if err != nil || rsp.Mtype != want {
+			t.Fatalf("got %v, %v; want %s", rsp, err, pdu.NewPDU(want, nil).GetTypeAsString())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("first push after the update took %s, want about a second", elapsed)
+	}
+}
+
+func TestNewHealthStreamTakesOverPushes(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	p := conformance.Dial(t, conformance.Target{Addr: addr})
+	ack := p.Hello(&pdu.HelloPayload{
+		CheckInterval: 1,
+		PushMode:      true,
+		AuthToken:     util.GenerateJWT("test"),
+		MinVersion:    pdu.MIN_PROTOCOL_VERSION,
+		MaxVersion:    pdu.MAX_PROTOCOL_VERSION,
+	})
+	if !ack.PushMode {
+		t.Fatal("server didn't agree to push")
+	}
+	expectPush := func(s *conformance.Stream) {
+		t.Helper()
+		s.SetReadDeadline(time.Now().Add(3 * time.Second))
+		rsp, err := s.Reader().ReadPDU()
+		if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_DATA {
+			t.Fatalf("got %v, %v; want HEALTH_DATA", rsp, err)
+		}
+	}
+	first := p.OpenHealth()
+	expectPush(first)
+	second := p.OpenHealth()
+	expectPush(second)
+
+	// One push may have been on its way when the second stream opened
+	first.SetReadDeadline(time.Now().Add(2500 * time.Millisecond))
+	pushes := 0
+	for {
+		if _, err := first.Reader().ReadPDU(); err != nil {
+			break
+		}
+		pushes++
+	}
+	if pushes > 1 {
+		t.Fatalf("first health stream got %d pushes after the second opened, want it to stop", pushes)
+	}
+	expectPush(second)
+}
+
+func TestVersionFallback(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, MaxVersion: pdu.PROTOCOL_VERSION_3}))
+	for _, test := range []struct {
+		name  string
+		hello *pdu.HelloPayload
+		want  int
+	}{
+		{"newer load balancer", &pdu.HelloPayload{MaxVersion: pdu.MAX_PROTOCOL_VERSION}, pdu.PROTOCOL_VERSION_3},
+		{"older load balancer", &pdu.HelloPayload{MaxVersion: pdu.PROTOCOL_VERSION_2}, pdu.PROTOCOL_VERSION_2},
+		{"single legacy version", &pdu.HelloPayload{Version: pdu.PROTOCOL_VERSION_1}, pdu.PROTOCOL_VERSION_1},
+	} {
+		if ack, _, _ := openTestSession(t, addr, test.hello); ack.Version != test.want {
+			t.Errorf("%s: ACK version %d, want %d", test.name, ack.Version, test.want)
+		}
+	}
+
+	// Without a common version the ERROR tells the load balancer what the server speaks
+	p := conformance.Dial(t, conformance.Target{Addr: addr})
+	p.Control.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p.Control.Writer().WritePayload(pdu.TYPE_HELLO, &pdu.HelloPayload{
+		AuthToken:  util.GenerateJWT("test"),
+		MinVersion: pdu.PROTOCOL_VERSION_4,
+		MaxVersion: pdu.MAX_PROTOCOL_VERSION,
+	})
+	rsp, err := p.Control.Reader().ReadPDU()
+	if err != nil || rsp.Mtype != pdu.TYPE_ERROR {
+		t.Fatalf("HELLO got %v, %v; want ERROR", rsp, err)
+	}
+	errorData := &pdu.ErrorPayload{}
+	pdu.DecodePayload(rsp.Data, errorData)
+	if errorData.ErrorCode != pdu.ERROR_UNSUPPORTED_VERSION ||
+		errorData.MinVersion != pdu.MIN_PROTOCOL_VERSION || errorData.MaxVersion != pdu.PROTOCOL_VERSION_3 {
+		t.Fatalf("ERROR = %+v, want ERROR_UNSUPPORTED_VERSION with versions [%d, %d]",
+			errorData, pdu.MIN_PROTOCOL_VERSION, pdu.PROTOCOL_VERSION_3)
+	}
+}
+
+func TestPduSizeNegotiation(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, MaxPduSize: 64 << 10}))
+	for _, test := range []struct {
+		name  string
+		hello *pdu.HelloPayload
+		want  int
+	}{
+		{"larger request", &pdu.HelloPayload{MaxPduSize: 1 << 20, MaxVersion: pdu.MAX_PROTOCOL_VERSION}, 64 << 10},
+		{"smaller request", &pdu.HelloPayload{MaxPduSize: 8 << 10, MaxVersion: pdu.MAX_PROTOCOL_VERSION}, 8 << 10},
+		{"no request", &pdu.HelloPayload{MaxVersion: pdu.MAX_PROTOCOL_VERSION}, pdu.MAX_PDU_SIZE},
+		// Version 2 has no max_pdu_size, so the ACK leaves it out
+		{"version 2", &pdu.HelloPayload{MaxPduSize: 1 << 20, MaxVersion: pdu.PROTOCOL_VERSION_2}, 0},
+	} {
+		if ack, _, _ := openTestSession(t, addr, test.hello); ack.MaxPduSize != test.want {
+			t.Errorf("%s: ACK max_pdu_size %d, want %d", test.name, ack.MaxPduSize, test.want)
+		}
+	}
+}
+
+func TestHealthStream(t *testing.T) {
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	p := conformance.Dial(t, conformance.Target{Addr: addr})
+	// A health stream opened ahead of HELLO is served once the session is up
+	early := p.Open(pdu.STREAM_HEALTH)
+	early.Writer().WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 7})
+	p.Hello(&pdu.HelloPayload{
+		SupportedMetrics: []string{"cpu"},
+		AuthToken:        util.GenerateJWT("test"),
+		MinVersion:       pdu.MIN_PROTOCOL_VERSION,
+		MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+	})
+	// A stream of an unknown type is turned away without hurting the session
+	p.Open(0x7f).Writer().WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 8})
+
+	health := p.OpenHealth()
+	health.Writer().WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 9})
+	for _, test := range []struct {
+		s  *conformance.Stream
+		id uint32
+	}{{early, 7}, {health, 9}} {
+		test.s.SetReadDeadline(time.Now().Add(10 * time.Second))
+		rsp, err := test.s.Reader().ReadPDU()
+		if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_RESPONSE || rsp.ID != test.id {
+			t.Fatalf("health stream got %v, %v; want HEALTH_RESPONSE %d", rsp, err, test.id)
+		}
+	}
+}
+
+func TestAckAdvertisesCapacity(t *testing.T) {
+	labels := map[string]string{"zone": "us-east-1a", "role": "api"}
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, Weight: 3, MaxConnections: 500, Labels: labels}))
+	ack, _, _ := openTestSession(t, addr, &pdu.HelloPayload{CheckInterval: 5, MaxVersion: pdu.MAX_PROTOCOL_VERSION})
+	if ack.Weight != 3 || ack.MaxConnections != 500 || !maps.Equal(ack.Labels, labels) {
+		t.Errorf("ACK advertises weight %d, max connections %d, labels %v; want 3, 500, %v", ack.Weight, ack.MaxConnections, ack.Labels, labels)
+	}
+}
+
+func TestCheckAdvertised(t *testing.T) {
+	manyLabels := make(map[string]string)
+	for i := range 20 {
+		manyLabels[fmt.Sprintf("label-%d", i)] = strings.Repeat("v", 30)
+	}
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: "no labels"},
+		{name: "a few labels", labels: map[string]string{"zone": "us-east-1a", "role": "api", "version": "1.4.2"}},
+		{name: "labels that don't fit", labels: manyLabels, wantErr: true},
+		{name: "empty label key", labels: map[string]string{"": "x"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The longest hostname DNS allows
+			s := &Server{cfg: ServerConfig{Weight: 3, MaxConnections: 500, Labels: test.labels},
+				id: "web-1", hostname: strings.Repeat("h", 253), instanceID: randomHex(8), startedAt: time.Now()}
+			if err := s.checkAdvertised(); (err != nil) != test.wantErr {
+				t.Errorf("checkAdvertised() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
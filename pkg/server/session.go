@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"github.com/quic-go/quic-go"
+)
+
+// maxRequestsPerSecond caps the HEALTH_REQUESTs and CONFIG_UPDATEs a
+// session may send per second, across all its streams.
+const maxRequestsPerSecond = 10
+
+// session holds the state that all streams of one load balancer
+// connection share once HELLO/ACK has completed on the control stream.
+type session struct {
+	conn quic.Connection
+	// established is closed once the ACK has been sent.
+	established chan struct{}
+	// done is closed when the session ends, stopping background work.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mu    sync.Mutex
+	state sessionState
+	// requests counts the requests received since windowStart
+	windowStart time.Time
+	requests    int
+	// checkInterval and metrics are set by HELLO and changed by CONFIG_UPDATE
+	checkInterval int
+	metrics       *metricSelection
+	// push is the session's running push loop, if any.
+	push *pushLoop
+
+	// Set before established is closed and read-only afterwards
+	loadBalancer   string
+	establishedAt  time.Time
+	version        int
+	codec          pdu.Codec
+	maxPduSize     int
+	pushMode       bool
+	pushThresholds map[string]float64
+	// aggregateWindows are the windows health reports carry aggregates over.
+	aggregateWindows []string
+}
+
+// newSession creates the session for a newly accepted connection.
+func newSession(conn quic.Connection) *session {
+	return &session{
+		conn:        conn,
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// addSession enters sess in the session table as the session of the load
+// balancer that authenticated as lbID. An earlier session of the same load
+// balancer is closed and replaced. It fails if the server already has
+// MaxSessions other sessions.
+func (s *Server) addSession(lbID string, sess *session) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	old := s.sessions[lbID]
+	if old == nil && s.cfg.MaxSessions > 0 && len(s.sessions) >= s.cfg.MaxSessions {
+		return fmt.Errorf("server is at its limit of %d sessions", s.cfg.MaxSessions)
+	}
+	if old != nil {
+		log.Printf("[server] Load balancer %s reconnected from %s, closing its session from %s",
+			lbID, sess.conn.RemoteAddr(), old.conn.RemoteAddr())
+		old.end()
+		old.conn.CloseWithError(0, "replaced by a newer session")
+	}
+	sess.loadBalancer = lbID
+	s.sessions[lbID] = sess
+	return nil
+}
+
+// hasSession reports whether the load balancer that authenticated as lbID
+// has a session.
+func (s *Server) hasSession(lbID string) bool {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	_, ok := s.sessions[lbID]
+	return ok
+}
+
+// removeSession takes sess out of the session table, unless it was
+// already replaced.
+func (s *Server) removeSession(sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if sess.loadBalancer != "" && s.sessions[sess.loadBalancer] == sess {
+		delete(s.sessions, sess.loadBalancer)
+		log.Printf("[server] Session with load balancer %s ended", sess.loadBalancer)
+	}
+}
+
+// end stops the session's background work and moves it to
+// STATE_TERMINATING. It is safe to call more than once.
+func (sess *session) end() {
+	sess.doneOnce.Do(func() {
+		sess.setState(STATE_TERMINATING)
+		close(sess.done)
+	})
+}
+
+// getState returns the session's current state.
+func (sess *session) getState() sessionState {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.state
+}
+
+// setState moves the session to state st.
+func (sess *session) setState(st sessionState) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.state = st
+}
+
+// healthConfig returns the session's check interval in seconds and the
+// metrics it reports.
+func (sess *session) healthConfig() (int, *metricSelection) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.checkInterval, sess.metrics
+}
+
+// setHealthConfig changes the session's check interval and metrics, and
+// lets a running push loop know.
+func (sess *session) setHealthConfig(checkInterval int, metrics *metricSelection) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.checkInterval = checkInterval
+	sess.metrics = metrics
+	if sess.push == nil {
+		return
+	}
+	select {
+	case sess.push.reconfigured <- struct{}{}:
+	default:
+	}
+}
+
+// allowRequest counts a request against the session's rate limit and
+// reports whether it may be served.
+func (sess *session) allowRequest() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	now := time.Now()
+	if now.Sub(sess.windowStart) >= time.Second {
+		sess.windowStart = now
+		sess.requests = 0
+	}
+	sess.requests++
+	return sess.requests <= maxRequestsPerSecond
+}
+
+// check returns the state the session moves to on a message of type
+// mtype, or a *transitionError if the message isn't allowed right now.
+func (sess *session) check(mtype uint8) (sessionState, error) {
+	return nextState(sess.getState(), mtype)
+}
+
+// waitEstablished blocks until HELLO/ACK completes. It returns false if
+// the session ends first.
+func (sess *session) waitEstablished() bool {
+	select {
+	case <-sess.established:
+		return true
+	case <-sess.done:
+		return false
+	}
+}
+
+// waitHandshake blocks until the TLS handshake completes, so that
+// nothing that came in as 0-RTT data is acted on before the load balancer
+// is known not to be a replay. It returns false if the handshake failed
+// or the session ended first.
+func (sess *session) waitHandshake() bool {
+	early, ok := sess.conn.(quic.EarlyConnection)
+	if !ok {
+		return true
+	}
+	select {
+	case <-early.HandshakeComplete():
+		return early.Context().Err() == nil
+	case <-sess.done:
+		return false
+	}
+}
+
+// configure applies the agreed codec and PDU size to a stream's reader and writer.
+func (sess *session) configure(reader *pdu.Reader, writer *pdu.Writer) {
+	reader.SetCodec(sess.codec)
+	writer.SetCodec(sess.codec)
+	reader.SetMaxPduSize(sess.maxPduSize)
+	writer.SetMaxPduSize(sess.maxPduSize)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// sessionState is where a session is in the protocol.
+type sessionState int
+
+const (
+	// STATE_AWAIT_HELLO is the state of a new connection until HELLO/ACK.
+	STATE_AWAIT_HELLO sessionState = iota
+	// STATE_ESTABLISHED is the state of a session that can be polled and
+	// reconfigured.
+	STATE_ESTABLISHED
+	// STATE_TERMINATING is the state of a session after TERMINATE. Nothing
+	// more is accepted.
+	STATE_TERMINATING
+)
+
+func (st sessionState) String() string {
+	switch st {
+	case STATE_AWAIT_HELLO:
+		return "AWAIT_HELLO"
+	case STATE_ESTABLISHED:
+		return "ESTABLISHED"
+	case STATE_TERMINATING:
+		return "TERMINATING"
+	default:
+		return fmt.Sprintf("sessionState(%d)", int(st))
+	}
+}
+
+// transitionError is returned for a message the session may not receive
+// in its current state. Code is the error_code to answer with.
+type transitionError struct {
+	State sessionState
+	Mtype uint8
+	Code  int
+}
+
+func (e *transitionError) Error() string {
+	if e.Code == pdu.ERROR_UNKNOWN_TYPE {
+		return fmt.Sprintf("unknown message type %d", e.Mtype)
+	}
+	msg := &pdu.PDU{Mtype: e.Mtype}
+	return fmt.Sprintf("%s not allowed in state %s", msg.GetTypeAsString(), e.State)
+}
+
+// rejectCode returns the error_code to answer a message with that failed
+// a session's check with err. Errors other than transitionError are the
+// server's own fault.
+func rejectCode(err error) int {
+	var te *transitionError
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return pdu.ERROR_INTERNAL
+}
+
+// nextState returns the state a session in state st moves to when it
+// receives a message of type mtype from the load balancer.
+//
+//	AWAIT_HELLO --HELLO--> ESTABLISHED
+//	ESTABLISHED --HEALTH_REQUEST, CONFIG_UPDATE--> ESTABLISHED
+//	ESTABLISHED --TERMINATE--> TERMINATING
+//
+// Any other message is illegal and returns a *transitionError.
+func nextState(st sessionState, mtype uint8) (sessionState, error) {
+	if mtype > pdu.TYPE_TERMINATE_ACK {
+		return st, &transitionError{State: st, Mtype: mtype, Code: pdu.ERROR_UNKNOWN_TYPE}
+	}
+	switch {
+	case st == STATE_AWAIT_HELLO && mtype == pdu.TYPE_HELLO:
+		return STATE_ESTABLISHED, nil
+	case st == STATE_ESTABLISHED && (mtype == pdu.TYPE_HEALTH_REQUEST || mtype == pdu.TYPE_CONFIG_UPDATE):
+		return STATE_ESTABLISHED, nil
+	case st == STATE_ESTABLISHED && mtype == pdu.TYPE_TERMINATE:
+		return STATE_TERMINATING, nil
+	}
+	return st, &transitionError{State: st, Mtype: mtype, Code: pdu.ERROR_UNEXPECTED_MESSAGE}
+}
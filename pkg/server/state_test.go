@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/conformance"
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+)
+
+func TestNextState(t *testing.T) {
+	legal := map[sessionState]map[uint8]sessionState{
+		STATE_AWAIT_HELLO: {
+			pdu.TYPE_HELLO: STATE_ESTABLISHED,
+		},
+		STATE_ESTABLISHED: {
+			pdu.TYPE_HEALTH_REQUEST: STATE_ESTABLISHED,
+			pdu.TYPE_CONFIG_UPDATE:  STATE_ESTABLISHED,
+			pdu.TYPE_TERMINATE:      STATE_TERMINATING,
+		},
+		STATE_TERMINATING: {},
+	}
+	for st, allowed := range legal {
+		for mtype := 0; mtype <= 255; mtype++ {
+			next, err := nextState(st, uint8(mtype))
+			want, ok := allowed[uint8(mtype)]
+			if ok {
+				if err != nil || next != want {
+					t.Errorf("nextState(%s, %d) = %s, %v; want %s", st, mtype, next, err, want)
+				}
+				continue
+			}
+			var te *transitionError
+			if !errors.As(err, &te) {
+				t.Errorf("nextState(%s, %d) = %s, %v; want a transition error", st, mtype, next, err)
+				continue
+			}
+			wantCode := pdu.ERROR_UNEXPECTED_MESSAGE
+			if mtype > pdu.TYPE_TERMINATE_ACK {
+				wantCode = pdu.ERROR_UNKNOWN_TYPE
+			}
+			if te.Code != wantCode || next != st {
+				t.Errorf("nextState(%s, %d) = %s, code %d; want %s, code %d", st, mtype, next, te.Code, st, wantCode)
+			}
+		}
+	}
+}
+
+func TestRejectCode(t *testing.T) {
+	_, err := nextState(STATE_AWAIT_HELLO, pdu.TYPE_CONFIG_UPDATE)
+	if code := rejectCode(fmt.Errorf("checking: %w", err)); code != pdu.ERROR_UNEXPECTED_MESSAGE {
+		t.Errorf("wrapped transition error got code %d, want %d", code, pdu.ERROR_UNEXPECTED_MESSAGE)
+	}
+	if code := rejectCode(errors.New("something else")); code != pdu.ERROR_INTERNAL {
+		t.Errorf("other error got code %d, want %d", code, pdu.ERROR_INTERNAL)
+	}
+}
+
+func TestSessionEndTerminates(t *testing.T) {
+	sess := newSession(nil)
+	if st := sess.getState(); st != STATE_AWAIT_HELLO {
+		t.Fatalf("new session in state %s, want AWAIT_HELLO", st)
+	}
+	sess.setState(STATE_ESTABLISHED)
+	sess.end()
+	sess.end()
+	if st := sess.getState(); st != STATE_TERMINATING {
+		t.Fatalf("ended session in state %s, want TERMINATING", st)
+	}
+	if sess.waitEstablished() {
+		t.Fatal("waitEstablished returned true for a session that ended first")
+	}
+}
+
+// testPeer is a load balancer side connection to a test server.
+type testPeer struct {
+	*conformance.Peer
+	t *testing.T
+}
+
+// dialTestServer starts a server on a loopback port and opens a control
+// stream to it.
+func dialTestServer(t *testing.T) *testPeer {
+	t.Helper()
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true}))
+	return &testPeer{Peer: conformance.Dial(t, conformance.Target{Addr: addr}), t: t}
+}
+
+// exchange sends a PDU of type mtype on s and returns the reply, or the
+// error that ended the stream.
+func (p *testPeer) exchange(s *conformance.Stream, mtype uint8, payload pdu.Payload) (*pdu.PDU, error) {
+	p.t.Helper()
+	msg := pdu.NewPDU(mtype, nil)
+	if payload != nil {
+		var err error
+		if msg, err = pdu.NewPayloadPDU(mtype, payload); err != nil {
+			p.t.Fatal(err)
+		}
+	}
+	msg.ID = 7
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := s.Writer().WritePDU(msg); err != nil {
+		return nil, err
+	}
+	return s.Reader().ReadPDU()
+}
+
+func (p *testPeer) hello() {
+	p.t.Helper()
+	p.Hello(&pdu.HelloPayload{
+		CheckInterval: 5,
+		AuthToken:     util.GenerateJWT("test"),
+		MinVersion:    pdu.MIN_PROTOCOL_VERSION,
+		MaxVersion:    pdu.MAX_PROTOCOL_VERSION,
+		Codecs:        []string{pdu.CODEC_BINARY},
+	})
+}
+
+// expectReply checks that rsp is a reply of type want.
+func (p *testPeer) expectReply(rsp *pdu.PDU, err error, want uint8) {
+	p.t.Helper()
+	if err != nil {
+		p.t.Fatalf("got error %v, want %s", err, (&pdu.PDU{Mtype: want}).GetTypeAsString())
+	}
+	if rsp.Mtype != want || rsp.ID != 7 {
+		p.t.Fatalf("got %s (id %d), want %s (id 7)", rsp.GetTypeAsString(), rsp.ID, (&pdu.PDU{Mtype: want}).GetTypeAsString())
+	}
+}
+
+// expectRejected checks that the server answered with an ERROR carrying
+// code and then closed the connection with the same code.
+func (p *testPeer) expectRejected(rsp *pdu.PDU, err error, code int) {
+	p.t.Helper()
+	if err == nil {
+		if rsp.Mtype != pdu.TYPE_ERROR {
+			p.t.Fatalf("got %s, want ERROR %d", rsp.GetTypeAsString(), code)
+		}
+		errorData := &pdu.ErrorPayload{}
+		if err := pdu.DecodePayload(rsp.Data, errorData); err != nil {
+			p.t.Fatal(err)
+		}
+		if errorData.ErrorCode != code {
+			p.t.Fatalf("got ERROR %d, want %d", errorData.ErrorCode, code)
+		}
+	}
+	p.ExpectClosed(code)
+}
+
+func TestAwaitHelloRejectsOtherMessages(t *testing.T) {
+	for _, mtype := range []uint8{pdu.TYPE_HEALTH_REQUEST, pdu.TYPE_CONFIG_UPDATE, pdu.TYPE_TERMINATE, pdu.TYPE_ACK} {
+		p := dialTestServer(t)
+		rsp, err := p.exchange(p.Control, mtype, nil)
+		p.expectRejected(rsp, err, pdu.ERROR_UNEXPECTED_MESSAGE)
+	}
+}
+
+func TestAwaitHelloRejectsUnknownType(t *testing.T) {
+	p := dialTestServer(t)
+	rsp, err := p.exchange(p.Control, 42, nil)
+	p.expectRejected(rsp, err, pdu.ERROR_UNKNOWN_TYPE)
+}
+
+func TestEstablishedSession(t *testing.T) {
+	p := dialTestServer(t)
+	p.hello()
+
+	rsp, err := p.exchange(p.Control, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.expectReply(rsp, err, pdu.TYPE_HEALTH_RESPONSE)
+
+	rsp, err = p.exchange(p.Control, pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 10})
+	p.expectReply(rsp, err, pdu.TYPE_CONFIG_ACK)
+
+	health := p.OpenHealth()
+	rsp, err = p.exchange(health, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.expectReply(rsp, err, pdu.TYPE_HEALTH_RESPONSE)
+
+	rsp, err = p.exchange(p.Control, pdu.TYPE_TERMINATE, &pdu.TerminatePayload{})
+	p.expectReply(rsp, err, pdu.TYPE_TERMINATE_ACK)
+
+	// The session is terminating, so the health stream is no longer served
+	rsp, err = p.exchange(health, pdu.TYPE_HEALTH_REQUEST, nil)
+	p.expectRejected(rsp, err, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+func TestEstablishedRejectsSecondHello(t *testing.T) {
+	p := dialTestServer(t)
+	p.hello()
+	rsp, err := p.exchange(p.Control, pdu.TYPE_HELLO, &pdu.HelloPayload{AuthToken: util.GenerateJWT("test"), MinVersion: 1, MaxVersion: 1})
+	p.expectRejected(rsp, err, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+func TestHealthStreamRejectsControlMessages(t *testing.T) {
+	p := dialTestServer(t)
+	p.hello()
+	health := p.OpenHealth()
+	rsp, err := p.exchange(health, pdu.TYPE_CONFIG_UPDATE, &pdu.ConfigUpdatePayload{NewCheckInterval: 10})
+	p.expectRejected(rsp, err, pdu.ERROR_UNEXPECTED_MESSAGE)
+}
+
+func TestAwaitHelloRejectsBadToken(t *testing.T) {
+	p := dialTestServer(t)
+	rsp, err := p.exchange(p.Control, pdu.TYPE_HELLO, &pdu.HelloPayload{AuthToken: "not-a-token", MinVersion: 1, MaxVersion: 1})
+	p.expectRejected(rsp, err, pdu.ERROR_AUTH_FAILED)
+}
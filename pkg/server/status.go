@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// SetReady tells load balancers whether to send the server traffic. A
+// server that isn't ready reports pdu.STATUS_NOT_READY but keeps its
+// sessions, e.g. while the application loads its caches.
+func (s *Server) SetReady(ready bool) {
+	if s.ready.Swap(ready) != ready {
+		log.Printf("[server] Ready: %v", ready)
+	}
+}
+
+// assess runs the probes and adds them, their latency if the session
+// selected it, the aggregates over windows, and the resulting status to
+// health data.
+func (s *Server) assess(healthData *pdu.HealthResponsePayload, metrics *metricSelection, windows []string) {
+	healthData.Aggregates = s.history.aggregates(windows, healthData.Metrics)
+	healthData.Probes = s.runProbes()
+	if latency, ok := slowestProbe(healthData.Probes); ok && metrics.probeLatency {
+		healthData.Metrics[RESPONSE_TIME_METRIC] = latency
+	}
+	healthData.Status, healthData.StatusReason = s.status(healthData)
+}
+
+// status decides what the server reports: draining once it is shutting
+// down, then from worst to best: down if a probe failed, not ready while
+// warming up or held back with SetReady, degraded if a metric or the
+// probes' latency crossed its threshold, and healthy otherwise. Metrics
+// are checked whether or not the session asked for them, so every load
+// balancer gets the same status.
+func (s *Server) status(healthData *pdu.HealthResponsePayload) (string, string) {
+	if s.draining.Load() {
+		return pdu.STATUS_DRAINING, "shutting down"
+	}
+	if failed := healthData.FailedProbes(); len(failed) > 0 {
+		return pdu.STATUS_DOWN, "probe failed: " + strings.Join(failed, ", ")
+	}
+	if !s.ready.Load() {
+		return pdu.STATUS_NOT_READY, "held back by the application"
+	}
+	if remaining := time.Until(s.readyAt); remaining > 0 {
+		return pdu.STATUS_NOT_READY, fmt.Sprintf("warming up for another %s", remaining.Round(time.Second))
+	}
+	if len(s.cfg.DegradedThresholds) == 0 {
+		return pdu.STATUS_HEALTHY, ""
+	}
+	metrics := s.allMetrics()
+	if latency, ok := slowestProbe(healthData.Probes); ok {
+		metrics[RESPONSE_TIME_METRIC] = latency
+	}
+	if over := overThresholds(metrics, s.cfg.DegradedThresholds); len(over) > 0 {
+		return pdu.STATUS_DEGRADED, strings.Join(over, ", ")
+	}
+	return pdu.STATUS_HEALTHY, ""
+}
+
+// allMetrics returns every metric the server has: the latest sample of
+// the metric history, or a fresh collection before the first sample. The
+// map is the caller's.
+func (s *Server) allMetrics() map[string]float64 {
+	if sample, ok := s.history.latest(); ok && sample.metrics != nil {
+		return maps.Clone(sample.metrics)
+	}
+	return collectAll()
+}
+
+// overThresholds lists the metrics at or over their threshold, sorted. A
+// threshold for a per-device metric such as "disk_usage_percent" applies
+// to every device.
+func overThresholds(metrics map[string]float64, thresholds map[string]float64) []string {
+	var over []string
+	for metric, value := range metrics {
+		threshold, ok := thresholds[metric]
+		if !ok {
+			base, _, _ := strings.Cut(metric, ":")
+			threshold, ok = thresholds[base]
+		}
+		if ok && value >= threshold {
+			over = append(over, fmt.Sprintf("%s %.1f over %g", metric, value, threshold))
+		}
+	}
+	sort.Strings(over)
+	return over
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"drexel.edu/net-quic/pkg/pdu"
+	"drexel.edu/net-quic/pkg/util"
+)
+
+func TestStatus(t *testing.T) {
+	thresholds := map[string]float64{"cpu_usage_percent": 90, "disk_usage_percent": 95}
+	tests := []struct {
+		name     string
+		warmUp   time.Duration
+		notReady bool
+		draining bool
+		// metrics are the latest sample; reported are the ones the
+		// session asked for
+		metrics  map[string]float64
+		reported map[string]float64
+		probes   []pdu.ProbeResult
+		status   string
+		reason   string
+	}{
+		{name: "healthy", metrics: map[string]float64{"cpu_usage_percent": 50}, status: pdu.STATUS_HEALTHY},
+		{name: "metric over threshold", metrics: map[string]float64{"cpu_usage_percent": 92.5}, status: pdu.STATUS_DEGRADED, reason: "cpu_usage_percent 92.5 over 90"},
+		{
+			name:     "metric the session didn't ask for",
+			metrics:  map[string]float64{"cpu_usage_percent": 92.5, "memory_usage_percent": 10},
+			reported: map[string]float64{"memory_usage_percent": 10},
+			status:   pdu.STATUS_DEGRADED,
+			reason:   "cpu_usage_percent 92.5 over 90",
+		},
+		{name: "per-device metric over threshold", metrics: map[string]float64{"disk_usage_percent:/": 10, "disk_usage_percent:/var": 97}, status: pdu.STATUS_DEGRADED, reason: "disk_usage_percent:/var 97.0 over 95"},
+		{name: "warming up", warmUp: time.Minute, metrics: map[string]float64{"cpu_usage_percent": 92.5}, status: pdu.STATUS_NOT_READY, reason: "warming up"},
+		{name: "held back", notReady: true, status: pdu.STATUS_NOT_READY, reason: "held back"},
+		{
+			name:     "probe failed",
+			notReady: true,
+			probes:   []pdu.ProbeResult{{Name: "web", Passed: true}, {Name: "db"}, {Name: "queue"}},
+			status:   pdu.STATUS_DOWN,
+			reason:   "probe failed: db, queue",
+		},
+		{
+			name:     "draining",
+			draining: true,
+			probes:   []pdu.ProbeResult{{Name: "db"}},
+			status:   pdu.STATUS_DRAINING,
+			reason:   "shutting down",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(ServerConfig{GenTLS: true, WarmUp: test.warmUp, DegradedThresholds: thresholds})
+			s.SetReady(!test.notReady)
+			if test.draining {
+				s.Drain()
+			}
+			s.history.record(metricSample{at: time.Now(), metrics: test.metrics})
+			status, reason := s.status(&pdu.HealthResponsePayload{Metrics: test.reported, Probes: test.probes})
+			if status != test.status || !strings.HasPrefix(reason, test.reason) {
+				t.Errorf("got %s (%s), want %s (%s)", status, reason, test.status, test.reason)
+			}
+		})
+	}
+}
+
+func TestHealthResponseStatus(t *testing.T) {
+	s := NewServer(ServerConfig{GenTLS: true, WarmUp: time.Second})
+	addr := serveTestServer(t, s)
+	_, reader, writer := openTestSession(t, addr, &pdu.HelloPayload{
+		CheckInterval: 5,
+		MaxVersion:    pdu.MAX_PROTOCOL_VERSION,
+	})
+	request := func(id uint32) *pdu.HealthResponsePayload {
+		t.Helper()
+		writer.WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: id})
+		rsp, err := reader.ReadPDU()
+		if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_RESPONSE {
+			t.Fatalf("HEALTH_REQUEST got %v, %v; want HEALTH_RESPONSE", rsp, err)
+		}
+		healthData := &pdu.HealthResponsePayload{}
+		if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+			t.Fatal(err)
+		}
+		return healthData
+	}
+
+	if healthData := request(2); healthData.Status != pdu.STATUS_NOT_READY {
+		t.Fatalf("status during warm-up = %q, want %q", healthData.Status, pdu.STATUS_NOT_READY)
+	}
+	time.Sleep(time.Until(s.readyAt))
+	if healthData := request(3); healthData.Status != pdu.STATUS_HEALTHY || healthData.StatusReason != "" {
+		t.Fatalf("status after warm-up = %q (%s), want %q", healthData.Status, healthData.StatusReason, pdu.STATUS_HEALTHY)
+	}
+	// Draining servers keep sending health data, saying they are leaving
+	s.Drain()
+	if healthData := request(4); healthData.Status != pdu.STATUS_DRAINING || healthData.StatusReason == "" || len(healthData.Metrics) == 0 {
+		t.Fatalf("status while draining = %q (%s) with %v, want %q with metrics", healthData.Status, healthData.StatusReason, healthData.Metrics, pdu.STATUS_DRAINING)
+	}
+}
+
+func TestStatusIgnoresSessionMetrics(t *testing.T) {
+	// There are always goroutines, so the server is always degraded
+	addr := serveTestServer(t, NewServer(ServerConfig{GenTLS: true, DegradedThresholds: map[string]float64{"goroutines": 1}}))
+	for _, metrics := range [][]string{{"goroutines"}, {"memory"}} {
+		_, reader, writer := openTestSession(t, addr, &pdu.HelloPayload{
+			AuthToken:        util.GenerateJWT("lb-" + metrics[0]),
+			SupportedMetrics: metrics,
+			CheckInterval:    5,
+			MaxVersion:       pdu.MAX_PROTOCOL_VERSION,
+		})
+		writer.WritePDU(&pdu.PDU{Mtype: pdu.TYPE_HEALTH_REQUEST, ID: 2})
+		rsp, err := reader.ReadPDU()
+		if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_RESPONSE {
+			t.Fatalf("HEALTH_REQUEST got %v, %v; want HEALTH_RESPONSE", rsp, err)
+		}
+		healthData := &pdu.HealthResponsePayload{}
+		if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+			t.Fatal(err)
+		}
+		if healthData.Status != pdu.STATUS_DEGRADED || !strings.HasPrefix(healthData.StatusReason, "goroutines") {
+			t.Errorf("session asking for %v got %q (%s), want %q for goroutines", metrics, healthData.Status, healthData.StatusReason, pdu.STATUS_DEGRADED)
+		}
+		// Only what the session asked for is sent back
+		if _, ok := healthData.Metrics["goroutines"]; ok != (metrics[0] == "goroutines") {
+			t.Errorf("session asking for %v got metrics %v", metrics, healthData.Metrics)
+		}
+	}
+}
+
+func TestPushWhileDraining(t *testing.T) {
+	s := NewServer(ServerConfig{GenTLS: true})
+	addr := serveTestServer(t, s)
+	// Without a health stream, pushes share the control stream
+	_, reader, _ := openTestSession(t, addr, &pdu.HelloPayload{
+		CheckInterval: 1,
+		MaxVersion:    pdu.PROTOCOL_VERSION_4,
+		PushMode:      true,
+	})
+	s.Drain()
+	rsp, err := reader.ReadPDU()
+	if err != nil || rsp.Mtype != pdu.TYPE_HEALTH_DATA {
+		t.Fatalf("push while draining got %v, %v; want HEALTH_DATA", rsp, err)
+	}
+	healthData := &pdu.HealthResponsePayload{}
+	if err := pdu.DecodePayload(rsp.Data, healthData); err != nil {
+		t.Fatal(err)
+	}
+	if healthData.Status != pdu.STATUS_DRAINING {
+		t.Errorf("pushed status = %q, want %q", healthData.Status, pdu.STATUS_DRAINING)
+	}
+}
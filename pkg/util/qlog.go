@@ -0,0 +1,53 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// QlogPath returns the path of the qlog file for a connection: name and
+// the original destination connection ID, so that every connection gets
+// a file of its own.
+func QlogPath(dir string, name string, p logging.Perspective, odcid quic.ConnectionID) string {
+	label := "client"
+	if p == logging.PerspectiveServer {
+		label = "server"
+	}
+	// Addresses contain colons, which some file systems don't like
+	name = strings.NewReplacer(":", "_", "/", "_").Replace(name)
+	return filepath.Join(dir, fmt.Sprintf("%s_%s_%s.qlog", name, odcid, label))
+}
+
+// NewQlogTracer creates a tracer that writes a connection's qlog to path,
+// creating its directory if needed.
+func NewQlogTracer(path string, p logging.Perspective, odcid quic.ConnectionID) (*logging.ConnectionTracer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating qlog directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating qlog file: %w", err)
+	}
+	return qlog.NewConnectionTracer(&bufferedFile{Writer: bufio.NewWriter(f), f: f}, p, odcid), nil
+}
+
+// bufferedFile flushes its buffer when it is closed.
+type bufferedFile struct {
+	*bufio.Writer
+	f *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	if err := b.Writer.Flush(); err != nil {
+		b.f.Close()
+		return err
+	}
+	return b.f.Close()
+}
@@ -1,11 +1,13 @@
 package util
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -57,7 +59,13 @@ func GenerateTLSConfig() (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	// Clients won't resume TLS sessions with a certificate that has expired,
+	// so it needs a validity period
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
 	if err != nil {
 		return nil, err
@@ -75,15 +83,57 @@ func GenerateTLSConfig() (*tls.Config, error) {
 	}, nil
 }
 
+// JWT_SECRET_ENV names the environment variable the JWT secret is read from.
+const JWT_SECRET_ENV = "QHCP_JWT_SECRET"
+
+// ErrNoJWTSecret is returned when tokens are signed or verified before a
+// JWT secret has been configured.
+var ErrNoJWTSecret = errors.New("no JWT secret configured (set " + JWT_SECRET_ENV + ")")
+
+// jwtSecret signs and verifies the tokens load balancers present in HELLO.
+// It comes from JWT_SECRET_ENV unless SetJWTSecret or LoadJWTSecret
+// replaces it. Without one, no token is signed or accepted.
+var jwtSecret = []byte(os.Getenv(JWT_SECRET_ENV))
+
+// SetJWTSecret replaces the JWT secret. Call it before starting a server
+// or load balancer.
+func SetJWTSecret(secret []byte) {
+	jwtSecret = secret
+}
+
+// LoadJWTSecret makes the contents of the file at path the JWT secret,
+// without surrounding whitespace.
+func LoadJWTSecret(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading JWT secret: %w", err)
+	}
+	secret := bytes.TrimSpace(raw)
+	if len(secret) == 0 {
+		return fmt.Errorf("JWT secret file %s is empty", path)
+	}
+	SetJWTSecret(secret)
+	return nil
+}
+
+// HasJWTSecret reports whether a JWT secret is configured.
+func HasJWTSecret() bool {
+	return len(jwtSecret) > 0
+}
+
+// GenerateJWT signs a token for clientID, valid for a day. It returns ""
+// if no JWT secret is configured.
 func GenerateJWT(clientID string) string {
+	if !HasJWTSecret() {
+		log.Printf("Error generating JWT: %v", ErrNoJWTSecret)
+		return ""
+	}
 	// Create a new JWT token with the client ID as a claim
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"client_id": clientID,
 		"exp":       time.Now().Add(time.Hour * 24).Unix(),
 	})
-	// Sign the token with a secret key (replace with your own secret)
-	secretKey := []byte("your_secret_key")
-	tokenString, err := token.SignedString(secretKey)
+	tokenString, err := token.SignedString(jwtSecret)
 	if err != nil {
 		log.Printf("Error generating JWT: %v", err)
 		return ""
@@ -92,13 +142,52 @@ func GenerateJWT(clientID string) string {
 	return tokenString
 }
 
+// VerifyJWT checks the token's signature and expiry and returns its client ID.
 func VerifyJWT(tokenString string) (string, error) {
-	// Parse the JWT token (simplified, just trust the token)
-	token, _ := jwt.Parse(tokenString, nil)
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		clientID := claims["client_id"].(string)
-		return clientID, nil
+	if !HasJWTSecret() {
+		// An empty HMAC key would accept tokens anyone can sign
+		return "", ErrNoJWTSecret
+	}
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid JWT token: %w", err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", fmt.Errorf("invalid JWT token")
 	}
+	clientID, ok := claims["client_id"].(string)
+	if !ok || clientID == "" {
+		return "", fmt.Errorf("invalid JWT token: missing client_id")
+	}
+	return clientID, nil
+}
 
-	return "", fmt.Errorf("invalid JWT token")
+// LoadSessionTicketKey reads the 32-byte TLS session ticket key stored at
+// path, creating the file with a random key if it doesn't exist.
+func LoadSessionTicketKey(path string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := rand.Read(key[:]); err != nil {
+			return key, err
+		}
+		if err := os.WriteFile(path, key[:], 0o600); err != nil {
+			return key, fmt.Errorf("error saving session ticket key: %w", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return key, fmt.Errorf("error reading session ticket key: %w", err)
+	}
+	if len(raw) != len(key) {
+		return key, fmt.Errorf("session ticket key %s must be %d bytes, got %d", path, len(key), len(raw))
+	}
+	copy(key[:], raw)
+	return key, nil
 }
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJWTSecret(t *testing.T) {
+	defer SetJWTSecret(jwtSecret)
+
+	SetJWTSecret(nil)
+	if token := GenerateJWT("lb-1"); token != "" {
+		t.Errorf("GenerateJWT without a secret = %q, want none", token)
+	}
+	if _, err := VerifyJWT("e30.e30."); !errors.Is(err, ErrNoJWTSecret) {
+		t.Errorf("VerifyJWT without a secret = %v, want %v", err, ErrNoJWTSecret)
+	}
+
+	SetJWTSecret([]byte("secret-1"))
+	token := GenerateJWT("lb-1")
+	if clientID, err := VerifyJWT(token); err != nil || clientID != "lb-1" {
+		t.Errorf("VerifyJWT = %q, %v; want lb-1", clientID, err)
+	}
+	SetJWTSecret([]byte("secret-2"))
+	if _, err := VerifyJWT(token); err == nil {
+		t.Error("token signed with another secret was accepted")
+	}
+}
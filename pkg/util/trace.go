@@ -0,0 +1,26 @@
+package util
+
+import (
+	"fmt"
+	"os"
+
+	"drexel.edu/net-quic/pkg/pdu"
+)
+
+// CreateTrace creates the file at path and returns a PDU trace writing
+// to it in the given format (pdu.TRACE_JSONL if empty).
+func CreateTrace(path string, format string) (*pdu.Trace, error) {
+	if format == "" {
+		format = pdu.TRACE_JSONL
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace file: %w", err)
+	}
+	trace, err := pdu.NewTrace(f, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return trace, nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TransportConfig holds the QUIC transport parameters shared by the load
+// balancer and the server. Zero values fall back to quic-go's defaults.
+type TransportConfig struct {
+	// KeepAlivePeriod is how often a PING is sent on an otherwise quiet
+	// connection (0 disables keep-alives).
+	KeepAlivePeriod time.Duration
+	// MaxIdleTimeout closes a connection once nothing has been received
+	// for this long (0 means 30s).
+	MaxIdleTimeout time.Duration
+	// HandshakeTimeout gives up on a handshake that makes no progress for
+	// this long (0 means 5s). The whole handshake may take twice as long.
+	HandshakeTimeout time.Duration
+	// MaxIncomingStreams caps the streams the peer may have open at once
+	// (0 means 100, negative allows none).
+	MaxIncomingStreams int64
+	// DisableDatagrams turns off QUIC datagrams, and with them heartbeats.
+	DisableDatagrams bool
+}
+
+// QuicConfig returns a quic.Config with the transport parameters set.
+func (t TransportConfig) QuicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:      t.KeepAlivePeriod,
+		MaxIdleTimeout:       t.MaxIdleTimeout,
+		HandshakeIdleTimeout: t.HandshakeTimeout,
+		MaxIncomingStreams:   t.MaxIncomingStreams,
+		EnableDatagrams:      !t.DisableDatagrams,
+	}
+}
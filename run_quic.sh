@@ -19,6 +19,24 @@ show_menu() {
     echo -n "Enter your choice (1-3): "
 }
 
+# Function to ask for the JWT secret file, which every node needs to share
+read_jwt_secret_file() {
+    jwt_secret_file=""
+    while [ -z "$jwt_secret_file" ]; do
+        echo "Enter the JWT secret file shared by the load balancer and servers (leave blank to use \$QHCP_JWT_SECRET):"
+        read jwt_secret_file
+        if [ -z "$jwt_secret_file" ]; then
+            if [ -n "$QHCP_JWT_SECRET" ]; then
+                return
+            fi
+            echo "QHCP_JWT_SECRET is not set, so a secret file is required."
+        elif [ ! -f "$jwt_secret_file" ]; then
+            echo "No such file: $jwt_secret_file"
+            jwt_secret_file=""
+        fi
+    done
+}
+
 # Function to run the load balancer
 run_load_balancer() {
     echo "Enter the comma-separated list of server addresses (host:port) (e.g., localhost:4243,localhost:4244):"
@@ -33,10 +51,12 @@ run_load_balancer() {
     read reconnect_interval
     echo "Enter the TLS certificate file (leave blank for default):"
     read cert_file
+    read_jwt_secret_file
 
     init_module
 
     go run cmd/echo/echo.go -loadbalancer \
+        -jwt-secret-file "${jwt_secret_file}" \
         -servers "$servers" \
         -loadbalancer-port "${loadbalancer_port:-4242}" \
         -max-fail-attempts "${max_fail_attempts:-3}" \
@@ -55,10 +75,12 @@ run_server() {
     read key_file
     echo "Enter the TLS certificate file (leave blank for default):"
     read cert_file
+    read_jwt_secret_file
 
     init_module
 
     go run cmd/echo/echo.go -server \
+        -jwt-secret-file "${jwt_secret_file}" \
         -server-ip "${server_ip:-0.0.0.0}" \
         -server-port "${server_port:-4243}" \
         -key-file "${key_file}" \